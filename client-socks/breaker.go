@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// breaker stops dialing an upstream after consecutive failures until a
+// cooldown passed, then lets a single dial probe it again
+type breaker struct {
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// breakerConfig tells when breakers open, failures 0 disables them
+type breakerConfig struct {
+	failures int
+	cooldown time.Duration
+}
+
+// allow tells if the upstream may be dialed now
+func (c breakerConfig) allow(u *upstream, now time.Time) bool {
+	if c.failures <= 0 {
+		return true
+	}
+	b := &u.breaker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures < c.failures {
+		return true
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record counts the outcome of dialing the upstream, opening its breaker
+// after too many failures in a row and closing it on success
+func (c breakerConfig) record(log *zap.Logger, u *upstream, err error, now time.Time) {
+	if c.failures <= 0 {
+		return
+	}
+	b := &u.breaker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	wasOpen := b.failures >= c.failures
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		if wasOpen {
+			upstreamBreakerOpen.WithLabelValues(u.addr).Set(0)
+			log.Info("closing circuit breaker, upstream reachable again", zap.String("upstream", u.addr))
+		}
+		return
+	}
+	b.failures++
+	if b.failures >= c.failures {
+		b.openUntil = now.Add(c.cooldown)
+		if !wasOpen {
+			upstreamBreakerOpen.WithLabelValues(u.addr).Set(1)
+			upstreamBreakerTrips.WithLabelValues(u.addr).Inc()
+			log.Warn(
+				"opening circuit breaker, skipping upstream",
+				zap.String("upstream", u.addr),
+				zap.Int("failures", b.failures),
+				zap.Duration("cooldown", c.cooldown),
+			)
+		}
+	}
+}
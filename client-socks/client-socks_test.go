@@ -0,0 +1,627 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+	"util"
+
+	"go.uber.org/zap"
+)
+
+func TestProxyPipeClosesPeer(t *testing.T) {
+	localClient, local := net.Pipe()
+	remote, remoteServer := net.Pipe()
+	defer remoteServer.Close()
+
+	p := &proxy{log: zap.NewNop(), wait: make(chan struct{})}
+	exited := make(chan struct{}, 2)
+	go func() {
+		p.pipe(context.Background(), remote, local, isLocalConnection)
+		exited <- struct{}{}
+	}()
+	go func() {
+		p.pipe(context.Background(), local, remote, isLocalNotConnection)
+		exited <- struct{}{}
+	}()
+
+	// the local client going away has to end both directions
+	_ = localClient.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-exited:
+		case <-time.After(time.Second):
+			t.Fatalf("pipe %d did not exit", i)
+		}
+	}
+	select {
+	case <-p.wait:
+	default:
+		t.Fatalf("expected wait to be closed")
+	}
+	if p.closeReason != closeReasonEOF {
+		t.Fatalf("expected close reason %q, got %q", closeReasonEOF, p.closeReason)
+	}
+}
+
+func TestProxyPipeTimeouts(t *testing.T) {
+	tests := []struct {
+		name   string
+		send   bool
+		reason string
+	}{
+		// the server never answers
+		{"read", false, closeReasonTimeout},
+		// the server stops reading what the local client sends
+		{"write", true, closeReasonWriteTimeout},
+	}
+	for _, test := range tests {
+		localClient, local := net.Pipe()
+		remote, remoteServer := net.Pipe()
+
+		p := &proxy{log: zap.NewNop(), wait: make(chan struct{}), readTimeout: time.Second, writeTimeout: 50 * time.Millisecond}
+		if !test.send {
+			p.readTimeout = 50 * time.Millisecond
+		}
+		go p.pipe(context.Background(), remote, local, isLocalConnection)
+		go p.pipe(context.Background(), local, remote, isLocalNotConnection)
+		if test.send {
+			_, _ = localClient.Write([]byte("request"))
+		}
+
+		select {
+		case <-p.wait:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: expected the pipe to time out", test.name)
+		}
+		if p.closeReason != test.reason {
+			t.Fatalf("%s: expected close reason %q, got %q", test.name, test.reason, p.closeReason)
+		}
+		_ = localClient.Close()
+		_ = remoteServer.Close()
+	}
+}
+
+func TestProxyPipeOneWayTransfer(t *testing.T) {
+	localClient, local := net.Pipe()
+	remote, remoteServer := net.Pipe()
+	defer localClient.Close()
+	defer remoteServer.Close()
+
+	p := &proxy{log: zap.NewNop(), wait: make(chan struct{}), readTimeout: 100 * time.Millisecond}
+	go p.pipe(context.Background(), remote, local, isLocalConnection)
+	go p.pipe(context.Background(), local, remote, isLocalNotConnection)
+
+	// a download keeps the connection open while the local client is silent
+	go func() { _, _ = io.Copy(io.Discard, localClient) }()
+	for i := 0; i < 10; i++ {
+		if _, err := remoteServer.Write([]byte("chunk")); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+	select {
+	case <-p.wait:
+		t.Fatalf("connection closed during the transfer: %s", p.closeReason)
+	default:
+	}
+
+	// and once both sides are silent it times out
+	select {
+	case <-p.wait:
+	case <-time.After(time.Second):
+		t.Fatal("expected the silent connection to time out")
+	}
+	if p.closeReason != closeReasonTimeout {
+		t.Fatalf("expected close reason %q, got %q", closeReasonTimeout, p.closeReason)
+	}
+}
+
+func TestProxyPipeMaxTransferBytes(t *testing.T) {
+	localClient, local := net.Pipe()
+	remote, remoteServer := net.Pipe()
+	defer localClient.Close()
+	defer remoteServer.Close()
+
+	p := &proxy{log: zap.NewNop(), wait: make(chan struct{}), maxTransferBytes: 10}
+	go p.pipe(context.Background(), remote, local, isLocalConnection)
+	go p.pipe(context.Background(), local, remote, isLocalNotConnection)
+
+	go func() { _, _ = localClient.Write([]byte("ping")) }()
+	if _, err := io.ReadFull(remoteServer, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	// the write exceeding the cap is cut to what is left of it
+	go func() { _, _ = remoteServer.Write([]byte("0123456789")) }()
+	received, _ := io.ReadAll(localClient)
+	if string(received) != "012345" {
+		t.Errorf("expected the 6 bytes left of the cap, got %q", received)
+	}
+	<-p.wait
+	if p.closeReason != closeReasonMaxTransfer {
+		t.Fatalf("expected close reason %q, got %q", closeReasonMaxTransfer, p.closeReason)
+	}
+}
+
+// tcpPair returns both ends of a loopback tcp connection
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestProxyPipeHalfClose(t *testing.T) {
+	for _, halfClose := range []bool{true, false} {
+		localClient, local := tcpPair(t)
+		remote, destination := tcpPair(t)
+
+		p := &proxy{log: zap.NewNop(), wait: make(chan struct{}), halfClose: halfClose}
+		exited := make(chan struct{}, 2)
+		go func() {
+			p.pipe(context.Background(), remote, local, isLocalConnection)
+			exited <- struct{}{}
+		}()
+		go func() {
+			p.pipe(context.Background(), local, remote, isLocalNotConnection)
+			exited <- struct{}{}
+		}()
+
+		// the client is done sending, the destination sees that
+		_ = localClient.CloseWrite()
+		buf := make([]byte, 64)
+		_ = destination.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := destination.Read(buf); err != io.EOF {
+			t.Fatalf("half close %v: expected eof at the destination, got %d bytes, %v", halfClose, n, err)
+		}
+		if !halfClose {
+			<-p.wait
+		}
+
+		// and keeps sending its answer
+		_, _ = destination.Write([]byte("late answer"))
+		_ = destination.Close()
+
+		_ = localClient.SetReadDeadline(time.Now().Add(time.Second))
+		answer, _ := io.ReadAll(localClient)
+		if halfClose && string(answer) != "late answer" {
+			t.Fatalf("expected the late answer to be relayed, got %q", answer)
+		}
+		if !halfClose && len(answer) > 0 {
+			t.Fatalf("expected nothing to be relayed after closing, got %q", answer)
+		}
+
+		for i := 0; i < 2; i++ {
+			select {
+			case <-exited:
+			case <-time.After(time.Second):
+				t.Fatalf("half close %v: pipe %d did not exit", halfClose, i)
+			}
+		}
+		if p.closeReason != closeReasonEOF {
+			t.Fatalf("half close %v: expected close reason %q, got %q", halfClose, closeReasonEOF, p.closeReason)
+		}
+		_ = localClient.Close()
+	}
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		requests <- request
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhello"))
+	}()
+
+	proxyURL, _ := url.Parse("http://jan:secret@" + listener.Addr().String())
+	dialer, err := newHTTPConnectDialer(proxyURL, &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", "server.example.com:8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := <-requests
+	if request.Method != http.MethodConnect || request.Host != "server.example.com:8000" {
+		t.Errorf("unexpected request %s %s", request.Method, request.Host)
+	}
+	if user, password, ok := request.BasicAuth(); ok || user != "" || password != "" {
+		t.Errorf("credentials belong in Proxy-Authorization, not Authorization")
+	}
+	if request.Header.Get("Proxy-Authorization") != "Basic amFuOnNlY3JldA==" {
+		t.Errorf("unexpected Proxy-Authorization %q", request.Header.Get("Proxy-Authorization"))
+	}
+	hello := make([]byte, 5)
+	if _, err := io.ReadFull(conn, hello); err != nil || string(hello) != "hello" {
+		t.Errorf("expected data sent along with the response, got %q, %v", hello, err)
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	s := &connStats{}
+	s.started()
+	s.started()
+	if snapshot := s.snapshot(); snapshot.ActiveConnections != 2 {
+		t.Fatalf("expected 2 active connections, got %d", snapshot.ActiveConnections)
+	}
+	s.ended(statusOK, 10, 20)
+	s.ended(statusDialFailed, 0, 0)
+	want := statsSnapshot{BytesSent: 10, BytesReceived: 20, SucceededConnections: 1, FailedConnections: 1}
+	if snapshot := s.snapshot(); snapshot != want {
+		t.Errorf("unexpected stats %+v, want %+v", snapshot, want)
+	}
+}
+
+func TestParseUpstreams(t *testing.T) {
+	upstreams, weighted, err := parseUpstreams("host1:8001=3, host2:8001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !weighted || len(upstreams) != 2 || upstreams[0].weight != 3 || upstreams[1].weight != 1 || upstreams[1].addr != "host2:8001" {
+		t.Fatalf("unexpected upstreams %+v %+v", upstreams[0], upstreams[1])
+	}
+	for _, invalid := range []string{"", "host1:8001=0", "host1:8001=x"} {
+		if _, _, err := parseUpstreams(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestTunnelOrderWeighted(t *testing.T) {
+	upstreams, weighted, _ := parseUpstreams("big=3,small=1")
+	tunnel := &tunnelConfig{upstreams: upstreams, weighted: weighted}
+	first := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		order := tunnel.order()
+		if len(order) != 2 || order[0] == order[1] {
+			t.Fatalf("every upstream has to be tried once, got %v", order)
+		}
+		first[order[0].addr]++
+	}
+	if first["big"] < 2700 || first["big"] > 3300 {
+		t.Errorf("big should be tried first about 3 of 4 times, was %d of 4000", first["big"])
+	}
+
+	tunnel.weighted = false
+	if order := tunnel.order(); order[0].addr != "big" || order[1].addr != "small" {
+		t.Errorf("without weights upstreams are tried in order")
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	config := breakerConfig{failures: 2, cooldown: time.Minute}
+	u := &upstream{addr: "host:8000", weight: 1}
+	now := time.Now()
+	failed := errors.New("dial failed")
+
+	for i := 0; i < 2; i++ {
+		if !config.allow(u, now) {
+			t.Fatalf("breaker opened after %d failures only", i)
+		}
+		config.record(zap.NewNop(), u, failed, now)
+	}
+	if config.allow(u, now.Add(time.Second)) {
+		t.Fatal("breaker should be open during the cooldown")
+	}
+	later := now.Add(2 * time.Minute)
+	if !config.allow(u, later) {
+		t.Fatal("breaker should allow probing after the cooldown")
+	}
+	if config.allow(u, later) {
+		t.Fatal("only a single probe may be on the way")
+	}
+	config.record(zap.NewNop(), u, nil, later)
+	if !config.allow(u, later) {
+		t.Fatal("breaker should close once the probe succeeded")
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	local, client := net.Pipe()
+	defer local.Close()
+	go func() {
+		_, _ = client.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic amFuOnNlY3JldA==\r\n\r\n"))
+	}()
+	connect, _ := readHTTPConnect(zap.NewNop(), local)
+	if connect == nil {
+		t.Fatal("expected a CONNECT request")
+	}
+	if connect.target != "example.com:443" || connect.user != "jan" || connect.password != "secret" {
+		t.Fatalf("unexpected CONNECT %+v", connect)
+	}
+
+	for _, test := range []struct {
+		reply  byte
+		status int
+	}{
+		{socksSucceeded, 0},
+		{socksNotAllowed, http.StatusForbidden},
+		{4, http.StatusBadGateway},
+	} {
+		remote, server := net.Pipe()
+		received := make(chan []byte, 1)
+		go func() {
+			defer server.Close()
+			// greeting, user and password, connect request
+			buf := make([]byte, 3+12+18)
+			if _, err := io.ReadFull(server, buf[:3]); err != nil {
+				return
+			}
+			_, _ = server.Write([]byte{socksVersion, socksUserPassAuth})
+			if _, err := io.ReadFull(server, buf[3:15]); err != nil {
+				return
+			}
+			_, _ = server.Write([]byte{1, socksAuthSucceeded})
+			if _, err := io.ReadFull(server, buf[15:]); err != nil {
+				return
+			}
+			received <- buf
+			_, _ = server.Write([]byte{socksVersion, test.reply, 0, socksIPv4Address, 10, 0, 0, 1, 0, 80})
+		}()
+		err := connect.socksConnect(remote)
+		expected := append([]byte{5, 1, 2, 1, 3}, "jan"...)
+		expected = append(append(expected, 6), "secret"...)
+		expected = append(append(expected, 5, 1, 0, 3, 11), "example.com"...)
+		expected = append(expected, 1, 187)
+		if buf := <-received; !bytes.Equal(buf, expected) {
+			t.Errorf("expected %v, got %v", expected, buf)
+		}
+		if test.status == 0 && err != nil {
+			t.Errorf("reply %d: %v", test.reply, err)
+		}
+		if test.status != 0 && (err == nil || httpStatus(err) != test.status) {
+			t.Errorf("reply %d: expected status %d, got %v", test.reply, test.status, err)
+		}
+		remote.Close()
+	}
+}
+
+func TestAuthenticateUpstream(t *testing.T) {
+	local, localClient := net.Pipe()
+	remote, server := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	// the local client only offers username/password with its own
+	// credentials, which are not passed on
+	go func() {
+		_, _ = localClient.Write([]byte{socksVersion, 1, socksUserPassAuth})
+		reply := make([]byte, 2)
+		if _, err := io.ReadFull(localClient, reply); err != nil || reply[1] != socksUserPassAuth {
+			return
+		}
+		_, _ = localClient.Write(append(append([]byte{1, 3}, "app"...), append([]byte{1}, "x"...)...))
+		_, _ = io.ReadFull(localClient, reply)
+	}()
+	received := make(chan []byte, 1)
+	go func() {
+		defer server.Close()
+		buf := make([]byte, 3+8)
+		if _, err := io.ReadFull(server, buf[:3]); err != nil {
+			return
+		}
+		_, _ = server.Write([]byte{socksVersion, socksUserPassAuth})
+		if _, err := io.ReadFull(server, buf[3:]); err != nil {
+			return
+		}
+		received <- buf
+		_, _ = server.Write([]byte{1, socksAuthSucceeded})
+	}()
+
+	if err := authenticateUpstream(local, remote, "svc", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	expected := append(append([]byte{5, 1, 2, 1, 3}, "svc"...), append([]byte{2}, "pw"...)...)
+	if buf := <-received; !bytes.Equal(buf, expected) {
+		t.Fatalf("expected %v, got %v", expected, buf)
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	for addr, expected := range map[string]bool{
+		"127.0.0.1:8080": true,
+		"[::1]:8080":     true,
+		"localhost:8080": true,
+		"0.0.0.0:8080":   false,
+		":8080":          false,
+		"10.0.0.1:8080":  false,
+		"[::]:8080":      false,
+		"invalid":        false,
+	} {
+		if isLoopbackAddr(addr) != expected {
+			t.Errorf("expected %s loopback %v", addr, expected)
+		}
+	}
+}
+
+func TestReadPasswordFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pass")
+	if err := os.WriteFile(file, []byte("s3cr et\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if password, err := readPasswordFile(file); err != nil || password != "s3cr et" {
+		t.Fatalf("expected the password without the newline, got %q %v", password, err)
+	}
+	if _, err := readPasswordFile(file + ".missing"); err == nil {
+		t.Fatal("expected a missing file to fail")
+	}
+}
+
+func TestDirectRules(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "direct.txt")
+	rules := "# trusted destinations\n10.0.0.0/8\n192.0.2.10 # a single ip\n\ncorp.example.com\n*.internal\n"
+	if err := os.WriteFile(file, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	direct, err := loadDirectRules(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for target, expected := range map[string]bool{
+		"10.1.2.3:443":            true,
+		"192.0.2.10:80":           true,
+		"192.0.2.11:80":           false,
+		"corp.example.com:443":    true,
+		"git.corp.example.com:22": true,
+		"notcorp.example.com:443": false,
+		"db.internal:5432":        true,
+		"www.example.com:443":     false,
+		"[2001:db8::1]:443":       false,
+		"":                        false,
+	} {
+		if direct.matches(target) != expected {
+			t.Errorf("%q: expected direct=%v", target, expected)
+		}
+	}
+	if (*directRules)(nil).matches("10.1.2.3:443") {
+		t.Error("without rules nothing should be direct")
+	}
+}
+
+func TestReadLocalSocks(t *testing.T) {
+	local, localClient := net.Pipe()
+	defer local.Close()
+	defer localClient.Close()
+	go func() {
+		_, _ = localClient.Write([]byte{socksVersion, 2, socksNoAuth, socksUserPassAuth})
+		reply := make([]byte, 2)
+		if _, err := io.ReadFull(localClient, reply); err != nil || reply[1] != socksUserPassAuth {
+			return
+		}
+		_, _ = localClient.Write(append(append([]byte{1, 3}, "jan"...), append([]byte{6}, "secret"...)...))
+		_, _ = io.ReadFull(localClient, reply)
+		_, _ = localClient.Write(append(append([]byte{socksVersion, socksConnect, 0, socksFQDNAddress, 11}, "example.com"...), 1, 187))
+	}()
+
+	request, err := readLocalSocks(local, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.target != "example.com:443" || request.user != "jan" || request.password != "secret" {
+		t.Fatalf("unexpected request %+v", request)
+	}
+	if expected := append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 1, 187); !bytes.Equal(request.raw, expected) {
+		t.Fatalf("expected the raw request %v, got %v", expected, request.raw)
+	}
+}
+
+func TestServeDirect(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	direct := &directRules{}
+	if err := direct.add("127.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	// no server is reachable, the destination has to be dialed directly
+	tunnel := &tunnelConfig{mode: modeSocks, direct: direct}
+	local, localClient := net.Pipe()
+	defer localClient.Close()
+	go serve(context.Background(), zap.NewNop(), local, tunnel, 1)
+
+	addr := echo.Addr().(*net.TCPAddr)
+	_, _ = localClient.Write([]byte{socksVersion, 1, socksNoAuth})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(localClient, reply); err != nil || reply[1] != socksNoAuth {
+		t.Fatalf("unexpected method reply %v, %v", reply, err)
+	}
+	_, _ = localClient.Write(append([]byte{socksVersion, socksConnect, 0, socksIPv4Address}, append(addr.IP.To4(), byte(addr.Port>>8), byte(addr.Port))...))
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(localClient, header); err != nil || header[1] != socksSucceeded {
+		t.Fatalf("unexpected reply %v, %v", header, err)
+	}
+	_, _ = localClient.Write([]byte("ping"))
+	answer := make([]byte, 4)
+	_ = localClient.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(localClient, answer); err != nil || string(answer) != "ping" {
+		t.Fatalf("expected the echo, got %q, %v", answer, err)
+	}
+}
+
+func TestMuxPoolDialsUpToSize(t *testing.T) {
+	var dials int32
+	release := make(chan struct{})
+	pool := &muxPool{size: 1, dialSession: func(*zap.Logger, *tunnelConfig) *muxSession {
+		atomic.AddInt32(&dials, 1)
+		<-release
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() {
+			_ = clientConn.Close()
+			_ = serverConn.Close()
+		})
+		go func() { _, _ = io.Copy(io.Discard, serverConn) }()
+		session, err := util.NewMuxClient(clientConn)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		return &muxSession{MuxSession: session, upstream: "test"}
+	}}
+
+	// openers arriving while the first session is dialed wait for it
+	sessions := make(chan *muxSession, 5)
+	for i := 0; i < 5; i++ {
+		go func() { sessions <- pool.session(zap.NewNop(), nil) }()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	var first *muxSession
+	for i := 0; i < 5; i++ {
+		session := <-sessions
+		if session == nil || (first != nil && session != first) {
+			t.Fatalf("expected every opener to share the session, got %v", session)
+		}
+		first = session
+	}
+	if dials := atomic.LoadInt32(&dials); dials != 1 {
+		t.Errorf("expected 1 session dialed with -mux-conns 1, got %d", dials)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// upstreamDirect is the upstream of destinations dialed directly
+const upstreamDirect = "direct"
+
+// directRules are the destinations the client dials itself instead of
+// tunneling them through the servers, by network or by domain
+type directRules struct {
+	networks []*net.IPNet
+	// domains match themselves and their subdomains
+	domains []string
+}
+
+// loadDirectRules reads a rule per line, a cidr like 10.0.0.0/8, an ip or
+// a domain like example.com, # starts a comment
+func loadDirectRules(file string) (*directRules, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("can not read direct rules: %v", err)
+	}
+	defer f.Close()
+	rules := &directRules{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		rule := scanner.Text()
+		if i := strings.Index(rule, "#"); i >= 0 {
+			rule = rule[:i]
+		}
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		if err := rules.add(rule); err != nil {
+			return nil, fmt.Errorf("direct rules line %d: %v", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can not read direct rules: %v", err)
+	}
+	return rules, nil
+}
+
+func (r *directRules) add(rule string) error {
+	if strings.Contains(rule, "/") {
+		_, network, err := net.ParseCIDR(rule)
+		if err != nil {
+			return fmt.Errorf("invalid cidr %q", rule)
+		}
+		r.networks = append(r.networks, network)
+		return nil
+	}
+	if ip := net.ParseIP(rule); ip != nil {
+		bits := 8 * len(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		r.networks = append(r.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		return nil
+	}
+	domain := strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(rule, "*"), "."))
+	if domain == "" || strings.ContainsAny(domain, " :*") {
+		return fmt.Errorf("not a cidr, ip or domain %q", rule)
+	}
+	r.domains = append(r.domains, domain)
+	return nil
+}
+
+// matches tells if target like example.com:443 is dialed directly, names
+// are matched by domain without resolving them
+func (r *directRules) matches(target string) bool {
+	if r == nil || target == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range r.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range r.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// directDialer dials target instead of an upstream server, like
+// dialUpstream it returns nil if it can not be reached
+func directDialer(target string) func(logger *zap.Logger, tunnel *tunnelConfig) (net.Conn, string) {
+	return func(logger *zap.Logger, tunnel *tunnelConfig) (net.Conn, string) {
+		conn, err := net.DialTimeout("tcp", target, connDeadline)
+		if err != nil {
+			logger.Warn("could not reach direct destination", zap.Error(err))
+			return nil, ""
+		}
+		tunnel.tuneTCP(conn)
+		return conn, upstreamDirect
+	}
+}
+
+// socksRequest is the request of a local socks5 client read by the client
+// itself, to pick between dialing it directly and the servers
+type socksRequest struct {
+	command byte
+	// target is the host:port requested
+	target string
+	// raw is the request as read, passed on to the server
+	raw []byte
+	// user and password the local client authenticated with, if any
+	user     string
+	password string
+}
+
+// readLocalSocks answers the greeting of a local socks5 client and reads
+// its request. The credentials of the client are kept to authenticate to
+// the server with, preferUserPass asks for them if the client has some.
+func readLocalSocks(conn net.Conn, preferUserPass bool) (*socksRequest, error) {
+	user, password, err := acceptLocalSocks(conn, preferUserPass)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	request := &socksRequest{command: header[1], raw: header, user: user, password: password}
+	var host string
+	switch header[3] {
+	case socksIPv4Address, socksIPv6Address:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socksIPv6Address {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		request.raw = append(request.raw, ip...)
+		host = ip.String()
+	case socksFQDNAddress:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return nil, err
+		}
+		request.raw = append(append(request.raw, length...), name...)
+		host = string(name)
+	default:
+		_ = sendSocksReply(conn, socksAddrTypeNotSupported, nil)
+		return nil, fmt.Errorf("unsupported socks address type %d", header[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+	request.raw = append(request.raw, port...)
+	request.target = net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	return request, nil
+}
+
+// directTarget is what a connection asks for if it may be dialed directly,
+// empty for requests only a server can serve like bind
+func directTarget(connect *httpConnect, request *socksRequest) string {
+	switch {
+	case connect != nil:
+		return connect.target
+	case request != nil && request.command == socksConnect:
+		return request.target
+	}
+	return ""
+}
+
+// sendSocksReply answers the request of a local socks5 client in place of
+// the server, with the address bound if known
+func sendSocksReply(conn net.Conn, reply byte, bound net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if tcpAddr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = tcpAddr.IP, tcpAddr.Port
+	}
+	message := []byte{socksVersion, reply, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		message = append(append(message, socksIPv4Address), ip4...)
+	} else {
+		message = append(append(message, socksIPv6Address), ip.To16()...)
+	}
+	_, err := conn.Write(append(message, byte(port>>8), byte(port)))
+	return err
+}
@@ -2,7 +2,10 @@ module client-socks
 
 go 1.18
 
-require github.com/prometheus/client_golang v1.12.2
+require (
+	github.com/prometheus/client_golang v1.12.2
+	golang.org/x/net v0.0.0-20220708220712-1185a9018129
+)
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
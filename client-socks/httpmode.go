@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// modes of the local listener
+const (
+	// modeSocks relays socks5 clients to the server as they are
+	modeSocks = "socks"
+	// modeHTTP serves HTTP CONNECT and speaks socks5 to the server itself
+	modeHTTP = "http"
+)
+
+// socks5 protocol bytes used in http mode and to authenticate to the server
+const (
+	socksVersion              = 5
+	socksNoAuth               = 0
+	socksUserPassAuth         = 2
+	socksNoAcceptable         = 0xff
+	socksConnect              = 1
+	socksIPv4Address          = 1
+	socksFQDNAddress          = 3
+	socksIPv6Address          = 4
+	socksSucceeded            = 0
+	socksFailure              = 1
+	socksNotAllowed           = 2
+	socksUnreachable          = 4
+	socksTTLExpired           = 6
+	socksAddrTypeNotSupported = 8
+	socksAuthSucceeded        = 0
+)
+
+// httpConnect is a CONNECT request read from a local http client
+type httpConnect struct {
+	// target is the host:port to tunnel to
+	target   string
+	user     string
+	password string
+}
+
+// readHTTPConnect reads a CONNECT request from conn. Anything else is
+// answered with an error and nil is returned. The returned conn reads what
+// the client sent after the request first.
+func readHTTPConnect(logger *zap.Logger, conn net.Conn) (*httpConnect, net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(connDeadline))
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		logger.Info("could not read http request", zap.Error(err))
+		return nil, conn
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if request.Method != http.MethodConnect {
+		logger.Info("http request is not a CONNECT", zap.String("method", request.Method))
+		writeHTTPStatus(conn, http.StatusMethodNotAllowed)
+		return nil, conn
+	}
+	if _, _, err := net.SplitHostPort(request.Host); err != nil {
+		logger.Info("invalid CONNECT target", zap.String("target", request.Host), zap.Error(err))
+		writeHTTPStatus(conn, http.StatusBadRequest)
+		return nil, conn
+	}
+	connect := &httpConnect{target: request.Host}
+	if request.Header.Get("Proxy-Authorization") != "" {
+		// the basic auth of the proxy is passed on to the server
+		request.Header.Set("Authorization", request.Header.Get("Proxy-Authorization"))
+		user, password, ok := request.BasicAuth()
+		if !ok {
+			writeHTTPStatus(conn, http.StatusProxyAuthRequired)
+			return nil, conn
+		}
+		connect.user, connect.password = user, password
+	}
+	if reader.Buffered() > 0 {
+		conn = &bufferedConn{Conn: conn, reader: reader}
+	}
+	return connect, conn
+}
+
+// errSocksNotAllowed is returned by socksConnect when the server denies
+// the credentials or the target
+var errSocksNotAllowed = errors.New("not allowed by the server")
+
+// socksConnect asks the server on conn to connect to the target of the
+// CONNECT request
+func (c *httpConnect) socksConnect(conn net.Conn) error {
+	if err := socksAuthenticate(conn, c.user, c.password); err != nil {
+		return err
+	}
+
+	request, err := socksConnectRequest(c.target)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != socksSucceeded {
+		return socksReplyError(header[1])
+	}
+	// skip the bound address
+	var addrLen int
+	switch header[3] {
+	case socksIPv4Address:
+		addrLen = net.IPv4len
+	case socksIPv6Address:
+		addrLen = net.IPv6len
+	case socksFQDNAddress:
+		if _, err := io.ReadFull(conn, header[:1]); err != nil {
+			return err
+		}
+		addrLen = int(header[0])
+	default:
+		return fmt.Errorf("unexpected socks address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+// socksConnectRequest encodes a connect request to target
+func socksConnectRequest(target string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portString)
+	}
+	request := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %q too long", host)
+		}
+		request = append(append(request, socksFQDNAddress, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(append(request, socksIPv4Address), ip4...)
+	} else {
+		request = append(append(request, socksIPv6Address), ip...)
+	}
+	return append(request, byte(port>>8), byte(port)), nil
+}
+
+// socksReplyError is a failure reply of the server
+type socksReplyError byte
+
+func (e socksReplyError) Error() string {
+	return fmt.Sprintf("socks server replied %d", byte(e))
+}
+
+// httpStatus is the status answering the CONNECT request for a failure to
+// set up the tunnel
+func httpStatus(err error) int {
+	var reply socksReplyError
+	switch {
+	case errors.Is(err, errSocksNotAllowed):
+		return http.StatusForbidden
+	case errors.As(err, &reply) && byte(reply) == socksNotAllowed:
+		return http.StatusForbidden
+	case errors.As(err, &reply) && byte(reply) == socksTTLExpired:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func writeHTTPStatus(conn net.Conn, status int) {
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+}
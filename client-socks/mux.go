@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"util"
+
+	"go.uber.org/zap"
+)
+
+// muxPool shares a few multiplexed connections to the servers among all
+// local connections, so only the connections opening them pay for the tls
+// handshake. The server has to use -mux too.
+type muxPool struct {
+	// size is how many sessions are kept open at most
+	size     int
+	lock     sync.Mutex
+	sessions []*muxSession
+	// dialing counts the sessions being dialed, dialed is signaled when
+	// one is done
+	dialing int
+	dialed  *sync.Cond
+	// dialSession dials a session, nil means dial
+	dialSession func(logger *zap.Logger, tunnel *tunnelConfig) *muxSession
+}
+
+// muxSession is a session to an upstream server
+type muxSession struct {
+	*util.MuxSession
+	upstream string
+}
+
+// open opens a stream to an upstream server like dialUpstream dials one,
+// returning nil if no session could be opened
+func (p *muxPool) open(logger *zap.Logger, tunnel *tunnelConfig) (net.Conn, string) {
+	// a session may have ended since it was picked, the retry dials anew
+	for attempt := 0; attempt < 2; attempt++ {
+		session := p.session(logger, tunnel)
+		if session == nil {
+			return nil, ""
+		}
+		stream, err := session.Open()
+		if err == nil {
+			return stream, session.upstream
+		}
+		logger.Warn("could not open mux stream", zap.String("upstream", session.upstream), zap.Error(err))
+	}
+	return nil, ""
+}
+
+// session returns the session with the fewest streams, dialing a new one
+// while there are less than size. Without a session to share it waits for
+// the sessions being dialed.
+func (p *muxPool) session(logger *zap.Logger, tunnel *tunnelConfig) *muxSession {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.dialed == nil {
+		p.dialed = sync.NewCond(&p.lock)
+	}
+	dialSession := p.dialSession
+	if dialSession == nil {
+		dialSession = p.dial
+	}
+	for {
+		live := p.sessions[:0]
+		for _, session := range p.sessions {
+			if !session.IsClosed() {
+				live = append(live, session)
+			}
+		}
+		p.sessions = live
+
+		if len(p.sessions)+p.dialing < p.size {
+			p.dialing++
+			p.lock.Unlock()
+			session := dialSession(logger, tunnel)
+			p.lock.Lock()
+			p.dialing--
+			p.dialed.Broadcast()
+			if session != nil {
+				p.sessions = append(p.sessions, session)
+				return session
+			}
+			break
+		}
+		if len(p.sessions) > 0 || p.dialing == 0 {
+			break
+		}
+		p.dialed.Wait()
+	}
+
+	var least *muxSession
+	for _, session := range p.sessions {
+		if !session.IsClosed() && (least == nil || session.NumStreams() < least.NumStreams()) {
+			least = session
+		}
+	}
+	return least
+}
+
+func (p *muxPool) dial(logger *zap.Logger, tunnel *tunnelConfig) *muxSession {
+	conn, upstream := dialUpstream(logger, tunnel)
+	if conn == nil {
+		return nil
+	}
+	if tunnel.padding {
+		conn = util.NewPaddedConn(conn)
+	}
+	session, err := util.NewMuxClient(conn)
+	if err != nil {
+		logger.Warn("could not start mux session", zap.String("upstream", upstream), zap.Error(err))
+		util.SilentClose(conn)
+		return nil
+	}
+	logger.Info("opened mux session", zap.String("upstream", upstream))
+	return &muxSession{MuxSession: session, upstream: upstream}
+}
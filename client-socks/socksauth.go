@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// socksUserPassVersion is the version of the username/password
+// subnegotiation
+const socksUserPassVersion = 1
+
+// socksAuthenticate greets the server on conn and authenticates with user
+// and password, without credentials if user is empty
+func socksAuthenticate(conn net.Conn, user, password string) error {
+	method := byte(socksNoAuth)
+	if user != "" {
+		method = socksUserPassAuth
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] == socksNoAcceptable {
+		return errSocksNotAllowed
+	}
+	if reply[0] != socksVersion || reply[1] != method {
+		return fmt.Errorf("unexpected socks method reply %v", reply)
+	}
+	if method != socksUserPassAuth {
+		return nil
+	}
+	if len(user) > 255 || len(password) > 255 {
+		return errors.New("user or password too long")
+	}
+	auth := append([]byte{socksUserPassVersion, byte(len(user))}, user...)
+	auth = append(append(auth, byte(len(password))), password...)
+	if _, err := conn.Write(auth); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != socksAuthSucceeded {
+		return errSocksNotAllowed
+	}
+	return nil
+}
+
+// acceptLocalSocks answers the greeting of a local socks5 client in place
+// of the server, so the client goes on with its request right away.
+// Clients offering no authentication are accepted as they are, unless
+// preferUserPass picks username/password if offered too. The credentials
+// of clients authenticating are returned, they are not checked.
+func acceptLocalSocks(conn net.Conn, preferUserPass bool) (user, password string, err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != socksVersion {
+		return "", "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", "", err
+	}
+	method := byte(socksNoAcceptable)
+	switch {
+	case preferUserPass && bytes.IndexByte(methods, socksUserPassAuth) >= 0:
+		method = socksUserPassAuth
+	case bytes.IndexByte(methods, socksNoAuth) >= 0:
+		method = socksNoAuth
+	case bytes.IndexByte(methods, socksUserPassAuth) >= 0:
+		method = socksUserPassAuth
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", "", err
+	}
+	switch method {
+	case socksNoAcceptable:
+		return "", "", errors.New("no supported socks authentication method offered")
+	case socksUserPassAuth:
+		// the version and the length of the user, the user and the length
+		// of the password, then the password
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return "", "", err
+		}
+		userBytes := make([]byte, int(header[1])+1)
+		if _, err := io.ReadFull(conn, userBytes); err != nil {
+			return "", "", err
+		}
+		passwordBytes := make([]byte, userBytes[len(userBytes)-1])
+		if _, err := io.ReadFull(conn, passwordBytes); err != nil {
+			return "", "", err
+		}
+		if _, err := conn.Write([]byte{socksUserPassVersion, socksAuthSucceeded}); err != nil {
+			return "", "", err
+		}
+		return string(userBytes[:len(userBytes)-1]), string(passwordBytes), nil
+	}
+	return "", "", nil
+}
+
+// authenticateUpstream authenticates to the server on remoteConn with the
+// shared upstream credentials in place of the local client on localConn,
+// which then sends its request to the server as usual
+func authenticateUpstream(localConn, remoteConn net.Conn, user, password string) error {
+	if _, _, err := acceptLocalSocks(localConn, false); err != nil {
+		return fmt.Errorf("local client: %v", err)
+	}
+	return socksAuthenticate(remoteConn, user, password)
+}
+
+// isLoopbackAddr tells if the listen address addr only accepts clients of
+// the same host, an empty host listens on every interface
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// readPasswordFile reads a password kept in file, without trailing newlines
+func readPasswordFile(file string) (string, error) {
+	password, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(password), "\r\n"), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// connStats aggregates the connections of all serve goroutines
+type connStats struct {
+	active        int64
+	bytesSent     uint64
+	bytesReceived uint64
+	succeeded     uint64
+	failed        uint64
+}
+
+var stats = &connStats{}
+
+// statsSnapshot is the json served on /stats
+type statsSnapshot struct {
+	ActiveConnections    int64  `json:"active_connections"`
+	BytesSent            uint64 `json:"bytes_sent"`
+	BytesReceived        uint64 `json:"bytes_received"`
+	SucceededConnections uint64 `json:"succeeded_connections"`
+	FailedConnections    uint64 `json:"failed_connections"`
+}
+
+func (s *connStats) started() {
+	atomic.AddInt64(&s.active, 1)
+}
+
+// ended counts a connection that ended with status after transferring
+// the given bytes
+func (s *connStats) ended(status string, sent, received uint64) {
+	atomic.AddInt64(&s.active, -1)
+	atomic.AddUint64(&s.bytesSent, sent)
+	atomic.AddUint64(&s.bytesReceived, received)
+	if status == statusOK {
+		atomic.AddUint64(&s.succeeded, 1)
+	} else {
+		atomic.AddUint64(&s.failed, 1)
+	}
+}
+
+func (s *connStats) snapshot() statsSnapshot {
+	return statsSnapshot{
+		ActiveConnections:    atomic.LoadInt64(&s.active),
+		BytesSent:            atomic.LoadUint64(&s.bytesSent),
+		BytesReceived:        atomic.LoadUint64(&s.bytesReceived),
+		SucceededConnections: atomic.LoadUint64(&s.succeeded),
+		FailedConnections:    atomic.LoadUint64(&s.failed),
+	}
+}
+
+// runStatsHandler serves the stats as json on /stats
+func runStatsHandler(ctx context.Context, log *zap.Logger, address string, s *connStats) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.snapshot())
+	})
+	server := &http.Server{Addr: address, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		log.Info("Shutdown stats handler in progress")
+		_ = server.Shutdown(context.Background())
+	}()
+
+	log.Info("Starting stats handler", zap.String("addr", address))
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal("Failed to start stats handler", zap.Error(err))
+	}
+}
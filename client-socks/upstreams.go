@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// upstream is a tls socks server connections are tunneled to
+type upstream struct {
+	addr string
+	// weight is the share of connections the upstream gets relative to
+	// the others
+	weight  int
+	breaker breaker
+}
+
+// parseUpstreams parses comma separated addresses with optional weights
+// like host1:8001=3,host2:8001=1, addresses without a weight weigh 1.
+// weighted tells if any weight was given.
+func parseUpstreams(list string) (upstreams []*upstream, weighted bool, err error) {
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		u := &upstream{addr: entry, weight: 1}
+		if addr, weight, ok := strings.Cut(entry, "="); ok {
+			if u.weight, err = strconv.Atoi(weight); err != nil || u.weight < 1 {
+				return nil, false, fmt.Errorf("invalid weight %q of %s, expected a positive number", weight, addr)
+			}
+			u.addr = addr
+			weighted = true
+		}
+		upstreams = append(upstreams, u)
+	}
+	if len(upstreams) == 0 {
+		return nil, false, fmt.Errorf("no server given")
+	}
+	return upstreams, weighted, nil
+}
+
+// order returns the upstreams in the order to try them. Without weights
+// that is the listed order, otherwise a weighted random one so an upstream
+// is tried first in proportion to its weight and the rest are failed over
+// to.
+func (t *tunnelConfig) order() []*upstream {
+	if !t.weighted {
+		return t.upstreams
+	}
+	remaining := append([]*upstream{}, t.upstreams...)
+	ordered := make([]*upstream, 0, len(remaining))
+	for len(remaining) > 0 {
+		total := 0
+		for _, u := range remaining {
+			total += u.weight
+		}
+		pick := rand.Intn(total)
+		for i, u := range remaining {
+			if pick -= u.weight; pick < 0 {
+				ordered = append(ordered, u)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+	return ordered
+}
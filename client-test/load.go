@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// loadResult is the outcome of one request of a load test
+type loadResult struct {
+	latency time.Duration
+	err     error
+}
+
+// runLoad fires requests from concurrency workers and prints the success
+// rate, latency percentiles and throughput. It returns if all succeeded.
+func runLoad(client *http.Client, spec *requestSpec, concurrency, requests int) bool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	jobs := make(chan struct{})
+	results := make(chan loadResult, requests)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				results <- fetch(client, spec)
+			}
+		}()
+	}
+
+	start := time.Now()
+	for i := 0; i < requests; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(results)
+
+	latencies := []time.Duration{}
+	errors := map[string]int{}
+	for result := range results {
+		if result.err != nil {
+			errors[result.err.Error()]++
+			continue
+		}
+		latencies = append(latencies, result.latency)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Printf("requests:    %d with concurrency %d in %v\n", requests, concurrency, elapsed)
+	successRate := 0.0
+	if requests > 0 {
+		successRate = 100 * float64(len(latencies)) / float64(requests)
+	}
+	fmt.Printf("success:     %d (%.1f%%)\n", len(latencies), successRate)
+	fmt.Printf("throughput:  %.1f requests/s\n", float64(requests)/elapsed.Seconds())
+	if len(latencies) > 0 {
+		fmt.Printf("latency:     p50 %v, p95 %v, p99 %v\n", percentile(latencies, 0.5), percentile(latencies, 0.95), percentile(latencies, 0.99))
+	}
+	for err, count := range errors {
+		fmt.Printf("failed %dx:  %s\n", count, err)
+	}
+	return len(errors) == 0
+}
+
+// fetch sends a request and reads the whole response, non 2xx responses
+// fail
+func fetch(client *http.Client, spec *requestSpec) loadResult {
+	request, err := spec.newRequest()
+	if err != nil {
+		return loadResult{err: err}
+	}
+	start := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		return loadResult{err: err}
+	}
+	defer silentClose(response.Body)
+	if _, err := io.Copy(ioutil.Discard, response.Body); err != nil {
+		return loadResult{err: err}
+	}
+	if !isSuccess(response) {
+		return loadResult{err: fmt.Errorf("status %s", response.Status)}
+	}
+	return loadResult{latency: time.Since(start)}
+}
+
+// percentile of sorted latencies, p between 0 and 1
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
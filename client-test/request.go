@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// headerFlags collects repeated -header "Key: Value" flags
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	if _, _, ok := strings.Cut(value, ":"); !ok {
+		return fmt.Errorf("invalid header %q, expected \"Key: Value\"", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// requestSpec describes the request to send, new ones are built for every
+// request so the body can be read again
+type requestSpec struct {
+	method  string
+	url     string
+	headers headerFlags
+	data    string
+}
+
+func (s *requestSpec) newRequest() (*http.Request, error) {
+	request, err := http.NewRequest(s.method, s.url, strings.NewReader(s.data))
+	if err != nil {
+		return nil, err
+	}
+	if s.data == "" {
+		request.Body = http.NoBody
+		request.ContentLength = 0
+	}
+	for _, header := range s.headers {
+		key, value, _ := strings.Cut(header, ":")
+		request.Header.Add(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+	return request, nil
+}
+
+func isSuccess(response *http.Response) bool {
+	return response.StatusCode >= 200 && response.StatusCode <= 299
+}
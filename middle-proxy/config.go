@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config lists the routes of the proxy
+type Config struct {
+	Routes []Route
+}
+
+// Route forwards connections accepted on Listen to the destination of the
+// TLS SNI they ask for, or to Destination
+type Route struct {
+	// Listen is where to listen like 127.0.0.1:8001
+	Listen string
+	// Destination is the server to forward to like 127.0.0.1:8000, when
+	// no SNI matches or the connection is not TLS. Several comma separated
+	// servers are failed over to in order, skipping unhealthy ones.
+	Destination string
+	// SNI maps server names to the servers to forward to like Destination,
+	// TLS is not terminated unless Cert is set
+	SNI map[string]string
+	// Cert and Key optionally terminate TLS from clients, the decrypted
+	// connections are forwarded. They are reloaded when the files change.
+	Cert string
+	Key  string
+	// UpstreamTLS wraps the forwarded connections in TLS again, the
+	// destinations are verified against UpstreamCA or the system roots
+	UpstreamTLS bool   `yaml:"upstream_tls"`
+	UpstreamCA  string `yaml:"upstream_ca"`
+	// MaxConnsPerSec rejects connections beyond the rate, MaxBytesPerSec
+	// throttles all connections of the route together, 0 means unlimited
+	MaxConnsPerSec float64 `yaml:"max_conns_per_sec"`
+	MaxBytesPerSec int64   `yaml:"max_bytes_per_sec"`
+}
+
+func loadConfig(file string) (*Config, error) {
+	configBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("can not read config: %v", err)
+	}
+	config := &Config{}
+	if err := yaml.Unmarshal(configBytes, config); err != nil {
+		return nil, fmt.Errorf("can not parse config: %v", err)
+	}
+	return config, config.validate()
+}
+
+func (c *Config) validate() error {
+	if len(c.Routes) == 0 {
+		return fmt.Errorf("no routes configured")
+	}
+	listens := map[string]bool{}
+	for i, route := range c.Routes {
+		if route.Listen == "" {
+			return fmt.Errorf("route %d: empty listen address", i)
+		}
+		if route.Destination == "" {
+			return fmt.Errorf("route %d: empty destination", i)
+		}
+		if listens[route.Listen] {
+			return fmt.Errorf("route %d: listen address %s used more than once", i, route.Listen)
+		}
+		listens[route.Listen] = true
+		if (route.Cert == "") != (route.Key == "") {
+			return fmt.Errorf("route %d: cert and key have to be set together", i)
+		}
+		if route.MaxConnsPerSec < 0 || route.MaxBytesPerSec < 0 {
+			return fmt.Errorf("route %d: negative rate limit", i)
+		}
+		if route.UpstreamCA != "" && !route.UpstreamTLS {
+			return fmt.Errorf("route %d: upstream_ca needs upstream_tls", i)
+		}
+		for sni, destination := range route.SNI {
+			if sni == "" || destination == "" {
+				return fmt.Errorf("route %d: sni %q: empty name or destination", i, sni)
+			}
+		}
+	}
+	return nil
+}
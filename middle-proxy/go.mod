@@ -1,7 +1,10 @@
-module middle-proxy
-
-go 1.18
-
-require inet.af/tcpproxy v0.0.0-20220326234310-be3ee21c9fa0
-
-require github.com/armon/go-proxyproto v0.0.0-20210323213023-7e956b284f0a // indirect
+module middle-proxy
+
+go 1.18
+
+require (
+	gopkg.in/yaml.v2 v2.4.0
+	inet.af/tcpproxy v0.0.0-20220326234310-be3ee21c9fa0
+)
+
+require github.com/armon/go-proxyproto v0.0.0-20210323213023-7e956b284f0a // indirect
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+	"util"
+
+	"inet.af/tcpproxy"
+)
+
+var acceptedConnections = util.NewCounterVector(
+	"middle_proxy_connections_accepted_total",
+	"Counts connections accepted by route",
+	[]string{"route"},
+)
+
+var activeForwards = util.NewGaugeVector(
+	"middle_proxy_active_forwards",
+	"Number of connections being forwarded by route",
+	[]string{"route"},
+)
+
+var rateLimitedConnections = util.NewCounterVector(
+	"middle_proxy_connections_rate_limited_total",
+	"Counts connections rejected for exceeding the connection rate of their route",
+	[]string{"route"},
+)
+
+var forwardedConnections = util.NewCounterVector(
+	"middle_proxy_forwarded_connections_total",
+	"Counts connections handed to a destination by listen address and destination",
+	[]string{"listen", "destination"},
+)
+
+var activeDestinationForwards = util.NewGaugeVector(
+	"middle_proxy_destination_active_forwards",
+	"Number of connections being forwarded by listen address and destination",
+	[]string{"listen", "destination"},
+)
+
+var forwardedBytes = util.NewCounterVector(
+	"middle_proxy_forwarded_bytes_total",
+	"Counts bytes forwarded by listen address, destination and direction, up from clients to the destination and down back to them",
+	[]string{"listen", "destination", "direction"},
+)
+
+// clientKeepAlivePeriod is the tcp keepalive of client connections, like
+// tcpproxy.DialProxy sets on the connections it gets unwrapped
+const clientKeepAlivePeriod = time.Minute
+
+// countedTarget counts the connections handed to a target, forwards are
+// tracked in active so shutdown can wait for them. As the connections are
+// wrapped for counting, and so copied without splice, tcp keepalive is set
+// on them here.
+type countedTarget struct {
+	route  string
+	target tcpproxy.Target
+	active *sync.WaitGroup
+}
+
+func (t *countedTarget) HandleConn(conn net.Conn) {
+	t.active.Add(1)
+	defer t.active.Done()
+	if tcpConn := underlyingTCPConn(conn); tcpConn != nil {
+		_ = tcpConn.SetKeepAlive(true)
+		_ = tcpConn.SetKeepAlivePeriod(clientKeepAlivePeriod)
+	}
+	acceptedConnections.WithLabelValues(t.route).Inc()
+	activeForwards.WithLabelValues(t.route).Inc()
+	defer activeForwards.WithLabelValues(t.route).Dec()
+	t.target.HandleConn(conn)
+}
+
+// underlyingTCPConn is the tcp connection of a client connection as
+// tcpproxy hands it over, nil if it is none
+func underlyingTCPConn(conn net.Conn) *net.TCPConn {
+	if wrapped, ok := conn.(*tcpproxy.Conn); ok {
+		conn = wrapped.Conn
+	}
+	tcpConn, _ := conn.(*net.TCPConn)
+	return tcpConn
+}
+
+// countingConn counts the bytes read from and written to a client
+// connection as they are forwarded
+type countingConn struct {
+	net.Conn
+	read    func(n int)
+	written func(n int)
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.read(n)
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.written(n)
+	}
+	return n, err
+}
+
+// forward hands conn to the target of u counting the connection and its
+// bytes by the listen address of the pool and the upstream
+func (p *upstreamPool) forward(u *upstream, conn net.Conn) {
+	forwardedConnections.WithLabelValues(p.listen, u.addr).Inc()
+	active := activeDestinationForwards.WithLabelValues(p.listen, u.addr)
+	active.Inc()
+	defer active.Dec()
+	up := forwardedBytes.WithLabelValues(p.listen, u.addr, "up")
+	down := forwardedBytes.WithLabelValues(p.listen, u.addr, "down")
+	u.target.HandleConn(&countingConn{
+		Conn:    conn,
+		read:    func(n int) { up.Add(float64(n)) },
+		written: func(n int) { down.Add(float64(n)) },
+	})
+}
@@ -1,28 +1,141 @@
-package main
-
-import (
-	"flag"
-	"fmt"
-
-	"inet.af/tcpproxy"
-)
-
-func main() {
-
-	flagDestination := flag.String("destination", "192.168.74.128:8000", "address of destination server like 127.0.0.1:8000")
-	flagAddr := flag.String("addr", "192.168.74.128:8001", "where to listen like 127.0.0.1:8001")
-
-	flag.Parse()
-	if *flagDestination == "" {
-		flag.Usage()
-		fmt.Println("empty socks server")
-	}
-	if *flagAddr == "" {
-		flag.Usage()
-		fmt.Println("empty addr - I do not know where to listen")
-	}
-
-	var p tcpproxy.Proxy
-	p.AddRoute(*flagAddr, tcpproxy.To(*flagDestination))
-	p.Run()
-}
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"util"
+
+	"go.uber.org/zap"
+	"inet.af/tcpproxy"
+)
+
+func main() {
+
+	flagDestination := flag.String("destination", "192.168.74.128:8000", "comma separated addresses of destination servers like 127.0.0.1:8000,127.0.0.2:8000, the first healthy one is forwarded to")
+	flagAddr := flag.String("addr", "192.168.74.128:8001", "where to listen like 127.0.0.1:8001")
+	flagConfig := flag.String("config", "", "optional yaml file with routes, each with a listen address and a destination, -addr, -destination, -cert, -key, -upstream-tls and -upstream-ca are ignored then")
+	flagProxyProtocol := flag.Bool("proxy-protocol", false, "send a proxy protocol v1 header with the client address to destinations, server-socks has to trust it with -proxy-protocol-from")
+	flagCert := flag.String("cert", "", "certificate to terminate tls from clients with, the decrypted connections are forwarded, needs -key, reloaded within a minute when the files change")
+	flagKey := flag.String("key", "", "key of -cert")
+	flagUpstreamTLS := flag.Bool("upstream-tls", false, "wrap forwarded connections in tls again towards the destinations")
+	flagUpstreamCA := flag.String("upstream-ca", "", "file with the ca certificates destinations are verified against with -upstream-tls, empty uses the system roots")
+	flagHealthInterval := flag.Duration("health-interval", 5*time.Second, "how often destinations are checked by dialing them")
+	flagHealthTimeout := flag.Duration("health-timeout", 2*time.Second, "how long dialing a destination may take for it to be healthy")
+	flagPrometheusAddr := flag.String("prometheus-addr", "", "where to serve prometheus metrics like :9202, disabled if empty")
+	metricLabels := util.MetricLabels{}
+	flag.Var(metricLabels, "metric-label", "constant label added to all metrics like region=eu, may be repeated or comma separated")
+	flagShutdownGrace := flag.Duration("shutdown-grace", 30*time.Second, "how long forwards may go on after SIGTERM before exiting, new connections are not accepted then")
+	flagLogLevel := flag.String("log-level", "info", "log level, one of debug, info, warn or error")
+	flagVersion := flag.Bool("version", false, "print the version and exit")
+
+	util.ParseFlags()
+	if *flagVersion {
+		fmt.Println(util.VersionString("middle-proxy"))
+		os.Exit(0)
+	}
+
+	log, err := util.NewLogger(*flagLogLevel, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "can not create logger:", err)
+		os.Exit(2)
+	}
+	defer log.Sync()
+
+	util.RegisterMetrics(metricLabels)
+
+	config := &Config{Routes: []Route{{
+		Listen:      *flagAddr,
+		Destination: *flagDestination,
+		Cert:        *flagCert,
+		Key:         *flagKey,
+		UpstreamTLS: *flagUpstreamTLS,
+		UpstreamCA:  *flagUpstreamCA,
+	}}}
+	if *flagConfig != "" {
+		config, err = loadConfig(*flagConfig)
+		util.TryFatal(log, err, "invalid config", zap.String("file", *flagConfig))
+	} else {
+		if *flagDestination == "" {
+			flag.Usage()
+			fmt.Println("empty socks server")
+		}
+		if *flagAddr == "" {
+			flag.Usage()
+			fmt.Println("empty addr - I do not know where to listen")
+		}
+	}
+
+	active := &sync.WaitGroup{}
+	stopChecks := make(chan struct{})
+	check := healthCheck{interval: *flagHealthInterval, timeout: *flagHealthTimeout}
+	var p tcpproxy.Proxy
+	for _, route := range config.Routes {
+		upstreamTLS, err := route.upstreamTLSConfig()
+		util.TryFatal(log, err, "invalid upstream tls", zap.String("listen", route.Listen))
+		if upstreamTLS != nil && *flagProxyProtocol {
+			// the header has to precede the tls handshake of the destination
+			log.Fatal("upstream tls can not be combined with -proxy-protocol", zap.String("listen", route.Listen))
+		}
+		var serverTLS *tls.Config
+		if route.Cert != "" {
+			serverTLS, err = route.serverTLSConfig(log.With(zap.String("route", route.Listen)))
+			util.TryFatal(log, err, "invalid tls termination", zap.String("listen", route.Listen))
+		}
+		listen := route.Listen
+		limit := newRouteLimit(log.With(zap.String("route", listen)), &route)
+		to := func(name, destinations string) tcpproxy.Target {
+			routeLog := log.With(zap.String("route", name))
+			pool := newUpstreamPool(routeLog, listen, destinations, *flagProxyProtocol, upstreamTLS)
+			go pool.check(check, stopChecks)
+			var target tcpproxy.Target = pool
+			if serverTLS != nil {
+				target = &tlsTermination{log: routeLog, config: serverTLS, target: pool}
+			}
+			// connections beyond the rate are rejected before any handshake
+			return &countedTarget{route: name, target: limit.wrap(name, target), active: active}
+		}
+
+		// routes are matched in the order added, the fallback goes last
+		for _, sni := range sortedKeys(route.SNI) {
+			p.AddSNIRoute(route.Listen, sni, to(route.Listen+" "+sni, route.SNI[sni]))
+		}
+		p.AddRoute(route.Listen, to(route.Listen, route.Destination))
+	}
+	util.TryFatal(log, p.Start(), "can not start proxy")
+	log.Info("forwarding", zap.Int("routes", len(config.Routes)))
+
+	ctx := util.CtxCancelOnOsSignal(log)
+	if *flagPrometheusAddr != "" {
+		go util.RunPrometheusHandler(ctx, log, *flagPrometheusAddr)
+	}
+	<-ctx.Done()
+
+	log.Info("stop accepting connections", zap.Duration("grace", *flagShutdownGrace))
+	_ = p.Close()
+	close(stopChecks)
+	drained := make(chan struct{})
+	go func() {
+		active.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		log.Info("all forwards done")
+	case <-time.After(*flagShutdownGrace):
+		log.Warn("shutdown grace is over, dropping forwards still going on")
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
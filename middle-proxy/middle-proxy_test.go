@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"inet.af/tcpproxy"
+)
+
+// newTestTCPPair returns both ends of a tcp connection over loopback
+func newTestTCPPair(t *testing.T) (client, server net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	client, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+func TestUnderlyingTCPConn(t *testing.T) {
+	_, server := newTestTCPPair(t)
+	for name, test := range map[string]struct {
+		conn net.Conn
+		tcp  bool
+	}{
+		"tcp":     {server, true},
+		"peeked":  {&tcpproxy.Conn{HostName: "example.com", Conn: server}, true},
+		"counted": {&countingConn{Conn: server}, false},
+	} {
+		if tcpConn := underlyingTCPConn(test.conn); (tcpConn != nil) != test.tcp {
+			t.Errorf("%s: expected a tcp connection %v, got %v", name, test.tcp, tcpConn)
+		}
+	}
+}
+
+func TestCountingConn(t *testing.T) {
+	client, server := newTestTCPPair(t)
+	upstream, upstreamServer := newTestTCPPair(t)
+	go func() { _, _ = io.Copy(upstreamServer, upstreamServer) }()
+
+	// forward the client to an echoing upstream through the counting conn
+	var up, down int64
+	counted := &countingConn{
+		Conn:    server,
+		read:    func(n int) { atomic.AddInt64(&up, int64(n)) },
+		written: func(n int) { atomic.AddInt64(&down, int64(n)) },
+	}
+	go func() { _, _ = io.Copy(upstream, counted) }()
+	go func() { _, _ = io.Copy(counted, upstream) }()
+
+	if _, err := client.Write([]byte("ping ping")); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, 9)
+	if _, err := io.ReadFull(client, echo); err != nil || string(echo) != "ping ping" {
+		t.Fatalf("expected the echo, got %q %v", echo, err)
+	}
+	// the echo may arrive before the write returned
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt64(&down) < 9 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if up, down := atomic.LoadInt64(&up), atomic.LoadInt64(&down); up != 9 || down != 9 {
+		t.Errorf("expected 9 bytes each way, got %d up and %d down", up, down)
+	}
+}
+
+func TestRouteLimitAllow(t *testing.T) {
+	for _, test := range []struct {
+		route   Route
+		allowed int
+	}{
+		{Route{MaxBytesPerSec: 100}, 10},
+		{Route{MaxConnsPerSec: 3}, 3},
+		// slow rates still allow one connection at once
+		{Route{MaxConnsPerSec: 0.1}, 1},
+	} {
+		limit := newRouteLimit(zap.NewNop(), &test.route)
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			if limit.allow() {
+				allowed++
+			}
+		}
+		if allowed != test.allowed {
+			t.Errorf("%+v: expected %d connections allowed, got %d", test.route, test.allowed, allowed)
+		}
+	}
+	if newRouteLimit(zap.NewNop(), &Route{}) != nil {
+		t.Error("expected no limit without rates")
+	}
+}
+
+// countingTarget counts the connections it gets and closes them
+type countingTarget struct {
+	conns int32
+}
+
+func (t *countingTarget) HandleConn(conn net.Conn) {
+	atomic.AddInt32(&t.conns, 1)
+	_ = conn.Close()
+}
+
+// testCounter counts Inc calls like a prometheus counter
+type testCounter struct {
+	count int32
+}
+
+func (c *testCounter) Inc() {
+	atomic.AddInt32(&c.count, 1)
+}
+
+func TestLimitedTargetRejects(t *testing.T) {
+	target := &countingTarget{}
+	rejected := &testCounter{}
+	limited := &limitedTarget{
+		limit:    newRouteLimit(zap.NewNop(), &Route{MaxConnsPerSec: 1}),
+		target:   target,
+		rejected: rejected,
+	}
+
+	for i := 0; i < 3; i++ {
+		client, server := newTestTCPPair(t)
+		limited.HandleConn(server)
+		// forwarded and rejected connections alike end up closed
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("connection %d: expected it closed, got %v", i, err)
+		}
+	}
+	if conns := atomic.LoadInt32(&target.conns); conns != 1 {
+		t.Errorf("expected 1 connection forwarded, got %d", conns)
+	}
+	if count := atomic.LoadInt32(&rejected.count); count != 2 {
+		t.Errorf("expected 2 connections counted as rejected, got %d", count)
+	}
+}
+
+// writeTestCertificate writes a self signed certificate for 127.0.0.1 with
+// the common name to cert.pem and key.pem in dir
+func writeTestCertificate(t *testing.T, dir, commonName string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// echoTarget echoes what it reads from the connections it gets
+type echoTarget struct{}
+
+func (echoTarget) HandleConn(conn net.Conn) {
+	defer conn.Close()
+	_, _ = io.Copy(conn, conn)
+}
+
+func TestTLSTermination(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), "middle-proxy")
+	route := &Route{Cert: certFile, Key: keyFile, UpstreamTLS: true, UpstreamCA: certFile}
+	serverTLS, err := route.serverTLSConfig(zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTLS, err := route.upstreamTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the echo upstream gets the decrypted connection
+	client, server := newTestTCPPair(t)
+	go (&tlsTermination{log: zap.NewNop(), config: serverTLS, target: echoTarget{}}).HandleConn(server)
+	clientTLS.ServerName = "127.0.0.1"
+	tlsClient := tls.Client(client, clientTLS)
+	if _, err := tlsClient.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(tlsClient, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("expected the echo, got %q %v", echo, err)
+	}
+
+	// a failed handshake closes the connection
+	client, server = newTestTCPPair(t)
+	go (&tlsTermination{log: zap.NewNop(), config: serverTLS, target: echoTarget{}}).HandleConn(server)
+	if _, err := client.Write([]byte("not tls\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(client); err != nil {
+		t.Fatalf("expected the connection closed, got %v", err)
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), "upstream")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go echoTarget{}.HandleConn(conn)
+		}
+	}()
+
+	// the upstream is verified against the upstream ca
+	trusting, err := (&Route{UpstreamTLS: true, UpstreamCA: certFile}).upstreamTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialTLS(trusting)(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("expected the echo, got %q %v", echo, err)
+	}
+
+	// and not trusted by the system roots
+	system, err := (&Route{UpstreamTLS: true}).upstreamTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := dialTLS(system)(context.Background(), "tcp", listener.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("expected an untrusted upstream to fail")
+	}
+}
+
+func TestCertificateFilesReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "first")
+	c := &certificateFiles{log: zap.NewNop(), certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		cert, err := c.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	touch := func(modTime time.Time) {
+		for _, file := range []string{certFile, keyFile} {
+			if err := os.Chtimes(file, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// a renewed certificate is served once the files changed
+	writeTestCertificate(t, dir, "renewed")
+	touch(time.Now().Add(time.Minute))
+	if name := commonName(); name != "renewed" {
+		t.Fatalf("expected the renewed certificate, got %s", name)
+	}
+
+	// a broken one keeps the previous certificate
+	if err := ioutil.WriteFile(certFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(time.Now().Add(2 * time.Minute))
+	if name := commonName(); name != "renewed" {
+		t.Fatalf("expected the previous certificate to be kept, got %s", name)
+	}
+}
+
+func TestUpstreamPoolCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = closed.Close()
+	pool := newUpstreamPool(zap.NewNop(), "127.0.0.1:0", " "+closed.Addr().String()+", "+listener.Addr().String()+",", false, nil)
+	if len(pool.upstreams) != 2 || pool.upstreams[0].addr != closed.Addr().String() {
+		t.Fatalf("expected the 2 listed upstreams, got %+v", pool.upstreams)
+	}
+	healthy := func() (healthy []bool) {
+		for _, u := range pool.upstreams {
+			healthy = append(healthy, atomic.LoadInt32(&u.healthy) == 1)
+		}
+		return healthy
+	}
+
+	// a round of checks marks the unreachable upstream down
+	stop := make(chan struct{})
+	close(stop)
+	pool.check(healthCheck{interval: time.Minute, timeout: time.Second}, stop)
+	if up := healthy(); up[0] || !up[1] {
+		t.Fatalf("expected only the listening upstream up, got %v", up)
+	}
+
+	// a failed dial for a connection marks the upstream down right away
+	client, server := newTestTCPPair(t)
+	pool.upstreams[1].target.OnDialError(server, io.ErrUnexpectedEOF)
+	if up := healthy(); up[1] {
+		t.Fatal("expected the upstream failing to dial marked down")
+	}
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection closed, got %v", err)
+	}
+
+	// without a healthy upstream connections are closed right away
+	client, server = newTestTCPPair(t)
+	pool.HandleConn(server)
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection rejected, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"util"
+
+	"go.uber.org/zap"
+	"inet.af/tcpproxy"
+)
+
+// connTokens are the tokens a connection takes from the connection bucket,
+// so its integer rate expresses fractional connection rates
+const connTokens = 1000
+
+// routeLimit caps the rate connections are accepted on a route and the
+// bandwidth of all of its connections together
+type routeLimit struct {
+	log      *zap.Logger
+	connRate float64
+	// conns holds connTokens for every connection that may be accepted, up
+	// to one second worth or at least one connection, nil means unlimited
+	conns *util.TokenBucket
+	// limited is set to 1 while connections are rejected, to log only when
+	// the rate is first exceeded
+	limited int32
+	// bytes throttles the connections, nil means unlimited
+	bytes *util.TokenBucket
+}
+
+// newRouteLimit returns the limits of route, nil if it has none
+func newRouteLimit(log *zap.Logger, route *Route) *routeLimit {
+	if route.MaxConnsPerSec <= 0 && route.MaxBytesPerSec <= 0 {
+		return nil
+	}
+	l := &routeLimit{log: log, connRate: route.MaxConnsPerSec}
+	if connRate := int64(route.MaxConnsPerSec * connTokens); connRate > 0 {
+		l.conns = util.NewFullTokenBucket(func() int64 { return connRate }, connTokens)
+	}
+	if maxBytes := route.MaxBytesPerSec; maxBytes > 0 {
+		l.bytes = util.NewTokenBucket(func() int64 { return maxBytes })
+	}
+	return l
+}
+
+// allow takes a token for a new connection, false if the route exceeds its
+// connection rate
+func (l *routeLimit) allow() bool {
+	if l.conns == nil || l.conns.TryTake(connTokens) {
+		atomic.StoreInt32(&l.limited, 0)
+		return true
+	}
+	if atomic.SwapInt32(&l.limited, 1) == 0 {
+		l.log.Warn("route exceeds the connection rate, rejecting its connections", zap.Float64("rate", l.connRate))
+	}
+	return false
+}
+
+// wrap returns target limited by l, target itself if l is nil
+func (l *routeLimit) wrap(route string, target tcpproxy.Target) tcpproxy.Target {
+	if l == nil {
+		return target
+	}
+	return &limitedTarget{limit: l, target: target, rejected: rateLimitedConnections.WithLabelValues(route)}
+}
+
+// limitedTarget rejects connections beyond the connection rate of the
+// route and throttles the others to its bandwidth
+type limitedTarget struct {
+	limit  *routeLimit
+	target tcpproxy.Target
+	// rejected counts the connections beyond the rate
+	rejected interface{ Inc() }
+}
+
+func (t *limitedTarget) HandleConn(conn net.Conn) {
+	if !t.limit.allow() {
+		t.rejected.Inc()
+		util.SilentClose(conn)
+		return
+	}
+	if t.limit.bytes != nil {
+		conn = util.NewRateLimitedConn(conn, t.limit.bytes)
+	}
+	t.target.HandleConn(conn)
+}
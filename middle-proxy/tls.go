@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"util"
+
+	"go.uber.org/zap"
+	"inet.af/tcpproxy"
+)
+
+// tlsHandshakeTimeout bounds the tls handshake of clients of routes
+// terminating tls
+const tlsHandshakeTimeout = 10 * time.Second
+
+// certificateCheckInterval is how often the certificate files of routes
+// terminating tls are checked for changes
+const certificateCheckInterval = time.Minute
+
+// tlsTermination completes the tls handshake of clients and hands the
+// decrypted connection to target
+type tlsTermination struct {
+	log    *zap.Logger
+	config *tls.Config
+	target tcpproxy.Target
+}
+
+func (t *tlsTermination) HandleConn(conn net.Conn) {
+	tlsConn := tls.Server(conn, t.config)
+	_ = conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		t.log.Debug("tls handshake failed", zap.String("from", conn.RemoteAddr().String()), zap.Error(err))
+		util.SilentClose(conn)
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	t.target.HandleConn(tlsConn)
+}
+
+// serverTLSConfig loads the certificate a route terminates tls with, it is
+// reloaded when its files change
+func (r *Route) serverTLSConfig(log *zap.Logger) (*tls.Config, error) {
+	c := &certificateFiles{log: log, certFile: r.Cert, keyFile: r.Key, interval: certificateCheckInterval}
+	if err := c.load(); err != nil {
+		return nil, fmt.Errorf("can not load certificate: %v", err)
+	}
+	return &tls.Config{GetCertificate: c.GetCertificate, MinVersion: tls.VersionTLS12}, nil
+}
+
+// certificateFiles serves a certificate and reloads it once its files
+// changed, checking them at most every interval during handshakes. A
+// certificate failing to load keeps the previous one in use until the
+// files change again.
+type certificateFiles struct {
+	log      *zap.Logger
+	certFile string
+	keyFile  string
+	interval time.Duration
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	// modTime is of the files last loaded or failed to load
+	modTime time.Time
+	checked time.Time
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate
+func (c *certificateFiles) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	check := time.Since(c.checked) >= c.interval
+	c.lock.Unlock()
+	if check {
+		if err := c.load(); err != nil {
+			c.log.Warn("can not reload certificate, keeping the previous one", zap.String("cert", c.certFile), zap.Error(err))
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.cert, nil
+}
+
+// load reads the certificate files if they changed since the last load
+func (c *certificateFiles) load() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.checked = time.Now()
+	var modTime time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if modTime.Equal(c.modTime) {
+		return nil
+	}
+	c.modTime = modTime
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil {
+		c.log.Info("reloaded certificate", zap.String("cert", c.certFile))
+	}
+	c.cert = &cert
+	return nil
+}
+
+// upstreamTLSConfig is the tls config a route wraps forwarded connections
+// in towards its destinations, nil if it forwards them as they are
+func (r *Route) upstreamTLSConfig() (*tls.Config, error) {
+	if !r.UpstreamTLS {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if r.UpstreamCA != "" {
+		ca, err := ioutil.ReadFile(r.UpstreamCA)
+		if err != nil {
+			return nil, fmt.Errorf("can not read upstream ca: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in upstream ca %s", r.UpstreamCA)
+		}
+	}
+	return config, nil
+}
+
+// dialTLS dials destinations and completes a tls handshake with them,
+// verifying them by the host of their address
+func dialTLS(config *tls.Config) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		config := config.Clone()
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config.ServerName = host
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			util.SilentClose(conn)
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
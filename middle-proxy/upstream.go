@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+	"util"
+
+	"go.uber.org/zap"
+	"inet.af/tcpproxy"
+)
+
+// healthCheck configures the tcp health checks of upstreams
+type healthCheck struct {
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// upstreamPool forwards connections to the first healthy of its upstreams.
+// Upstreams are checked by dialing them periodically, and marked down right
+// away when dialing them for a connection fails.
+type upstreamPool struct {
+	log *zap.Logger
+	// listen is the address of the route the pool serves, for the metrics
+	listen    string
+	upstreams []*upstream
+}
+
+type upstream struct {
+	addr   string
+	target *tcpproxy.DialProxy
+	// healthy is 1 while the upstream can be dialed
+	healthy int32
+}
+
+// newUpstreamPool creates a pool for comma separated destinations of the
+// route listening on listen, connections to them are wrapped in tls if
+// upstreamTLS is not nil
+func newUpstreamPool(log *zap.Logger, listen, destinations string, proxyProtocol bool, upstreamTLS *tls.Config) *upstreamPool {
+	pool := &upstreamPool{log: log, listen: listen}
+	for _, addr := range strings.Split(destinations, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		u := &upstream{addr: addr, target: tcpproxy.To(addr), healthy: 1}
+		if proxyProtocol {
+			u.target.ProxyProtocolVersion = 1
+		}
+		if upstreamTLS != nil {
+			u.target.DialContext = dialTLS(upstreamTLS)
+		}
+		u.target.OnDialError = func(src net.Conn, dstDialErr error) {
+			pool.setHealthy(u, false, dstDialErr)
+			util.SilentClose(src)
+		}
+		pool.upstreams = append(pool.upstreams, u)
+	}
+	return pool
+}
+
+func (p *upstreamPool) HandleConn(conn net.Conn) {
+	for _, u := range p.upstreams {
+		if atomic.LoadInt32(&u.healthy) == 1 {
+			p.forward(u, conn)
+			return
+		}
+	}
+	p.log.Warn("rejected connection, no healthy upstream", zap.String("from", conn.RemoteAddr().String()))
+	util.SilentClose(conn)
+}
+
+// check dials every upstream each interval until stop is closed
+func (p *upstreamPool) check(check healthCheck, stop <-chan struct{}) {
+	ticker := time.NewTicker(check.interval)
+	defer ticker.Stop()
+	for {
+		for _, u := range p.upstreams {
+			conn, err := net.DialTimeout("tcp", u.addr, check.timeout)
+			if err == nil {
+				util.SilentClose(conn)
+			}
+			p.setHealthy(u, err == nil, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// setHealthy marks u and logs transitions
+func (p *upstreamPool) setHealthy(u *upstream, healthy bool, err error) {
+	value := int32(0)
+	if healthy {
+		value = 1
+	}
+	if atomic.SwapInt32(&u.healthy, value) == value {
+		return
+	}
+	if healthy {
+		p.log.Info("upstream is up", zap.String("upstream", u.addr))
+	} else {
+		p.log.Warn("upstream is down", zap.String("upstream", u.addr), zap.Error(err))
+	}
+}
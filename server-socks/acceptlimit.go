@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"util"
+
+	"github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+)
+
+// connLimit caps the connections served at once across all listeners with
+// a counting semaphore, waiting up to wait for a slot before rejecting
+type connLimit struct {
+	log   *zap.Logger
+	slots chan struct{}
+	wait  time.Duration
+	lock  sync.Mutex
+	// full is set while the limit is reached, to log only when it is hit
+	full bool
+}
+
+func newConnLimit(log *zap.Logger, max int, wait time.Duration) *connLimit {
+	return &connLimit{log: log, slots: make(chan struct{}, max), wait: wait}
+}
+
+// acquire takes a slot for conn, or closes conn if none frees up in time.
+// Without a limit every connection is accepted.
+func (l *connLimit) acquire(conn net.Conn) bool {
+	if l == nil {
+		openConnections.WithLabelValues().Inc()
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		l.setFull(false)
+		openConnections.WithLabelValues().Inc()
+		return true
+	default:
+	}
+	if l.wait > 0 {
+		timer := time.NewTimer(l.wait)
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+			l.setFull(false)
+			openConnections.WithLabelValues().Inc()
+			return true
+		case <-timer.C:
+		}
+	}
+	if l.setFull(true) {
+		l.log.Warn("max connections reached, rejecting new ones", zap.Int("max", cap(l.slots)))
+	}
+	rejectedConnections.WithLabelValues("max_conns").Inc()
+	util.SilentClose(conn)
+	return false
+}
+
+func (l *connLimit) release() {
+	openConnections.WithLabelValues().Dec()
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// setFull records if the limit is reached and returns if that changed
+func (l *connLimit) setFull(full bool) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	changed := l.full != full
+	l.full = full
+	return changed
+}
+
+// ipRateLimit limits the rate connections are accepted from each source ip
+// with a token bucket per ip, buckets of idle ips age out of the cache
+type ipRateLimit struct {
+	log     *zap.Logger
+	rate    float64
+	burst   float64
+	exempt  []*net.IPNet
+	buckets *cache.Cache
+	lock    sync.Mutex
+}
+
+type connBucket struct {
+	tokens float64
+	last   time.Time
+	// limited is set while connections are rejected, to log only when the
+	// rate is first exceeded
+	limited bool
+}
+
+func newIPRateLimit(log *zap.Logger, rate float64, burst int, exempt []string) (*ipRateLimit, error) {
+	if burst < 1 {
+		return nil, fmt.Errorf("burst must be at least 1, got %d", burst)
+	}
+	networks, err := parseNetworks(exempt)
+	if err != nil {
+		return nil, err
+	}
+	// an idle bucket refills within idle, forgetting it changes nothing
+	idle := time.Duration(float64(burst) / rate * float64(time.Second))
+	if idle < time.Minute {
+		idle = time.Minute
+	}
+	return &ipRateLimit{
+		log:     log,
+		rate:    rate,
+		burst:   float64(burst),
+		exempt:  networks,
+		buckets: cache.New(idle, idle),
+	}, nil
+}
+
+// allow takes a token for the source ip of conn, or closes conn if the ip
+// exceeds the rate. Without a limit every connection is allowed.
+func (l *ipRateLimit) allow(conn net.Conn) bool {
+	if l == nil {
+		return true
+	}
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	for _, network := range l.exempt {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	ip := tcpAddr.IP.String()
+	if l.take(ip) {
+		return true
+	}
+	rejectedConnections.WithLabelValues("ip_rate").Inc()
+	util.SilentClose(conn)
+	return false
+}
+
+func (l *ipRateLimit) take(ip string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	bucket := &connBucket{tokens: l.burst, last: now}
+	if cached, ok := l.buckets.Get(ip); ok {
+		bucket = cached.(*connBucket)
+	}
+	l.buckets.SetDefault(ip, bucket)
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		if !bucket.limited {
+			bucket.limited = true
+			l.log.Warn(
+				"source ip exceeds the connection rate, rejecting its connections",
+				zap.String("from", ip),
+				zap.Float64("rate", l.rate),
+				zap.Float64("burst", l.burst),
+			)
+		}
+		return false
+	}
+	bucket.tokens--
+	bucket.limited = false
+	return true
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"util"
+
+	"server-socks/policy"
+	"socks5"
+
+	"go.uber.org/zap"
+)
+
+// accessLog writes a JSON line per request to a file of its own, separate
+// from the operational log. Allowed requests are written once they are
+// done, with the bytes proxied and how long they took.
+type accessLog struct {
+	log  *zap.Logger
+	file string
+	lock sync.Mutex
+	out  *os.File
+}
+
+// accessRecord is a line of the access log
+type accessRecord struct {
+	Time  time.Time `json:"time"`
+	Realm string    `json:"realm,omitempty"`
+	User  string    `json:"user"`
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+	// Destination is the name of the destination that allowed the request
+	Destination string `json:"destination,omitempty"`
+	// Labels of the destination that allowed the request
+	Labels  map[string]string `json:"labels,omitempty"`
+	Command string            `json:"command"`
+	// Decision is allowed or denied
+	Decision string `json:"decision"`
+	// BytesUp were sent to the destination, BytesDown received from it
+	BytesUp   int64   `json:"bytes_up"`
+	BytesDown int64   `json:"bytes_down"`
+	Duration  float64 `json:"duration_seconds"`
+
+	counts byteCounts
+}
+
+const (
+	accessDecisionAllowed = "allowed"
+	accessDecisionDenied  = "denied"
+)
+
+func openAccessLog(log *zap.Logger, file string) (*accessLog, error) {
+	l := &accessLog{log: log, file: file}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reopen opens the file again so it can be rotated by moving it away
+func (l *accessLog) reopen() error {
+	if l == nil {
+		return nil
+	}
+	out, err := os.OpenFile(l.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	util.SilentClose(l.out)
+	l.out = out
+	return nil
+}
+
+func (l *accessLog) write(record *accessRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		l.log.Warn("can not encode access log record", zap.Error(err))
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		l.log.Warn("can not write access log", zap.String("file", l.file), zap.Error(err))
+	}
+}
+
+// wrap returns rules writing their decisions to the access log, nil
+// disables it
+func (l *accessLog) wrap(rules socks5.RuleSet, realm string) socks5.RuleSet {
+	if l == nil {
+		return rules
+	}
+	return &accessLogRules{rules: rules, log: l, realm: realm}
+}
+
+type accessLogRules struct {
+	rules socks5.RuleSet
+	log   *accessLog
+	realm string
+}
+
+func (r *accessLogRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.BindPeer() {
+		// the record of the bind covers its peer
+		return r.rules.Allow(ctx, req)
+	}
+	record := &accessRecord{
+		Time:    time.Now(),
+		Realm:   r.realm,
+		User:    req.AuthContext.Payload["Username"],
+		From:    policy.SourceIP(req),
+		To:      req.DestAddr.String(),
+		Command: commandName(req.Command),
+	}
+	newCtx, allowed := r.rules.Allow(ctx, req)
+	if !allowed {
+		record.Decision = accessDecisionDenied
+		r.log.write(record)
+		return newCtx, false
+	}
+	var destination *policy.Destination
+	record.Destination, destination = policy.DestinationFromContext(newCtx)
+	if destination != nil {
+		record.Labels = destination.Labels
+	}
+	return contextWithAccessRecord(newCtx, record), true
+}
+
+func (r *accessLogRules) Release(ctx context.Context, req *socks5.Request) {
+	if record := accessRecordFromContext(ctx); record != nil && !req.BindPeer() {
+		record.Decision = accessDecisionAllowed
+		record.BytesUp = atomic.LoadInt64(&record.counts.up)
+		record.BytesDown = atomic.LoadInt64(&record.counts.down)
+		record.Duration = time.Since(record.Time).Seconds()
+		r.log.write(record)
+	}
+	if releaser, ok := r.rules.(socks5.RuleReleaser); ok {
+		releaser.Release(ctx, req)
+	}
+}
+
+func commandName(command uint8) string {
+	switch command {
+	case socks5.ConnectCommand:
+		return "connect"
+	case socks5.BindCommand:
+		return "bind"
+	case socks5.AssociateCommand:
+		return "associate"
+	}
+	return "unknown"
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// runAdminHandler serves the admin api on address until ctx is done
+func runAdminHandler(ctx context.Context, log *zap.Logger, address string, router *realmRouter) {
+	h := http.NewServeMux()
+	h.HandleFunc("/resolutions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		realm, realmOK := router.realms[r.URL.Query().Get("realm")]
+		if !realmOK {
+			http.Error(w, "unknown realm", http.StatusNotFound)
+			return
+		}
+		writeJSON(log, w, realm.authenticator.Resolutions())
+	})
+	h.HandleFunc("/policy", func(w http.ResponseWriter, r *http.Request) {
+		servePolicy(log, w, r, router)
+	})
+	h.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		router.reload("api " + r.RemoteAddr)
+		writeJSON(log, w, router.audit.last())
+	})
+	h.HandleFunc("/reloads", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(log, w, router.audit.last())
+	})
+	h.HandleFunc("/quotas", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if router.quotas == nil {
+			http.Error(w, "quotas disabled", http.StatusNotFound)
+			return
+		}
+		writeJSON(log, w, router.quotas.usages())
+	})
+	server := &http.Server{Addr: address, Handler: h}
+
+	go func() {
+		<-ctx.Done()
+		log.Info("Shutdown admin handler in progress")
+		_ = server.Shutdown(context.Background())
+	}()
+
+	log.Info("starting admin handler", zap.String("addr", address))
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal("Failed to start admin handler", zap.Error(err))
+	}
+}
+
+func writeJSON(log *zap.Logger, w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warn("could not write admin response", zap.Error(err))
+	}
+}
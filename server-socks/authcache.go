@@ -0,0 +1,51 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// authCacheUsers bounds the number of distinct users in basicAuthCache,
+// evicting the least recently used user once max is exceeded
+type authCacheUsers struct {
+	lock  sync.Mutex
+	max   int
+	order *list.List
+	users map[string]*list.Element
+}
+
+type authCacheUser struct {
+	name     string
+	hashedPW string
+}
+
+func newAuthCacheUsers(max int) *authCacheUsers {
+	return &authCacheUsers{
+		max:   max,
+		order: list.New(),
+		users: map[string]*list.Element{},
+	}
+}
+
+// touch marks the cache entry of user as recently used
+func (u *authCacheUsers) touch(user, hashedPW string) {
+	if u == nil {
+		return
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if element, ok := u.users[user]; ok {
+		element.Value.(*authCacheUser).hashedPW = hashedPW
+		u.order.MoveToFront(element)
+		return
+	}
+	u.users[user] = u.order.PushFront(&authCacheUser{name: user, hashedPW: hashedPW})
+
+	for u.order.Len() > u.max {
+		oldest := u.order.Remove(u.order.Back()).(*authCacheUser)
+		delete(u.users, oldest.name)
+		basicAuthCache.Delete(oldest.hashedPW)
+		authCacheEvictions.WithLabelValues().Inc()
+	}
+}
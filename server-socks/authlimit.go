@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"socks5"
+
+	"github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+)
+
+var errLockedOut = errors.New("too many failed authentications")
+
+// authFailures counts failed authentications by source IP and locks out
+// IPs exceeding maxFailures within window for cooldown
+type authFailures struct {
+	log         *zap.Logger
+	maxFailures int
+	window      time.Duration
+	cooldown    time.Duration
+	failures    *cache.Cache
+	lockouts    *cache.Cache
+}
+
+func newAuthFailures(log *zap.Logger, maxFailures int, window, cooldown time.Duration) *authFailures {
+	return &authFailures{
+		log:         log,
+		maxFailures: maxFailures,
+		window:      window,
+		cooldown:    cooldown,
+		failures:    cache.New(window, 2*window),
+		lockouts:    cache.New(cooldown, 2*cooldown),
+	}
+}
+
+// wrap returns an authenticator enforcing the lockout, nil disables it
+func (f *authFailures) wrap(authenticator socks5.Authenticator) socks5.Authenticator {
+	if f == nil {
+		return authenticator
+	}
+	return &lockoutAuthenticator{Authenticator: authenticator, failures: f}
+}
+
+func (f *authFailures) failed(ip string) {
+	count := 1
+	if f.failures.Add(ip, count, f.window) != nil {
+		var err error
+		if count, err = f.failures.IncrementInt(ip, 1); err != nil {
+			return
+		}
+	}
+	if count < f.maxFailures {
+		return
+	}
+	f.failures.Delete(ip)
+	f.lockouts.Set(ip, true, f.cooldown)
+	f.log.Warn(
+		"locking out source ip after failed authentications",
+		zap.String("from", ip),
+		zap.Int("failures", f.maxFailures),
+		zap.Duration("cooldown", f.cooldown),
+	)
+}
+
+type lockoutAuthenticator struct {
+	socks5.Authenticator
+	failures *authFailures
+}
+
+func (a *lockoutAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*socks5.AuthContext, error) {
+	ip := remoteIP(writer)
+	if _, lockedOut := a.failures.lockouts.Get(ip); lockedOut {
+		a.failures.log.Info("denied - source ip locked out", zap.String("from", ip))
+		return nil, errLockedOut
+	}
+
+	authContext, err := a.Authenticator.Authenticate(reader, writer)
+	switch err {
+	case nil:
+		a.failures.failures.Delete(ip)
+	case socks5.UserAuthFailed:
+		a.failures.failed(ip)
+	}
+	return authContext, err
+}
+
+// remoteIP returns the IP of the client socks5 writes its replies to
+func remoteIP(writer io.Writer) string {
+	conn, ok := writer.(interface{ RemoteAddr() net.Addr })
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
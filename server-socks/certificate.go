@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// certificateCheckInterval is how often the certificate files are checked
+// for changes
+const certificateCheckInterval = time.Minute
+
+// certificateHolder serves the TLS certificate through GetCertificate and
+// reloads it from its files when they change or on request, so new
+// handshakes use a renewed certificate while existing connections go on.
+// A certificate failing to load keeps the previous one in use.
+type certificateHolder struct {
+	log      *zap.Logger
+	certFile string
+	keyFile  string
+	audit    *reloadAudit
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	// modTime is of the files last loaded, or failed to load, so broken
+	// files are retried only once they change again
+	modTime time.Time
+}
+
+func newCertificateHolder(log *zap.Logger, certFile, keyFile string, audit *reloadAudit) (*certificateHolder, error) {
+	h := &certificateHolder{log: log, certFile: certFile, keyFile: keyFile, audit: audit}
+	if _, err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate
+func (h *certificateHolder) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.cert, nil
+}
+
+// load reads the certificate files and replaces the certificate in use
+func (h *certificateHolder) load() (string, error) {
+	modTime, err := h.filesModTime()
+	if err != nil {
+		return "", err
+	}
+	cert, err := tls.LoadX509KeyPair(h.certFile, h.keyFile)
+	var leaf *x509.Certificate
+	if err == nil {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.modTime = modTime
+	if err != nil {
+		return "", err
+	}
+	h.cert = &cert
+	return fmt.Sprintf("certificate %s valid until %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339)), nil
+}
+
+// filesModTime is the latest modification time of the certificate files
+func (h *certificateHolder) filesModTime() (time.Time, error) {
+	var modTime time.Time
+	for _, file := range []string{h.certFile, h.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTime, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+// reload loads the certificate again and records it in the audit
+func (h *certificateHolder) reload(trigger string) {
+	if h == nil {
+		return
+	}
+	event := reloadEvent{Time: time.Now(), Config: reloadConfigCertificate, Trigger: trigger, Changes: []string{}}
+	change, err := h.load()
+	if err != nil {
+		event.Error = err.Error()
+	} else {
+		event.Success = true
+		event.Changes = append(event.Changes, change)
+	}
+	h.audit.record(event)
+}
+
+// watch reloads the certificate whenever its files change
+func (h *certificateHolder) watch() {
+	for {
+		time.Sleep(certificateCheckInterval)
+		h.checkFiles()
+	}
+}
+
+// checkFiles reloads the certificate if its files changed since the last
+// load
+func (h *certificateHolder) checkFiles() {
+	modTime, err := h.filesModTime()
+	if err != nil {
+		h.log.Warn("could not check certificate files", zap.Error(err))
+		return
+	}
+	h.lock.RLock()
+	changed := !modTime.Equal(h.modTime)
+	h.lock.RUnlock()
+	if changed {
+		h.reload("file change")
+	}
+}
+
+// loadCertPool reads the pem encoded certificates in file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// requireALPN offers protos to clients and rejects handshakes negotiating
+// none of them. Protocols offered already, like the acme one, stay accepted.
+func requireALPN(config *tls.Config, protos []string) {
+	accepted := append(append([]string{}, protos...), config.NextProtos...)
+	config.NextProtos = accepted
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if !containsString(accepted, state.NegotiatedProtocol) {
+			return fmt.Errorf("alpn %q not accepted", state.NegotiatedProtocol)
+		}
+		return nil
+	}
+}
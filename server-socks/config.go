@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"server-socks/policy"
+
+	"github.com/foomo/htpasswd"
+	"gopkg.in/yaml.v2"
+)
+
+// ServerConfig is a single file given with -config in place of separate
+// flags and files, its settings override the flags they correspond to
+type ServerConfig struct {
+	// Addr overrides -addr
+	Addr string
+	// Users maps user names to their bcrypt hashes, replacing -auth
+	Users map[string]string
+	// Destinations is a destinations config including deny and groups,
+	// replacing -destinations
+	Destinations interface{}
+	// Cert, Key and ClientCA override -cert, -key and -client-ca
+	Cert     string
+	Key      string
+	ClientCA string
+}
+
+func loadServerConfig(file string) (*ServerConfig, error) {
+	configBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("can not read config: %v", err)
+	}
+	config := &ServerConfig{}
+	if err := yaml.UnmarshalStrict(configBytes, config); err != nil {
+		return nil, fmt.Errorf("can not parse config: %v", err)
+	}
+	return config, nil
+}
+
+// UserConfig is a user of a -users-file with the destinations it is
+// allowed to reach, in addition to those listing it in their Users
+type UserConfig struct {
+	// Hash is the bcrypt hash of the password like in the basic auth file
+	Hash string
+	// Destinations are names of destinations in the destinations config
+	Destinations []string
+}
+
+func loadUsersFile(file string) (map[string]*UserConfig, error) {
+	usersBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("can not read users file: %v", err)
+	}
+	users := map[string]*UserConfig{}
+	if err := yaml.UnmarshalStrict(usersBytes, users); err != nil {
+		return nil, fmt.Errorf("can not parse users file: %v", err)
+	}
+	return users, nil
+}
+
+// addUsers takes the password hashes from users and adds every user to the
+// Users of the destinations it lists. Only destinations limited to some
+// Users or Groups may be listed, adding a user to a destination open to
+// every user would lock out everyone else.
+func (loaded *realmPolicy) addUsers(users map[string]*UserConfig) error {
+	loaded.passwordHashes = make(map[string]string, len(users))
+	userNames := make([]string, 0, len(users))
+	for userName := range users {
+		userNames = append(userNames, userName)
+	}
+	sort.Strings(userNames)
+
+	// destinations are open unless limited before any user is added
+	open := map[string]bool{}
+	for name, d := range loaded.destinations {
+		open[name] = d != nil && len(d.Users) == 0 && len(d.Groups) == 0
+	}
+
+	problems := []string{}
+	for _, userName := range userNames {
+		user := users[userName]
+		if user == nil || user.Hash == "" {
+			problems = append(problems, fmt.Sprintf("user %s: missing hash", userName))
+			continue
+		}
+		loaded.passwordHashes[userName] = user.Hash
+		for _, name := range user.Destinations {
+			d, ok := loaded.destinations[name]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("user %s: unknown destination %s", userName, name))
+				continue
+			}
+			if d == nil {
+				// left to ValidateDestinations
+				continue
+			}
+			if open[name] {
+				problems = append(problems, fmt.Sprintf("user %s: destination %s is open to every user, list users for it in the destinations or do not list it", userName, name))
+				continue
+			}
+			if !containsString(d.Users, userName) {
+				d.Users = append(d.Users, userName)
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid users file:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// realmFiles are where a realm reads its users and destinations from
+type realmFiles struct {
+	htpasswd string
+	// users is a -users-file used instead of the htpasswd file
+	users        string
+	destinations string
+	// config is a -config file, its users and destinations if given are
+	// used instead of the files above
+	config string
+}
+
+// realmPolicy are the users and destinations of a realm
+type realmPolicy struct {
+	destinations   map[string]*policy.Destination
+	denies         map[string]*policy.Destination
+	groups         map[string][]string
+	passwordHashes map[string]string
+	// htpasswdFile the users were read from, "" if they are inline or from
+	// a users file
+	htpasswdFile string
+}
+
+// load reads and validates the users and destinations of the realm
+func (f realmFiles) load() (*realmPolicy, error) {
+	config := &ServerConfig{}
+	if f.config != "" {
+		var err error
+		if config, err = loadServerConfig(f.config); err != nil {
+			return nil, err
+		}
+	}
+	return f.loadWith(config)
+}
+
+// loadWith is load with the -config file already read into config
+func (f realmFiles) loadWith(config *ServerConfig) (loaded *realmPolicy, err error) {
+	if f.users != "" && (f.htpasswd != "" || config.Users != nil) {
+		return nil, fmt.Errorf("users file %s can not be combined with a basic auth file or the users of a config", f.users)
+	}
+
+	loaded = &realmPolicy{}
+	if config.Destinations != nil {
+		destinationBytes, err := yaml.Marshal(config.Destinations)
+		if err != nil {
+			return nil, fmt.Errorf("can not read destinations of config: %v", err)
+		}
+		loaded.destinations, loaded.denies, loaded.groups, err = policy.ParseDestinations(destinationBytes)
+	} else {
+		loaded.destinations, loaded.denies, loaded.groups, err = policy.LoadDestinations(f.destinations)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if f.users != "" {
+		users, err := loadUsersFile(f.users)
+		if err != nil {
+			return nil, err
+		}
+		if err := loaded.addUsers(users); err != nil {
+			return nil, err
+		}
+	} else if config.Users != nil {
+		loaded.passwordHashes = config.Users
+	} else {
+		loaded.htpasswdFile = f.htpasswd
+		if loaded.passwordHashes, err = htpasswd.ParseHtpasswdFile(f.htpasswd); err != nil {
+			return nil, fmt.Errorf("basic auth file sucks: %v", err)
+		}
+	}
+	if err := policy.ValidateDestinations(loaded.destinations, loaded.denies, loaded.groups, loaded.passwordHashes); err != nil {
+		return nil, err
+	}
+	return loaded, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"server-socks/policy"
+	"socks5"
+
+	"go.uber.org/zap"
+)
+
+// userConnLimiter wraps a socks5.RuleSet and caps the number of concurrent
+// connections per authenticated user. Slots are taken in Allow and given
+// back in Release once socks5 is done with the request. Udp associations
+// take their slot in associate, their datagrams pass Allow without one, as
+// do the peers of binds, covered by the slot of the bind.
+type userConnLimiter struct {
+	log    *zap.Logger
+	rules  socks5.RuleSet
+	max    int
+	lock   sync.Mutex
+	active map[string]int
+}
+
+func newUserConnLimiter(log *zap.Logger, rules socks5.RuleSet, max int) *userConnLimiter {
+	return &userConnLimiter{
+		log:    log,
+		rules:  rules,
+		max:    max,
+		active: map[string]int{},
+	}
+}
+
+func (l *userConnLimiter) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	newCtx, allowed := l.rules.Allow(ctx, req)
+	if !allowed {
+		return newCtx, false
+	}
+	userName, userNameOK := req.AuthContext.Payload["Username"]
+	if !userNameOK || req.Command == socks5.AssociateCommand || req.BindPeer() {
+		return newCtx, true
+	}
+
+	if !l.acquire(userName, req) {
+		l.release(newCtx, req)
+		return newCtx, false
+	}
+	return newCtx, true
+}
+
+// acquire takes a slot of userName for req, false if the user has none left
+func (l *userConnLimiter) acquire(userName string, req *socks5.Request) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.active[userName] >= l.max {
+		l.log.Info(
+			"denied - too many connections",
+			zap.String("to", req.DestAddr.String()),
+			zap.String("for", userName),
+			zap.String("from", policy.SourceIP(req)),
+			zap.Int("active", l.active[userName]),
+			zap.Int("max", l.max),
+		)
+		return false
+	}
+	l.active[userName]++
+	return true
+}
+
+// releaseUser gives a slot of userName back
+func (l *userConnLimiter) releaseUser(userName string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.active[userName]--
+	if l.active[userName] <= 0 {
+		delete(l.active, userName)
+	}
+}
+
+func (l *userConnLimiter) Release(ctx context.Context, req *socks5.Request) {
+	if userName, userNameOK := req.AuthContext.Payload["Username"]; userNameOK && req.Command != socks5.AssociateCommand && !req.BindPeer() {
+		l.releaseUser(userName)
+	}
+	l.release(ctx, req)
+}
+
+// associate makes udp associations take a slot of their user for as long
+// as they last, in addition to next, which may be nil. Without a limiter
+// next is returned.
+func (l *userConnLimiter) associate(next associateFunc) associateFunc {
+	if l == nil {
+		return next
+	}
+	return func(ctx context.Context, req *socks5.Request) (context.Context, func(), bool) {
+		userName, userNameOK := req.AuthContext.Payload["Username"]
+		if userNameOK && !l.acquire(userName, req) {
+			return ctx, nil, false
+		}
+		done := func() {}
+		if next != nil {
+			var nextDone func()
+			var ok bool
+			if ctx, nextDone, ok = next(ctx, req); !ok {
+				if userNameOK {
+					l.releaseUser(userName)
+				}
+				return ctx, nil, false
+			}
+			if nextDone != nil {
+				done = nextDone
+			}
+		}
+		return ctx, func() {
+			done()
+			if userNameOK {
+				l.releaseUser(userName)
+			}
+		}, true
+	}
+}
+
+// associateFunc is the type of socks5.Config.Associate
+type associateFunc func(ctx context.Context, req *socks5.Request) (context.Context, func(), bool)
+
+// release passes the release on to the wrapped rules
+func (l *userConnLimiter) release(ctx context.Context, req *socks5.Request) {
+	if r, ok := l.rules.(socks5.RuleReleaser); ok {
+		r.Release(ctx, req)
+	}
+}
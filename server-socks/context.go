@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+)
+
+type contextKey int
+
+const (
+	// accessRecordContextKey holds the access log record of a request
+	accessRecordContextKey contextKey = iota
+)
+
+func contextWithAccessRecord(ctx context.Context, record *accessRecord) context.Context {
+	return context.WithValue(ctx, accessRecordContextKey, record)
+}
+
+// accessRecordFromContext returns the access log record of the request,
+// nil if the access log is disabled
+func accessRecordFromContext(ctx context.Context) *accessRecord {
+	record, _ := ctx.Value(accessRecordContextKey).(*accessRecord)
+	return record
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"util"
+
+	"server-socks/policy"
+	"socks5"
+
+	"go.uber.org/zap"
+)
+
+// dialer dials destinations on behalf of socks5 and applies the bandwidth
+// limits configured for them
+type dialer struct {
+	log *zap.Logger
+	// rateLimit is the default bandwidth per connection, 0 is unlimited
+	rateLimit       int64
+	userRateLimiter *userRateLimiter
+	// self tracks dialed connections to detect loops
+	self *selfAddrs
+	// net sets the dial timeout and tcp keepalive of destinations
+	net net.Dialer
+	// idleTimeout closes connections without traffic for as long, 0
+	// keeps them open
+	idleTimeout time.Duration
+	// firstByteTimeout closes connections no bytes went through in either
+	// direction for as long after they were established, 0 waits forever
+	firstByteTimeout time.Duration
+	// quotas are charged with the bytes of the users, nil if disabled
+	quotas *quotas
+}
+
+// Dial can be used as socks5.Config.Dial
+func (d *dialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.net.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return d.wrap(ctx, d.self.track(conn), addr), nil
+}
+
+// BindConn can be used as socks5.Config.BindConn, the peers connecting to
+// bound ports are limited and counted like dialed destinations
+func (d *dialer) BindConn(ctx context.Context, peer net.Conn) net.Conn {
+	return d.wrap(ctx, peer, peer.RemoteAddr().String())
+}
+
+// Datagram can be used as socks5.Config.Datagram, the datagrams of udp
+// associations are charged to the quota of the user and throttled by the
+// bandwidth limits of the destination and user
+func (d *dialer) Datagram(ctx context.Context, n int, up bool) bool {
+	if !d.quotas.charge(policy.UserFromContext(ctx), n) {
+		return false
+	}
+	if limits, ok := ctx.Value(datagramLimitsKey{}).(*datagramLimits); ok {
+		name, destination := policy.DestinationFromContext(ctx)
+		if bucket := limits.bucket(name, d.rateLimit, destination); bucket != nil {
+			bucket.Wait(n)
+		}
+	}
+	if d.userRateLimiter != nil {
+		if bucket := d.userRateLimiter.bucket(policy.UserFromContext(ctx)); bucket != nil {
+			bucket.Wait(n)
+		}
+	}
+	return true
+}
+
+// Associate can be used as socks5.Config.Associate, each udp association
+// gets a bandwidth limit per destination like a connection has
+func (d *dialer) Associate(ctx context.Context, req *socks5.Request) (context.Context, func(), bool) {
+	return context.WithValue(ctx, datagramLimitsKey{}, &datagramLimits{buckets: map[string]*util.TokenBucket{}}), nil, true
+}
+
+type datagramLimitsKey struct{}
+
+// datagramLimits are the bandwidth limits of the destinations of an udp
+// association
+type datagramLimits struct {
+	lock    sync.Mutex
+	buckets map[string]*util.TokenBucket
+}
+
+// bucket returns the bucket of the destination named name, nil if neither
+// it nor the default rateLimit limit the bandwidth
+func (l *datagramLimits) bucket(name string, rateLimit int64, destination *policy.Destination) *util.TokenBucket {
+	if destination != nil && destination.RateLimit > 0 {
+		rateLimit = destination.RateLimit
+	}
+	if rateLimit <= 0 {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	bucket, ok := l.buckets[name]
+	if !ok {
+		bucket = util.NewTokenBucket(func() int64 { return rateLimit })
+		l.buckets[name] = bucket
+	}
+	return bucket
+}
+
+// wrap counts the bytes of conn to addr and applies the bandwidth limits
+// and timeouts of the destination and user
+func (d *dialer) wrap(ctx context.Context, conn net.Conn, addr string) net.Conn {
+	conn = d.count(ctx, conn, addr)
+
+	rateLimit := d.rateLimit
+	if _, destination := policy.DestinationFromContext(ctx); destination != nil && destination.RateLimit > 0 {
+		rateLimit = destination.RateLimit
+	}
+	if rateLimit > 0 {
+		conn = util.NewRateLimitedConn(conn, util.NewTokenBucket(func() int64 {
+			return rateLimit
+		}))
+	}
+	if d.userRateLimiter != nil {
+		conn = d.userRateLimiter.limit(ctx, conn)
+	}
+	return conn
+}
+
+// count wraps conn to log the bytes proxied when it is closed, shared with
+// the access log record of the request if there is one
+func (d *dialer) count(ctx context.Context, conn net.Conn, addr string) net.Conn {
+	counts := &byteCounts{}
+	if record := accessRecordFromContext(ctx); record != nil {
+		counts = &record.counts
+	}
+	name, destination := policy.DestinationFromContext(ctx)
+	userName := policy.UserFromContext(ctx)
+	start := time.Now()
+	counted := &countingConn{Conn: conn, counts: counts, usage: d.quotas.counter(userName), lastActivity: start.UnixNano(), closed: func() {
+		d.log.Info(
+			"connection closed",
+			zap.String("to", addr),
+			zap.String("name", name),
+			zap.String("for", userName),
+			zap.Int64("bytes_up", atomic.LoadInt64(&counts.up)),
+			zap.Int64("bytes_down", atomic.LoadInt64(&counts.down)),
+			zap.Duration("duration", time.Since(start)),
+			destination.LabelsField(),
+		)
+	}}
+	if d.idleTimeout > 0 {
+		counted.reapIdle(d.idleTimeout, func(idle time.Duration) {
+			idleConnectionsClosed.WithLabelValues().Inc()
+			d.log.Info("closing idle connection", zap.String("to", addr), zap.String("for", userName), zap.Duration("idle", idle))
+		})
+	}
+	if d.firstByteTimeout > 0 {
+		counted.reapSilent(d.firstByteTimeout, func() {
+			firstByteTimeouts.WithLabelValues().Inc()
+			d.log.Info("closing connection without traffic", zap.String("to", addr), zap.String("for", userName), zap.Duration("first_byte_timeout", d.firstByteTimeout))
+		})
+	}
+	return counted
+}
+
+// byteCounts are the bytes sent to and received from a destination
+type byteCounts struct {
+	up, down int64
+}
+
+// countingConn counts the bytes written to and read from the destination
+// and calls closed once when it is closed
+type countingConn struct {
+	net.Conn
+	counts *byteCounts
+	// usage of the quota of the user both directions add to, nil if the
+	// user has none
+	usage     *int64
+	closed    func()
+	closeOnce sync.Once
+	// lastActivity is when bytes last went through in unix nanoseconds
+	lastActivity int64
+	// timerLock guards the timers, which their own callbacks use, and
+	// stopped, set once Close stopped them
+	timerLock sync.Mutex
+	stopped   bool
+	idleTimer *time.Timer
+	// firstByteTimer closes the connection unless bytes went through
+	firstByteTimer *time.Timer
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.transferred(&c.counts.down, n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.transferred(&c.counts.up, n)
+	return n, err
+}
+
+func (c *countingConn) transferred(count *int64, n int) {
+	if n > 0 {
+		atomic.AddInt64(count, int64(n))
+		if c.usage != nil {
+			atomic.AddInt64(c.usage, int64(n))
+		}
+		atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+	}
+}
+
+// reapIdle closes the connection once no bytes went through it in either
+// direction for timeout, calling reaped before
+func (c *countingConn) reapIdle(timeout time.Duration, reaped func(idle time.Duration)) {
+	c.timerLock.Lock()
+	defer c.timerLock.Unlock()
+	c.idleTimer = time.AfterFunc(timeout, func() {
+		c.timerLock.Lock()
+		if c.stopped {
+			c.timerLock.Unlock()
+			return
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+		if idle < timeout {
+			c.idleTimer.Reset(timeout - idle)
+			c.timerLock.Unlock()
+			return
+		}
+		c.timerLock.Unlock()
+		reaped(idle)
+		_ = c.Close()
+	})
+}
+
+// reapSilent closes the connection if no bytes went through it in either
+// direction within timeout, calling reaped before. Unlike reapIdle it gives
+// up once the first bytes went through.
+func (c *countingConn) reapSilent(timeout time.Duration, reaped func()) {
+	c.timerLock.Lock()
+	defer c.timerLock.Unlock()
+	c.firstByteTimer = time.AfterFunc(timeout, func() {
+		c.timerLock.Lock()
+		stopped := c.stopped
+		c.timerLock.Unlock()
+		if stopped || atomic.LoadInt64(&c.counts.up) > 0 || atomic.LoadInt64(&c.counts.down) > 0 {
+			return
+		}
+		reaped()
+		_ = c.Close()
+	})
+}
+
+func (c *countingConn) Close() error {
+	c.timerLock.Lock()
+	c.stopped = true
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	if c.firstByteTimer != nil {
+		c.firstByteTimer.Stop()
+	}
+	c.timerLock.Unlock()
+	err := c.Conn.Close()
+	if c.closed != nil {
+		c.closeOnce.Do(c.closed)
+	}
+	return err
+}
+
+// CloseWrite keeps half closing working for wrapped tcp connections
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -4,16 +4,17 @@ go 1.18
 
 require (
 	golang.org/x/crypto v0.0.0-20200115085410-6d4e4cb37c7d
+	golang.org/x/net v0.0.0-20220708220712-1185a9018129
 	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
-	github.com/GehirnInc/crypt v0.0.0-20190301055215-6c0105aabd46 // indirect
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/multierr v1.6.0 // indirect
 )
 
 require (
+	github.com/GehirnInc/crypt v0.0.0-20190301055215-6c0105aabd46
 	github.com/foomo/htpasswd v0.0.0-20200116085101-e3a90e78da9c
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/spaolacci/murmur3 v1.1.0
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hashUpgrader rehashes passwords verified against a weaker hash than
+// bcrypt at cost, like SHA1, apr1 MD5 or bcrypt at a lower cost, and writes
+// the new hash back to the htpasswd file
+type hashUpgrader struct {
+	log  *zap.Logger
+	cost int
+	file string
+	// lock serializes updates of the file
+	lock sync.Mutex
+	// pending users are being upgraded
+	pending map[string]bool
+}
+
+func newHashUpgrader(log *zap.Logger, cost int, file string) *hashUpgrader {
+	return &hashUpgrader{log: log, cost: cost, file: file, pending: map[string]bool{}}
+}
+
+func (u *hashUpgrader) needsUpgrade(hashedPW string) bool {
+	if !strings.HasPrefix(hashedPW, "$2") {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hashedPW))
+	return err == nil && cost < u.cost
+}
+
+// upgrade rehashes the verified password of user in the background, if its
+// hash is too weak
+func (u *hashUpgrader) upgrade(credentials *Credentials, user, hashedPW string, password []byte) {
+	if u == nil || !u.needsUpgrade(hashedPW) {
+		return
+	}
+	u.lock.Lock()
+	if u.pending[user] {
+		u.lock.Unlock()
+		return
+	}
+	u.pending[user] = true
+	u.lock.Unlock()
+
+	password = append([]byte{}, password...)
+	go func() {
+		defer func() {
+			u.lock.Lock()
+			delete(u.pending, user)
+			u.lock.Unlock()
+		}()
+		upgradedPW, err := bcrypt.GenerateFromPassword(password, u.cost)
+		if err != nil {
+			u.log.Warn("could not rehash password", zap.String("for", user), zap.Error(err))
+			return
+		}
+
+		u.lock.Lock()
+		defer u.lock.Unlock()
+		if err := replaceHtpasswdHash(u.file, user, hashedPW, string(upgradedPW)); err != nil {
+			u.log.Warn("could not write upgraded password hash", zap.String("for", user), zap.Error(err))
+			return
+		}
+		credentials.replacePasswordHash(user, hashedPW, string(upgradedPW))
+		u.log.Info("upgraded password hash", zap.String("for", user), zap.Int("cost", u.cost))
+	}()
+}
+
+// replaceHtpasswdHash replaces the hash of user in an htpasswd file, if it
+// still is hashedPW, by atomically replacing the file
+func replaceHtpasswdHash(file, user, hashedPW, upgradedPW string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(content), "\n")
+	replaced := false
+	for i, line := range lines {
+		if strings.TrimRight(line, "\r") == user+":"+hashedPW {
+			lines[i] = user + ":" + upgradedPW + line[len(strings.TrimRight(line, "\r")):]
+			replaced = true
+		}
+	}
+	if !replaced {
+		return fmt.Errorf("%s changed in %s", user, file)
+	}
+
+	tmpFile := file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, []byte(strings.Join(lines, "\n")), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
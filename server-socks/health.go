@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// health tracks the startup of the server for probes
+type health struct {
+	listening uint32
+	// router is exported by /policy once the realms are set up, and
+	// tells if their destinations resolved
+	lock   sync.Mutex
+	router *realmRouter
+}
+
+func (h *health) setListening() {
+	atomic.StoreUint32(&h.listening, 1)
+}
+
+// setRouter makes the policy of the realms of router available to /policy
+func (h *health) setRouter(router *realmRouter) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.router = router
+}
+
+func (h *health) realmRouter() *realmRouter {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.router
+}
+
+// ready tells if the server listens and the destinations of every realm
+// resolved, realms starting with names that failed to resolve become
+// ready once the background resolution succeeds
+func (h *health) ready() bool {
+	if atomic.LoadUint32(&h.listening) != 1 {
+		return false
+	}
+	router := h.realmRouter()
+	if router == nil {
+		return false
+	}
+	for _, realm := range router.realms {
+		if !realm.authenticator.Resolved() {
+			return false
+		}
+	}
+	return true
+}
+
+// runHealthHandler serves /healthz, ok once the server listens, /readyz,
+// ok once the destinations have been resolved as well, and /policy, the
+// effective policy of the realms as json for audits
+func runHealthHandler(ctx context.Context, log *zap.Logger, address string, h *health) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeProbe(w, atomic.LoadUint32(&h.listening) == 1)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeProbe(w, h.ready())
+	})
+	mux.HandleFunc("/policy", func(w http.ResponseWriter, r *http.Request) {
+		router := h.realmRouter()
+		if router == nil {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		servePolicy(log, w, r, router)
+	})
+	server := &http.Server{Addr: address, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		log.Info("Shutdown health handler in progress")
+		_ = server.Shutdown(context.Background())
+	}()
+
+	log.Info("starting health handler", zap.String("addr", address))
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal("Failed to start health handler", zap.Error(err))
+	}
+}
+
+// servePolicy writes the effective policy of the realms of router, or of
+// the one given with ?realm=, as json
+func servePolicy(log *zap.Logger, w http.ResponseWriter, r *http.Request, router *realmRouter) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	policies := exportPolicies(router.realms)
+	if realmName := r.URL.Query().Get("realm"); realmName != "" {
+		realm, realmOK := router.realms[realmName]
+		if !realmOK {
+			http.Error(w, "unknown realm", http.StatusNotFound)
+			return
+		}
+		policies = []policyExport{exportPolicy(realm.name, realm.authenticator)}
+	}
+	writeJSON(log, w, policies)
+}
+
+func writeProbe(w http.ResponseWriter, ok bool) {
+	if !ok {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
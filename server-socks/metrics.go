@@ -0,0 +1,65 @@
+package main
+
+import (
+	"util"
+)
+
+var authCacheEvictions = util.NewCounterVector(
+	"auth_cache_evictions_total",
+	"Counts users evicted from the basic auth cache because it is full",
+	nil,
+)
+
+var plaintextProbes = util.NewCounterVector(
+	"plaintext_probes_total",
+	"Counts connections closed before the tls handshake because they did not start with one",
+	[]string{"reason"},
+)
+
+var tierAccepted = util.NewCounterVector(
+	"tier_connections_accepted_total",
+	"Counts connections given a slot by -max-active-conns by the tier of their user",
+	[]string{"tier"},
+)
+
+var tierShed = util.NewCounterVector(
+	"tier_connections_shed_total",
+	"Counts connections shed by -max-active-conns by the tier of their user",
+	[]string{"tier", "reason"},
+)
+
+var openConnections = util.NewGaugeVector(
+	"open_connections",
+	"Number of client connections being served",
+	nil,
+)
+
+var rejectedConnections = util.NewCounterVector(
+	"connections_rejected_total",
+	"Counts client connections closed right after being accepted by the limit rejecting them",
+	[]string{"reason"},
+)
+
+var idleConnectionsClosed = util.NewCounterVector(
+	"idle_connections_closed_total",
+	"Counts proxied connections closed for being idle longer than the idle timeout",
+	nil,
+)
+
+var firstByteTimeouts = util.NewCounterVector(
+	"first_byte_timeouts_total",
+	"Counts proxied connections closed for no traffic going through within the first byte timeout",
+	nil,
+)
+
+var muxSessions = util.NewGaugeVector(
+	"mux_sessions",
+	"Number of multiplexed client connections being served with -mux",
+	nil,
+)
+
+var muxStreams = util.NewCounterVector(
+	"mux_streams_total",
+	"Counts streams opened by clients over multiplexed connections",
+	nil,
+)
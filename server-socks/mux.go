@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"time"
+	"util"
+
+	"go.uber.org/zap"
+)
+
+// acceptMux tells by its first bytes if the client multiplexes connections
+// over conn. If so, their streams are served as connections of their own
+// until the session ends and nil is returned. Otherwise conn is returned
+// with the inspected bytes still to be read.
+func (r *realmRouter) acceptMux(conn net.Conn, realm *realm) net.Conn {
+	if !r.mux {
+		return conn
+	}
+	zapFrom := zap.String("from", conn.RemoteAddr().String())
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		r.log.Debug("no first bytes received", zapFrom, zap.Error(err))
+		util.SilentClose(conn)
+		return nil
+	}
+	conn = &peekedConn{Conn: conn, reader: reader}
+	if first[0] != util.MuxPreface[0] {
+		return conn
+	}
+	preface := make([]byte, len(util.MuxPreface))
+	if _, err := io.ReadFull(reader, preface); err != nil || !bytes.Equal(preface, util.MuxPreface) {
+		r.log.Debug("invalid mux preface", zapFrom, zap.ByteString("preface", preface))
+		util.SilentClose(conn)
+		return nil
+	}
+	// the session lasts until it is idle, its streams have deadlines of
+	// their own
+	_ = conn.SetDeadline(time.Time{})
+
+	session := util.NewMuxServer(conn, r.muxMaxStreams)
+	muxSessions.WithLabelValues().Inc()
+	defer muxSessions.WithLabelValues().Dec()
+	if r.muxIdleTimeout > 0 {
+		go reapIdleMux(session, r.muxIdleTimeout, func() {
+			r.log.Debug("closing idle mux session", zapFrom, zap.Duration("idle_timeout", r.muxIdleTimeout))
+		})
+	}
+	r.log.Debug("serving mux session", zapFrom)
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return nil
+		}
+		muxStreams.WithLabelValues().Inc()
+		go func() {
+			defer util.RecoverAndLogPanic(r.log)
+			// the connection of the session holds the -max-conns slot
+			// of its streams, -mux-max-streams caps them
+			if !r.ipRate.allow(stream) {
+				return
+			}
+			defer r.track(stream)()
+			_ = realm.server.ServeConn(stream)
+		}()
+	}
+}
+
+// reapIdleMux closes session once it had no open streams for timeout,
+// calling reaped before
+func reapIdleMux(session *util.MuxSession, timeout time.Duration, reaped func()) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	idleSince := time.Now()
+	for {
+		select {
+		case <-session.Done():
+			return
+		case now := <-ticker.C:
+			if session.NumStreams() > 0 {
+				idleSince = now
+				continue
+			}
+			if now.Sub(idleSince) >= timeout {
+				reaped()
+				_ = session.Close()
+				return
+			}
+		}
+	}
+}
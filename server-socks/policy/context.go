@@ -0,0 +1,56 @@
+package policy
+
+import (
+	"context"
+)
+
+type contextKey int
+
+const (
+	// userContextKey holds the authenticated user name of a request
+	userContextKey contextKey = iota
+	// destinationContextKey holds the destination that allowed a request
+	destinationContextKey
+	// denyReasonContextKey holds why the authenticator denied a request
+	denyReasonContextKey
+	// denyRuleContextKey holds the deny destination that denied a request
+	denyRuleContextKey
+)
+
+type allowedDestination struct {
+	name        string
+	destination *Destination
+}
+
+func contextWithUser(ctx context.Context, userName string) context.Context {
+	return context.WithValue(ctx, userContextKey, userName)
+}
+
+// UserFromContext returns the user name of the request Allow was asked
+// about, empty for clients without a user
+func UserFromContext(ctx context.Context) string {
+	userName, _ := ctx.Value(userContextKey).(string)
+	return userName
+}
+
+func contextWithDestination(ctx context.Context, name string, destination *Destination) context.Context {
+	return context.WithValue(ctx, destinationContextKey, allowedDestination{name: name, destination: destination})
+}
+
+// DestinationFromContext returns the destination that allowed the request
+// and its name, nil if there is none
+func DestinationFromContext(ctx context.Context) (string, *Destination) {
+	allowed, _ := ctx.Value(destinationContextKey).(allowedDestination)
+	return allowed.name, allowed.destination
+}
+
+func contextWithDenyRule(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, denyRuleContextKey, name)
+}
+
+// DenyRuleFromContext returns the deny destination that denied the request,
+// empty if there is none
+func DenyRuleFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(denyRuleContextKey).(string)
+	return name
+}
@@ -0,0 +1,121 @@
+package policy
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"socks5"
+
+	"github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+)
+
+// decision is an outcome of Allow kept in the decision cache
+type decision struct {
+	allowed bool
+	// name of the destination that allowed the request or of the deny
+	// destination that denied it
+	name        string
+	destination *Destination
+	reason      DenyReason
+	// msg and fields log a denied decision, the fields leave out the
+	// request
+	msg    string
+	fields []zap.Field
+	// denials are the records of the destinations that denied
+	denials []denialRecord
+}
+
+// CacheDecisions makes Allow keep its decisions by user, command,
+// requested address and port for ttl, they are dropped whenever the
+// destinations or their resolutions change. Decisions involving a
+// destination with a Schedule are not kept, as they change with the time.
+func (sa *Authenticator) CacheDecisions(ttl time.Duration) {
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+	sa.decisions = cache.New(ttl, 2*ttl)
+}
+
+// decisionKey is the key of the decision on req, empty if decisions are
+// not cached
+func (sa *Authenticator) decisionKey(req *socks5.Request) string {
+	if sa.decisions == nil {
+		return ""
+	}
+	// clients without a user are told apart from an empty user name
+	userName, userNameOK := req.AuthContext.Payload["Username"]
+	return strings.Join([]string{
+		strconv.FormatBool(userNameOK),
+		userName,
+		strconv.Itoa(int(req.Command)),
+		req.DestAddr.IP.String(),
+		strconv.Itoa(req.DestAddr.Port),
+		strings.ToLower(req.DestAddr.FQDN),
+	}, "\x00")
+}
+
+// cachedDecision returns the decision kept under key, sa.lock is held
+func (sa *Authenticator) cachedDecision(key string) (*decision, bool) {
+	if key == "" {
+		return nil, false
+	}
+	cached, ok := sa.decisions.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return cached.(*decision), true
+}
+
+// keepDecision caches a decision under key, sa.lock is held so it can not
+// outlive a change of the destinations it was made by
+func (sa *Authenticator) keepDecision(key string, d *decision) {
+	if key != "" {
+		sa.decisions.SetDefault(key, d)
+	}
+}
+
+// forgetDecisions drops all cached decisions, sa.lock is held for writing
+func (sa *Authenticator) forgetDecisions() {
+	if sa.decisions != nil {
+		sa.decisions.Flush()
+	}
+}
+
+// apply returns ctx carrying the decision like Allow made it, logging it
+// like Allow does, quietAllowed leaves out allowed decisions
+func (d *decision) apply(ctx context.Context, log *zap.Logger, quietAllowed bool, zapTo, zapUser, zapFrom zap.Field) context.Context {
+	fields := []zap.Field{zapTo, zapUser, zapFrom}
+	zapCached := zap.Bool("cached", true)
+	zapLabels := d.destination.LabelsField()
+	switch {
+	case d.allowed:
+		if !quietAllowed {
+			log.Info("allowed", append(fields, zap.String("name", d.name), zapLabels, zapCached)...)
+		}
+		d.destination.logRecord("allowed", d.name, fields...)
+		return contextWithDestination(ctx, d.name, d.destination)
+	case d.reason == DenyReasonDenyRule:
+		log.Info("denied - deny rule matched", append(fields, zap.String("deny", d.name), d.reason.Field(), zapLabels, zapCached)...)
+		d.destination.logRecord("denied - deny rule matched", d.name, append(fields, d.reason.Field())...)
+		return contextWithDenyRule(d.reason.Context(ctx), d.name)
+	}
+	d.logDenied(log, (*Destination).logRecord, zapTo, zapUser, zapFrom, zapCached)
+	return d.reason.Context(ctx)
+}
+
+// logDenied logs a denied decision and writes the records of the
+// destinations that denied to their log sinks, extra goes to the log line
+func (d *decision) logDenied(log *zap.Logger, logRecord recordFunc, zapTo, zapUser, zapFrom zap.Field, extra ...zap.Field) {
+	for _, denial := range d.denials {
+		logRecord(denial.destination, denial.msg, denial.name, append([]zap.Field{zapTo, zapUser, zapFrom}, denial.fields...)...)
+	}
+	if d.reason == DenyReasonNoUser {
+		// there is no user to log
+		zapUser = zap.Skip()
+	}
+	fields := append([]zap.Field{zapTo, zapUser, zapFrom}, d.fields...)
+	fields = append(fields, d.reason.Field(), d.destination.LabelsField())
+	log.Info(d.msg, append(fields, extra...)...)
+}
@@ -0,0 +1,80 @@
+package policy
+
+import (
+	"context"
+
+	"socks5"
+
+	"go.uber.org/zap"
+)
+
+// DenyReason tells why the authenticator denied a request. Reasons are
+// ordered from the least to the most specific.
+type DenyReason int
+
+const (
+	// DenyReasonUnknownDestination no destination matches the address
+	DenyReasonUnknownDestination DenyReason = iota
+	// DenyReasonPortNotAllowed destinations match but not the port
+	DenyReasonPortNotAllowed
+	// DenyReasonCommandNotAllowed destinations match but not the socks
+	// command, like udp to a destination only allowing connect
+	DenyReasonCommandNotAllowed
+	// DenyReasonNoUser destinations require a user but the client has none
+	DenyReasonNoUser
+	// DenyReasonUserNotAllowed destinations match but not the user
+	DenyReasonUserNotAllowed
+	// DenyReasonOutsideSchedule destinations match but are closed now
+	DenyReasonOutsideSchedule
+	// DenyReasonCountryNotAllowed destinations match but the IP is located
+	// in a country they do not allow
+	DenyReasonCountryNotAllowed
+	// DenyReasonDenyRule a deny destination matched
+	DenyReasonDenyRule
+	// DenyReasonQuotaExceeded the user used up the quota of the period
+	DenyReasonQuotaExceeded
+)
+
+var denyReasonNames = map[DenyReason]string{
+	DenyReasonUnknownDestination: "unknown_destination",
+	DenyReasonPortNotAllowed:     "port_not_allowed",
+	DenyReasonCommandNotAllowed:  "command_not_allowed",
+	DenyReasonNoUser:             "no_user",
+	DenyReasonUserNotAllowed:     "user_not_allowed",
+	DenyReasonOutsideSchedule:    "outside_schedule",
+	DenyReasonCountryNotAllowed:  "country_not_allowed",
+	DenyReasonDenyRule:           "deny_rule",
+	DenyReasonQuotaExceeded:      "quota_exceeded",
+}
+
+func (r DenyReason) String() string {
+	return denyReasonNames[r]
+}
+
+func (r DenyReason) Field() zap.Field {
+	return zap.String("reason", r.String())
+}
+
+// reply is the socks5 reply telling the client most about the reason
+func (r DenyReason) reply() uint8 {
+	switch r {
+	case DenyReasonUnknownDestination:
+		return socks5.ReplyHostUnreachable
+	case DenyReasonPortNotAllowed:
+		return socks5.ReplyConnectionRefused
+	}
+	return socks5.ReplyNotAllowed
+}
+
+// context returns ctx making socks5 send the reply of the reason, the
+// reason itself is kept for DenyReasonFromContext
+func (r DenyReason) Context(ctx context.Context) context.Context {
+	return context.WithValue(socks5.WithDenyReply(ctx, r.reply()), denyReasonContextKey, r)
+}
+
+// DenyReasonFromContext returns why the authenticator denied the request,
+// false if it did not
+func DenyReasonFromContext(ctx context.Context) (DenyReason, bool) {
+	reason, ok := ctx.Value(denyReasonContextKey).(DenyReason)
+	return reason, ok
+}
@@ -0,0 +1,246 @@
+package policy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"socks5"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// Destination is an entry of the destinations config, named by a hostname
+// or IP, a wildcard or a network, allowing or, under deny, denying access
+type Destination struct {
+	// Users allowed, entries like svc-billing-* are glob patterns
+	Users []string
+	// Groups of users allowed in addition to Users
+	Groups []string
+	Ports  []int
+	// AllPorts allows any port instead of the listed Ports
+	AllPorts bool
+	// Commands optionally limits the socks commands allowed to connect,
+	// udp and bind, empty allows all of them
+	Commands []string
+	// Schedule optionally limits access to time windows like
+	// "Mon-Fri 09:00-18:00", evaluated in Timezone, deny entries apply at
+	// all times and can not have one
+	Schedule []string
+	// Timezone of the Schedule, defaults to the local one
+	Timezone string
+	// RateLimit is the bandwidth per connection in bytes per second,
+	// overriding the -rate-limit default, 0 means the default applies
+	RateLimit int64
+	// AllowCountries limits the destination to IPs located in the listed
+	// countries like DE, DenyCountries excludes countries, both need
+	// -geoip-db
+	AllowCountries []string
+	DenyCountries  []string
+	// LogSink is a file connection records for the destination are written
+	// to in addition to the main log, for destinations needing their logs
+	// kept apart
+	LogSink string
+	// Labels like service: billing are attached to the log lines about the
+	// destination to tell flows apart
+	Labels map[string]string
+
+	windows  []accessWindow
+	location *time.Location
+	sinkLog  *zap.Logger
+	// members are the users of the Groups
+	members []string
+}
+
+func (d *Destination) init() (err error) {
+	if d.location, err = LoadLocation(d.Timezone); err != nil {
+		return err
+	}
+	for i, country := range d.AllowCountries {
+		d.AllowCountries[i] = strings.ToUpper(country)
+	}
+	for i, country := range d.DenyCountries {
+		d.DenyCountries[i] = strings.ToUpper(country)
+	}
+	d.windows = make([]accessWindow, len(d.Schedule))
+	for i, window := range d.Schedule {
+		if d.windows[i], err = parseAccessWindow(window); err != nil {
+			return err
+		}
+	}
+	return d.initLogSink()
+}
+
+// openAt tells if the schedule of the destination allows access at the
+// given time, destinations without a schedule are always open
+func (d *Destination) openAt(now time.Time) bool {
+	if len(d.windows) == 0 {
+		return true
+	}
+	now = now.In(d.location)
+	for _, window := range d.windows {
+		if window.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// denyKey is the top level key in the destinations config that holds
+// destinations to deny, overriding any allowing destination. Empty Ports,
+// Users or Commands on a deny destination match any port, user or command.
+//
+// Destinations are named by a hostname or IP, a wildcard like
+// *.example.com, or a network like 10.0.0.0/8.
+const denyKey = "deny"
+
+// groupsKey is the top level key in the destinations config that names
+// groups of users, destinations list groups to allow all of their members
+const groupsKey = "groups"
+
+type destinationsConfig struct {
+	Deny   map[string]*Destination `yaml:"deny"`
+	Groups map[string][]string     `yaml:"groups"`
+}
+
+// commandNames are the names of the socks commands in Commands
+var commandNames = map[string]uint8{
+	"connect": socks5.ConnectCommand,
+	"udp":     socks5.AssociateCommand,
+	"bind":    socks5.BindCommand,
+}
+
+// commandName is the name of a socks command in Commands
+func commandName(command uint8) string {
+	for name, namedCommand := range commandNames {
+		if namedCommand == command {
+			return name
+		}
+	}
+	return strconv.Itoa(int(command))
+}
+
+// allowsCommand tells if the socks command is listed in Commands, any
+// command is allowed if none are listed
+func (d *Destination) allowsCommand(command uint8) bool {
+	if len(d.Commands) == 0 {
+		return true
+	}
+	for _, name := range d.Commands {
+		if allowedCommand, ok := commandNames[strings.ToLower(name)]; ok && allowedCommand == command {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Destination) allowsPort(port int) bool {
+	if d.AllPorts {
+		return true
+	}
+	for _, allowedPort := range d.Ports {
+		if allowedPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsUser tells if userName is listed, is a member of a listed group, or
+// matches a listed pattern like svc-billing-*
+func (d *Destination) allowsUser(userName string) bool {
+	if containsString(d.Users, userName) || containsString(d.members, userName) {
+		return true
+	}
+	for _, allowedUser := range d.Users {
+		if isUserPattern(allowedUser) {
+			if matched, _ := path.Match(allowedUser, userName); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isUserPattern tells if a user entry is a glob pattern rather than a name
+func isUserPattern(user string) bool {
+	return strings.ContainsAny(user, "*?[")
+}
+
+// restrictsCountries tells if the destination is limited by country
+func (d *Destination) restrictsCountries() bool {
+	return len(d.AllowCountries) > 0 || len(d.DenyCountries) > 0
+}
+
+// allowsCountry tells if the country ip is located in passes
+// AllowCountries and DenyCountries, IPs of unknown countries only pass
+// DenyCountries
+func (d *Destination) allowsCountry(geo *GeoIP, ip net.IP) bool {
+	if !d.restrictsCountries() {
+		return true
+	}
+	country := geo.country(ip)
+	if containsString(d.DenyCountries, country) {
+		return false
+	}
+	return len(d.AllowCountries) == 0 || containsString(d.AllowCountries, country)
+}
+
+// restrictsUsers tells if only some users are allowed
+func (d *Destination) restrictsUsers() bool {
+	return len(d.Users) > 0 || len(d.Groups) > 0
+}
+
+// expandGroups looks up the members of the Groups of the destination,
+// unknown groups are left to ValidateDestinations
+func (d *Destination) expandGroups(groups map[string][]string) {
+	if d == nil {
+		return
+	}
+	d.members = nil
+	for _, group := range d.Groups {
+		d.members = append(d.members, groups[group]...)
+	}
+}
+
+// Members returns the users allowed through the Groups of the destination
+func (d *Destination) Members() []string {
+	return d.members
+}
+
+// LoadDestinations reads the allowed and denied destinations and the user
+// groups they refer to from file
+func LoadDestinations(file string) (destinations, denies map[string]*Destination, groups map[string][]string, err error) {
+	destinationBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("can not read destinations config: %v", err)
+	}
+	return ParseDestinations(destinationBytes)
+}
+
+// ParseDestinations parses a destinations config
+func ParseDestinations(destinationBytes []byte) (destinations, denies map[string]*Destination, groups map[string][]string, err error) {
+	destinations = map[string]*Destination{}
+	if err := yaml.Unmarshal(destinationBytes, destinations); err != nil {
+		return nil, nil, nil, fmt.Errorf("can not parse destinations: %v", err)
+	}
+	delete(destinations, denyKey)
+	delete(destinations, groupsKey)
+
+	config := destinationsConfig{}
+	if err := yaml.Unmarshal(destinationBytes, &config); err != nil {
+		return nil, nil, nil, fmt.Errorf("can not parse deny destinations and groups: %v", err)
+	}
+	for _, d := range destinations {
+		d.expandGroups(config.Groups)
+	}
+	for _, d := range config.Deny {
+		d.expandGroups(config.Groups)
+	}
+	return destinations, config.Deny, config.Groups, nil
+}
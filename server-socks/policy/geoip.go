@@ -0,0 +1,262 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// GeoIP looks up the country of IPs in a MaxMind DB like GeoLite2-Country,
+// read into memory once
+type GeoIP struct {
+	tree       []byte
+	data       mmdbDecoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// ipv4Start is the node of ::/96 in ipv6 databases, ipv4 lookups
+	// start there
+	ipv4Start uint
+}
+
+var (
+	mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+	errInvalidMMDB     = errors.New("invalid maxmind db")
+)
+
+// OpenGeoIP reads the MaxMind DB file
+func OpenGeoIP(file string) (*GeoIP, error) {
+	db, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	markerAt := bytes.LastIndex(db, mmdbMetadataMarker)
+	if markerAt < 0 {
+		return nil, fmt.Errorf("%s is not a maxmind db", file)
+	}
+	metadata, _, err := mmdbDecoder(db[markerAt+len(mmdbMetadataMarker):]).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("can not read metadata of %s: %v", file, err)
+	}
+	fields, _ := metadata.(map[string]interface{})
+	g := &GeoIP{
+		nodeCount:  mmdbUint(fields["node_count"]),
+		recordSize: mmdbUint(fields["record_size"]),
+		ipVersion:  mmdbUint(fields["ip_version"]),
+	}
+	if g.recordSize != 24 && g.recordSize != 28 && g.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d in %s", g.recordSize, file)
+	}
+	treeSize := g.recordSize * g.nodeCount / 4
+	if treeSize+16 > uint(markerAt) {
+		return nil, fmt.Errorf("search tree of %s exceeds the file", file)
+	}
+	g.tree = db[:treeSize]
+	g.data = mmdbDecoder(db[treeSize+16 : markerAt])
+	if g.ipVersion == 6 {
+		for i := 0; i < 96 && g.ipv4Start < g.nodeCount; i++ {
+			g.ipv4Start = g.record(g.ipv4Start, 0)
+		}
+	}
+	return g, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node
+func (g *GeoIP) record(node, bit uint) uint {
+	switch g.recordSize {
+	case 24:
+		b := g.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := g.tree[node*7:]
+		if bit == 0 {
+			return (uint(b[3])&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return (uint(b[3])&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(g.tree[node*8+bit*4:]))
+	}
+}
+
+// country returns the iso code of the country of ip, "" if it is unknown
+func (g *GeoIP) country(ip net.IP) string {
+	if g == nil {
+		return ""
+	}
+	node, address := uint(0), ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		node, address = g.ipv4Start, ip4
+	} else if g.ipVersion == 4 || address == nil {
+		return ""
+	}
+	for i := 0; i < 8*len(address) && node < g.nodeCount; i++ {
+		bit := uint(address[i/8]>>(7-uint(i%8))) & 1
+		node = g.record(node, bit)
+	}
+	if node <= g.nodeCount {
+		return ""
+	}
+	value, _, err := g.data.decode(node-g.nodeCount-16, 0)
+	if err != nil {
+		return ""
+	}
+	fields, _ := value.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := fields[key].(map[string]interface{})
+		if isoCode, ok := country["iso_code"].(string); ok {
+			return isoCode
+		}
+	}
+	return ""
+}
+
+// mmdbDecoder decodes values of the data section of a maxmind db
+type mmdbDecoder []byte
+
+const mmdbMaxDepth = 32
+
+func (d mmdbDecoder) bytes(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d)) || offset+n < offset {
+		return nil, errInvalidMMDB
+	}
+	return d[offset : offset+n], nil
+}
+
+// decode returns the value at offset and the offset following it
+func (d mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errInvalidMMDB
+	}
+	control, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+	kind := uint(control[0] >> 5)
+	if kind == 1 {
+		pointer, next, err := d.pointer(control[0], offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer, depth+1)
+		return value, next, err
+	}
+	if kind == 0 {
+		extended, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + uint(extended[0])
+		offset++
+	}
+	size := uint(control[0] & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		b, err := d.bytes(offset, extra)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += extra
+		size = uint(mmdbBigEndian(b)) + []uint{29, 285, 65821}[extra-1]
+	}
+
+	switch kind {
+	case 2, 4:
+		b, err := d.bytes(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if kind == 4 {
+			return append([]byte{}, b...), offset + size, nil
+		}
+		return string(b), offset + size, nil
+	case 3, 15:
+		b, err := d.bytes(offset, size)
+		if err != nil || (size != 8 && size != 4) {
+			return nil, 0, errInvalidMMDB
+		}
+		if size == 4 {
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset + size, nil
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset + size, nil
+	case 5, 6, 8, 9, 10:
+		b, err := d.bytes(offset, size)
+		if err != nil || size > 16 {
+			return nil, 0, errInvalidMMDB
+		}
+		if size > 8 {
+			// uint128 is not needed for countries, keep the low bits
+			b = b[size-8:]
+		}
+		return mmdbBigEndian(b), offset + size, nil
+	case 7:
+		fields := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errInvalidMMDB
+			}
+			if fields[name], offset, err = d.decode(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return fields, offset, nil
+	case 11:
+		values := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, value)
+			offset = next
+		}
+		return values, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported maxmind db type %d", kind)
+}
+
+// pointer returns the offset a pointer starting with control points to
+// and the offset following the pointer
+func (d mmdbDecoder) pointer(control byte, offset uint) (uint, uint, error) {
+	size := uint(control>>3)&3 + 1
+	b, err := d.bytes(offset, size)
+	if err != nil {
+		return 0, 0, err
+	}
+	value := uint(control & 7)
+	switch size {
+	case 1:
+		value = value<<8 | uint(b[0])
+	case 2:
+		value = (value<<16 | uint(mmdbBigEndian(b))) + 2048
+	case 3:
+		value = (value<<24 | uint(mmdbBigEndian(b))) + 526336
+	default:
+		value = uint(mmdbBigEndian(b))
+	}
+	return value, offset + size, nil
+}
+
+func mmdbBigEndian(b []byte) uint64 {
+	var value uint64
+	for _, c := range b {
+		value = value<<8 | uint64(c)
+	}
+	return value
+}
+
+func mmdbUint(value interface{}) uint {
+	n, _ := value.(uint64)
+	return uint(n)
+}
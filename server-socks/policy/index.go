@@ -0,0 +1,75 @@
+package policy
+
+import (
+	"net"
+	"sort"
+
+	"socks5"
+)
+
+// nameIndex finds the destination names matching a requested address
+// without matching every name: names are looked up by the IPs they resolved
+// to, only networks and wildcards, usually few, are matched one by one
+type nameIndex struct {
+	// byIP are the names by the IPs they resolved to, in evaluation order
+	byIP      map[string][]string
+	networks  []string
+	wildcards []string
+}
+
+// newNameIndex indexes names by their resolved names and networks
+func newNameIndex(names []string, resolvedNames map[string][]string, networks map[string]*net.IPNet) *nameIndex {
+	ix := &nameIndex{byIP: map[string][]string{}}
+	for _, name := range names {
+		if isWildcard(name) {
+			ix.wildcards = append(ix.wildcards, name)
+			continue
+		}
+		if _, ok := networks[name]; ok {
+			ix.networks = append(ix.networks, name)
+			continue
+		}
+		for _, addr := range resolvedNames[name] {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				continue
+			}
+			// IPs of the same name in several forms are indexed once
+			key := ip.String()
+			if indexed := ix.byIP[key]; len(indexed) == 0 || indexed[len(indexed)-1] != name {
+				ix.byIP[key] = append(indexed, name)
+			}
+		}
+	}
+	return ix
+}
+
+// lookup returns the names matching addr like Authenticator.matches, in
+// the order of their evaluation
+func (ix *nameIndex) lookup(addr *socks5.AddrSpec, networks map[string]*net.IPNet) []string {
+	if ix == nil {
+		return nil
+	}
+	matched := ix.byIP[addr.IP.String()]
+	if len(ix.networks) == 0 && len(ix.wildcards) == 0 {
+		return matched
+	}
+	others := []string{}
+	for _, name := range ix.networks {
+		if network, ok := networks[name]; ok && network.Contains(addr.IP) {
+			others = append(others, name)
+		}
+	}
+	for _, name := range ix.wildcards {
+		if wildcardMatches(name, addr.FQDN) {
+			others = append(others, name)
+		}
+	}
+	if len(others) == 0 {
+		return matched
+	}
+	// names are evaluated in sorted order
+	merged := append(append(make([]string, 0, len(matched)+len(others)), matched...), others...)
+	sort.Strings(merged)
+	return merged
+}
@@ -0,0 +1,88 @@
+package policy
+
+import (
+	"sort"
+	"sync"
+	"util"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// logSinks are the loggers of the files destinations route their
+// connection records to, shared by all realms and kept across reloads
+var logSinks = &logSinkRegistry{loggers: map[string]*zap.Logger{}}
+
+type logSinkRegistry struct {
+	lock    sync.Mutex
+	loggers map[string]*zap.Logger
+}
+
+// get returns the logger appending to file, opening it once
+func (r *logSinkRegistry) get(file string) (*zap.Logger, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if logger, ok := r.loggers[file]; ok {
+		return logger, nil
+	}
+	logger, err := util.NewLogger("info", file)
+	if err != nil {
+		return nil, err
+	}
+	r.loggers[file] = logger
+	return logger, nil
+}
+
+// initLogSink opens the log sink of the destination, if it has one
+func (d *Destination) initLogSink() (err error) {
+	if d.LogSink != "" {
+		d.sinkLog, err = logSinks.get(d.LogSink)
+	}
+	return err
+}
+
+// logRecord writes a connection record about the destination to its log
+// sink, if it has one, in addition to the main log
+func (d *Destination) logRecord(msg string, name string, fields ...zap.Field) {
+	if d.sinkLog != nil {
+		d.sinkLog.Info(msg, append(fields, zap.String("destination", name), d.LabelsField())...)
+	}
+}
+
+// LabelsField is the log field carrying the Labels of the destination,
+// skipped if d is nil or has none
+func (d *Destination) LabelsField() zap.Field {
+	if d == nil || len(d.Labels) == 0 {
+		return zap.Skip()
+	}
+	return zap.Object("labels", destinationLabels(d.Labels))
+}
+
+// destinationLabels logs as an object of the labels in key order
+type destinationLabels map[string]string
+
+func (l destinationLabels) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	keys := make([]string, 0, len(l))
+	for key := range l {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		enc.AddString(key, l[key])
+	}
+	return nil
+}
+
+// recordFunc writes a connection record about a destination like
+// Destination.logRecord
+type recordFunc func(d *Destination, msg string, name string, fields ...zap.Field)
+
+// denialRecord is a record about a destination denying a request, written
+// to its log sink once no other destination allowed the request. The fields
+// leave out the request, so the record applies to any request denied alike.
+type denialRecord struct {
+	destination *Destination
+	msg         string
+	name        string
+	fields      []zap.Field
+}
@@ -0,0 +1,528 @@
+// Package policy decides which destinations the clients of a socks server
+// may reach. Destinations and denies are read from a destinations config,
+// their names are resolved periodically and an Authenticator allows or
+// denies the requests of a socks5.Server by them.
+package policy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"socks5"
+
+	"github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+)
+
+// Policy decides on the requests of a socks5.Server by destinations that
+// can be replaced while serving, Authenticator implements it
+type Policy interface {
+	socks5.RuleSet
+	// SetDestinations replaces the destinations and denies, the current
+	// ones are kept if the new ones are invalid
+	SetDestinations(destinations, denies map[string]*Destination) error
+	// Destinations returns the current destinations and denies
+	Destinations() (destinations, denies map[string]*Destination)
+	// Resolutions returns what the names of the destinations resolved to
+	Resolutions() []Resolution
+	// Resolved tells if every name of the destinations resolved once
+	Resolved() bool
+	// Snapshot returns the destinations, denies and resolutions as of the
+	// same moment
+	Snapshot() (destinations, denies map[string]*Destination, resolutions []Resolution)
+	// Evaluate decides a request like Allow without logging the decision,
+	// writing it to log sinks or caching it
+	Evaluate(ctx context.Context, req *socks5.Request) (context.Context, bool)
+}
+
+var _ Policy = (*Authenticator)(nil)
+
+// Authenticator allows requests to the destinations resolving to the
+// requested IP, see Allow
+type Authenticator struct {
+	log           *zap.Logger
+	destinations  map[string]*Destination
+	denies        map[string]*Destination
+	names         []string
+	denyNames     []string
+	lock          sync.RWMutex
+	resolvedNames map[string][]string
+	resolvedAt    map[string]time.Time
+	// networks by the name of destinations and denies given as a cidr
+	networks map[string]*net.IPNet
+	// allowIndex and denyIndex find the names matching a request, rebuilt
+	// along with the resolved names
+	allowIndex *nameIndex
+	denyIndex  *nameIndex
+	// toResolve are the names resolved periodically, replaced on reload
+	toResolve []string
+	// literals are the names that are IPs, never looked up
+	literals []string
+	// nextResolve is when each name to resolve is due to be resolved again
+	nextResolve map[string]time.Time
+	// resolveFailures counts the failed lookups in a row of names failing
+	// to resolve, to back off retrying them
+	resolveFailures map[string]int
+	resolver        Resolver
+	// resolveWorkers is the number of names looked up at once
+	resolveWorkers int
+	// AllowAll allows every request not matching a deny destination
+	// regardless of the destinations
+	AllowAll bool
+	// QuietAllowed leaves the "allowed" lines out of the log, denials are
+	// logged as before
+	QuietAllowed bool
+	// decisions are the cached decisions of Allow, nil if disabled
+	decisions *cache.Cache
+	// geo locates destination IPs for AllowCountries and DenyCountries,
+	// nil if no geoip db is configured
+	geo *GeoIP
+}
+
+// NewAuthenticator resolves the names of the destinations and denies with
+// resolver, up to resolveWorkers at once, and keeps resolving them in the
+// background. A nil resolver is the SystemResolver, geo may be nil if no
+// destination is limited by country.
+func NewAuthenticator(log *zap.Logger, destinations, denies map[string]*Destination, resolver Resolver, resolveWorkers int, geo *GeoIP) (*Authenticator, error) {
+	if resolver == nil {
+		resolver = SystemResolver{}
+	}
+	sa := &Authenticator{log: log, resolver: resolver, resolveWorkers: resolveWorkers, geo: geo}
+	if err := sa.SetDestinations(destinations, denies); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			time.Sleep(sa.untilNextResolve())
+
+			sa.lock.RLock()
+			toResolve := sa.toResolve
+			sa.lock.RUnlock()
+			names := sa.dueNames(time.Now())
+			if len(names) == 0 {
+				continue
+			}
+
+			resolvedNames, ttls, err := resolveNames(sa.resolver, sa.resolveWorkers, names)
+			if err != nil {
+				log.Warn("could not resolve names, keeping their last known addresses", zap.Error(err))
+			}
+			sa.lock.RLock()
+			reloaded := !sameStrings(toResolve, sa.toResolve)
+			sa.lock.RUnlock()
+			if !reloaded {
+				failed, _ := err.(resolveErrors)
+				sa.setResolvedNames(resolvedNames)
+				sa.scheduleResolve(names, ttls, failed)
+			}
+		}
+	}()
+	return sa, nil
+}
+
+// SetDestinations validates and resolves destinations and denies and only
+// then replaces the current ones, so a failing reload changes nothing
+func (sa *Authenticator) SetDestinations(destinations, denies map[string]*Destination) error {
+	for name, destination := range destinations {
+		if err := destination.init(); err != nil {
+			return fmt.Errorf("invalid destination %s: %v", name, err)
+		}
+		if destination.restrictsCountries() && sa.geo == nil {
+			return fmt.Errorf("invalid destination %s: countries need -geoip-db", name)
+		}
+	}
+	for name, deny := range denies {
+		if err := deny.initLogSink(); err != nil {
+			return fmt.Errorf("invalid deny destination %s: %v", name, err)
+		}
+	}
+	// evaluate destinations in a stable order
+	names := sortedNames(destinations)
+	denyNames := sortedNames(denies)
+
+	toResolve := []string{}
+	literals := []string{}
+	networks := map[string]*net.IPNet{}
+	for _, name := range append(append([]string{}, names...), denyNames...) {
+		if isCIDR(name) {
+			_, network, err := net.ParseCIDR(name)
+			if err != nil {
+				return fmt.Errorf("invalid destination %s: %v", name, err)
+			}
+			networks[name] = network
+			continue
+		}
+		if net.ParseIP(name) != nil {
+			if !containsString(literals, name) {
+				literals = append(literals, name)
+			}
+			continue
+		}
+		// wildcards are matched by the requested name, not resolved
+		if !isWildcard(name) && !containsString(toResolve, name) {
+			toResolve = append(toResolve, name)
+		}
+	}
+
+	// names failing to resolve keep their last known addresses, if any
+	resolvedNames, ttls, err := resolveNames(sa.resolver, sa.resolveWorkers, toResolve)
+	if err != nil {
+		sa.log.Warn("could not resolve names", zap.Error(err))
+	}
+
+	sa.lock.Lock()
+	sa.destinations = destinations
+	sa.denies = denies
+	sa.names = names
+	sa.denyNames = denyNames
+	sa.networks = networks
+	sa.toResolve = toResolve
+	sa.literals = literals
+	sa.nextResolve = map[string]time.Time{}
+	sa.resolveFailures = map[string]int{}
+	// the indexes are rebuilt along with the swap, Allow never walks an
+	// index of other destinations
+	sa.setResolvedNamesLocked(resolvedNames)
+	sa.forgetDecisions()
+	sa.lock.Unlock()
+	failed, _ := err.(resolveErrors)
+	sa.scheduleResolve(toResolve, ttls, failed)
+	return nil
+}
+
+// Destinations returns the current destinations and denies
+func (sa *Authenticator) Destinations() (destinations, denies map[string]*Destination) {
+	sa.lock.RLock()
+	defer sa.lock.RUnlock()
+	return sa.destinations, sa.denies
+}
+
+// setResolvedNames replaces the resolutions of the names to resolve, names
+// missing from resolvedNames keep their previous resolution. IP literals
+// resolve to themselves.
+func (sa *Authenticator) setResolvedNames(resolvedNames map[string][]string) {
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+	sa.setResolvedNamesLocked(resolvedNames)
+}
+
+// setResolvedNamesLocked is setResolvedNames with sa.lock held for writing
+func (sa *Authenticator) setResolvedNamesLocked(resolvedNames map[string][]string) {
+	now := time.Now()
+	newResolvedNames := make(map[string][]string, len(sa.toResolve)+len(sa.literals))
+	resolvedAt := make(map[string]time.Time, len(sa.toResolve)+len(sa.literals))
+	changed := false
+	for _, name := range sa.literals {
+		newResolvedNames[name] = []string{net.ParseIP(name).String()}
+		if resolvedAt[name] = sa.resolvedAt[name]; resolvedAt[name].IsZero() {
+			resolvedAt[name] = now
+		}
+	}
+	for _, name := range sa.toResolve {
+		if addrs, ok := resolvedNames[name]; ok {
+			changed = changed || !sameStrings(addrs, sa.resolvedNames[name])
+			newResolvedNames[name] = addrs
+			resolvedAt[name] = now
+		} else if addrs, ok := sa.resolvedNames[name]; ok {
+			newResolvedNames[name] = addrs
+			resolvedAt[name] = sa.resolvedAt[name]
+		}
+	}
+	sa.resolvedNames = newResolvedNames
+	sa.resolvedAt = resolvedAt
+	sa.index()
+	if changed {
+		sa.forgetDecisions()
+	}
+}
+
+// index rebuilds the name indexes, sa.lock is held for writing
+func (sa *Authenticator) index() {
+	sa.allowIndex = newNameIndex(sa.names, sa.resolvedNames, sa.networks)
+	sa.denyIndex = newNameIndex(sa.denyNames, sa.resolvedNames, sa.networks)
+}
+
+// Resolution is the addresses a destination name resolved to and when
+type Resolution struct {
+	Name       string    `json:"name"`
+	IPs        []string  `json:"ips"`
+	ResolvedAt time.Time `json:"resolved_at"`
+}
+
+// Resolutions returns the current resolution of every resolved name
+func (sa *Authenticator) Resolutions() []Resolution {
+	sa.lock.RLock()
+	defer sa.lock.RUnlock()
+	return sa.resolutions()
+}
+
+// Snapshot returns the current destinations, denies and resolutions under
+// a single lock, consistent with each other across a reload
+func (sa *Authenticator) Snapshot() (destinations, denies map[string]*Destination, resolutions []Resolution) {
+	sa.lock.RLock()
+	defer sa.lock.RUnlock()
+	return sa.destinations, sa.denies, sa.resolutions()
+}
+
+// resolutions implements Resolutions, sa.lock is held
+func (sa *Authenticator) resolutions() []Resolution {
+	resolutions := make([]Resolution, 0, len(sa.resolvedNames))
+	for name, ips := range sa.resolvedNames {
+		resolutions = append(resolutions, Resolution{Name: name, IPs: ips, ResolvedAt: sa.resolvedAt[name]})
+	}
+	sort.Slice(resolutions, func(i, j int) bool {
+		return resolutions[i].Name < resolutions[j].Name
+	})
+	return resolutions
+}
+
+func sortedNames(destinations map[string]*Destination) []string {
+	names := make([]string, 0, len(destinations))
+	for name := range destinations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Allow permits a request if any destination resolving to the requested IP
+// allows the requested port, command and user. All destinations sharing
+// that IP are considered, so the outcome does not depend on the order of
+// evaluation: a request is denied only if every matching destination
+// denies it. Deny destinations are checked first and win over any allowing
+// destination.
+func (sa *Authenticator) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	return sa.allow(ctx, req, false)
+}
+
+// Evaluate decides req like Allow for -test-policy, but the decision is
+// neither logged, written to log sinks nor cached
+func (sa *Authenticator) Evaluate(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	return sa.allow(ctx, req, true)
+}
+
+// allow implements Allow, a dry run leaves no trace of the decision
+func (sa *Authenticator) allow(ctx context.Context, req *socks5.Request, dryRun bool) (newCtx context.Context, allowed bool) {
+	allowed = false
+	log := sa.log
+	logRecord := recordFunc((*Destination).logRecord)
+	if dryRun {
+		log = zap.NewNop()
+		logRecord = func(*Destination, string, string, ...zap.Field) {}
+	}
+	zapTo := zap.String("to", req.DestAddr.String())
+	zapUser := zap.String("for", req.AuthContext.Payload["Username"])
+	zapFrom := zap.String("from", SourceIP(req))
+	userNameInContext, userNameInContextOK := req.AuthContext.Payload["Username"]
+	newCtx = contextWithUser(ctx, userNameInContext)
+
+	sa.lock.RLock()
+	defer sa.lock.RUnlock()
+
+	decisionKey := ""
+	if !dryRun {
+		decisionKey = sa.decisionKey(req)
+	}
+	if cached, ok := sa.cachedDecision(decisionKey); ok {
+		newCtx = cached.apply(newCtx, log, sa.QuietAllowed, zapTo, zapUser, zapFrom)
+		allowed = cached.allowed
+		return
+	}
+	// decisions involving schedules change with the time and are not kept
+	keep := true
+
+	for _, name := range sa.denyIndex.lookup(req.DestAddr, sa.networks) {
+		deny := sa.denies[name]
+		if deny == nil {
+			continue
+		}
+		if len(deny.Ports) > 0 && !deny.allowsPort(req.DestAddr.Port) {
+			continue
+		}
+		if !deny.allowsCommand(req.Command) {
+			continue
+		}
+		if deny.restrictsUsers() && !deny.allowsUser(userNameInContext) {
+			continue
+		}
+		zapReason := DenyReasonDenyRule.Field()
+		zapLabels := deny.LabelsField()
+		log.Info("denied - deny rule matched", zap.String("deny", name), zapTo, zapUser, zapFrom, zapReason, zapLabels)
+		logRecord(deny, "denied - deny rule matched", name, zapTo, zapUser, zapFrom, zapReason)
+		newCtx = contextWithDenyRule(DenyReasonDenyRule.Context(newCtx), name)
+		sa.keepDecision(decisionKey, &decision{name: name, destination: deny, reason: DenyReasonDenyRule})
+		return
+	}
+
+	// allow all skips the destinations, deny rules still apply
+	if sa.AllowAll {
+		if !sa.QuietAllowed {
+			log.Info("allowed - allow all", zapTo, zapUser, zapFrom)
+		}
+		allowed = true
+		return
+	}
+
+	now := time.Now()
+	// reason is the most specific reason the matching destinations deny,
+	// denying the destination giving it
+	reason := DenyReasonUnknownDestination
+	var denying *Destination
+	deniedBy := func(destinationReason DenyReason, destination *Destination) {
+		if destinationReason > reason {
+			reason, denying = destinationReason, destination
+		}
+	}
+	// denials are written to the sinks of the destinations only once no
+	// other destination allowed
+	var denials []denialRecord
+	recordDenial := func(d *Destination, msg string, name string, fields ...zap.Field) {
+		denials = append(denials, denialRecord{destination: d, msg: msg, name: name, fields: fields})
+	}
+	for _, name := range sa.allowIndex.lookup(req.DestAddr, sa.networks) {
+		destination := sa.destinations[name]
+		if destination == nil {
+			continue
+		}
+		keep = keep && len(destination.windows) == 0
+		zapName := zap.String("name", name)
+		zapLabels := destination.LabelsField()
+		if !destination.allowsPort(req.DestAddr.Port) {
+			deniedBy(DenyReasonPortNotAllowed, destination)
+			log.Debug("port not allowed", zapName, zapTo, zapUser, zapFrom, zapLabels)
+			recordDenial(destination, "denied - port not allowed", name, DenyReasonPortNotAllowed.Field())
+			continue
+		}
+		if !destination.allowsCommand(req.Command) {
+			deniedBy(DenyReasonCommandNotAllowed, destination)
+			zapCommand := zap.String("command", commandName(req.Command))
+			log.Debug("command not allowed", zapName, zapTo, zapUser, zapFrom, zapCommand, zapLabels)
+			recordDenial(destination, "denied - command not allowed", name, zapCommand, DenyReasonCommandNotAllowed.Field())
+			continue
+		}
+		if destination.restrictsUsers() {
+			if !userNameInContextOK {
+				// explicit user expected, but not found
+				deniedBy(DenyReasonNoUser, destination)
+				log.Debug("no user found", zapName, zapTo, zapFrom, zapLabels)
+				continue
+			}
+			if !destination.allowsUser(userNameInContext) {
+				deniedBy(DenyReasonUserNotAllowed, destination)
+				log.Debug("user not allowed", zapName, zapTo, zapUser, zapFrom, zapLabels)
+				recordDenial(destination, "denied - user not allowed", name, DenyReasonUserNotAllowed.Field())
+				continue
+			}
+		}
+		if !destination.openAt(now) {
+			deniedBy(DenyReasonOutsideSchedule, destination)
+			log.Debug("outside schedule", zapName, zapTo, zapUser, zapFrom, zapLabels)
+			recordDenial(destination, "denied - outside of the destination schedule", name, DenyReasonOutsideSchedule.Field())
+			continue
+		}
+		if !destination.allowsCountry(sa.geo, req.DestAddr.IP) {
+			deniedBy(DenyReasonCountryNotAllowed, destination)
+			zapCountry := zap.String("country", sa.geo.country(req.DestAddr.IP))
+			log.Debug("country not allowed", zapName, zapTo, zapUser, zapFrom, zapCountry, zapLabels)
+			recordDenial(destination, "denied - country not allowed", name, zapCountry, DenyReasonCountryNotAllowed.Field())
+			continue
+		}
+		if !sa.QuietAllowed {
+			log.Info("allowed", zapName, zapTo, zapUser, zapFrom, zapLabels)
+		}
+		logRecord(destination, "allowed", name, zapTo, zapUser, zapFrom)
+		newCtx = contextWithDestination(newCtx, name, destination)
+		allowed = true
+		if keep {
+			sa.keepDecision(decisionKey, &decision{allowed: true, name: name, destination: destination})
+		}
+		return
+	}
+	denied := &decision{destination: denying, reason: reason, msg: "denied", denials: denials}
+	switch reason {
+	case DenyReasonOutsideSchedule:
+		denied.msg, denied.fields = "denied - outside of the destination schedule", []zap.Field{zap.Time("now", now)}
+	case DenyReasonNoUser:
+		denied.msg = "denied - no user found"
+	case DenyReasonCountryNotAllowed:
+		denied.msg, denied.fields = "denied - country not allowed", []zap.Field{zap.String("country", sa.geo.country(req.DestAddr.IP))}
+	}
+	if keep {
+		sa.keepDecision(decisionKey, denied)
+	}
+	denied.logDenied(log, logRecord, zapTo, zapUser, zapFrom)
+	newCtx = reason.Context(newCtx)
+	return
+}
+
+// SourceIP is the IP of the client a request came from, if known
+func SourceIP(req *socks5.Request) string {
+	if req.RemoteAddr == nil {
+		return ""
+	}
+	return req.RemoteAddr.IP.String()
+}
+
+// matches tells if the destination name refers to addr, either by one of
+// its resolved IPs or, for wildcards like *.example.com, by a requested name
+// ending in .example.com. A wildcard does not match example.com itself.
+// Networks match the IPs they contain. Allow finds the matching names by
+// the name indexes instead of asking every name.
+func (sa *Authenticator) matches(name string, addr *socks5.AddrSpec) bool {
+	if isWildcard(name) {
+		return wildcardMatches(name, addr.FQDN)
+	}
+	if network, ok := sa.networks[name]; ok {
+		return network.Contains(addr.IP)
+	}
+	return containsIP(sa.resolvedNames[name], addr.IP)
+}
+
+func isWildcard(name string) bool {
+	return strings.HasPrefix(name, "*.")
+}
+
+// wildcardMatches tells if the requested fqdn ends in the domain of the
+// wildcard name
+func wildcardMatches(name, fqdn string) bool {
+	fqdn = strings.ToLower(strings.TrimSuffix(fqdn, "."))
+	return fqdn != "" && strings.HasSuffix(fqdn, strings.ToLower(name[1:]))
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// containsIP compares parsed IPs, as an IPv6 address has several textual
+// forms and an IPv4 one may be given as IPv4-mapped IPv6
+func containsIP(ips []string, ip net.IP) bool {
+	for _, candidate := range ips {
+		if ip.Equal(net.ParseIP(candidate)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,1116 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"socks5"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newTestAuthenticator(destinations map[string]*Destination, resolvedNames map[string][]string) *Authenticator {
+	sa := &Authenticator{
+		log:           zap.NewNop(),
+		destinations:  destinations,
+		resolvedNames: resolvedNames,
+	}
+	for name := range destinations {
+		sa.names = append(sa.names, name)
+	}
+	sa.index()
+	return sa
+}
+
+func newTestRequest(user string, ip string, port int) *socks5.Request {
+	payload := map[string]string{}
+	if user != "" {
+		payload["Username"] = user
+	}
+	return &socks5.Request{
+		Command:     socks5.ConnectCommand,
+		AuthContext: &socks5.AuthContext{Method: socks5.UserPassAuth, Payload: payload},
+		DestAddr:    &socks5.AddrSpec{IP: net.ParseIP(ip), Port: port},
+	}
+}
+
+func TestAuthenticatorAllowOverlappingIPs(t *testing.T) {
+	sa := newTestAuthenticator(
+		map[string]*Destination{
+			"a.example.com": {Users: []string{"jan"}, Ports: []int{443}},
+			"b.example.com": {Users: []string{"peter"}, Ports: []int{80, 443}},
+			"c.example.com": {Ports: []int{8080}},
+		},
+		map[string][]string{
+			"a.example.com": {"10.0.0.1"},
+			"b.example.com": {"10.0.0.1"},
+			"c.example.com": {"10.0.0.1", "10.0.0.2"},
+		},
+	)
+
+	tests := []struct {
+		user    string
+		ip      string
+		port    int
+		allowed bool
+	}{
+		{"jan", "10.0.0.1", 443, true},
+		{"peter", "10.0.0.1", 443, true},
+		{"peter", "10.0.0.1", 80, true},
+		{"jan", "10.0.0.1", 80, false},
+		{"test", "10.0.0.1", 443, false},
+		{"test", "10.0.0.1", 8080, true},
+		{"", "10.0.0.1", 8080, true},
+		{"", "10.0.0.1", 443, false},
+		{"jan", "10.0.0.2", 443, false},
+	}
+	for _, test := range tests {
+		// the result must not depend on the order destinations are checked in
+		for i := 0; i < 10; i++ {
+			rand.Shuffle(len(sa.names), func(i, j int) { sa.names[i], sa.names[j] = sa.names[j], sa.names[i] })
+			_, allowed := sa.Allow(context.Background(), newTestRequest(test.user, test.ip, test.port))
+			if allowed != test.allowed {
+				t.Fatalf("%s to %s:%d: expected allowed=%v", test.user, test.ip, test.port, test.allowed)
+			}
+		}
+	}
+}
+
+func TestAuthenticatorAllowResolver(t *testing.T) {
+	resolver := LookupFunc(func(name string) ([]string, time.Duration, error) {
+		addrs, ok := map[string][]string{
+			"open.example.com":  {"10.0.0.1"},
+			"users.example.com": {"10.0.0.2"},
+		}[name]
+		if !ok {
+			return nil, 0, errors.New("no such host")
+		}
+		return addrs, 0, nil
+	})
+	sa, err := NewAuthenticator(zap.NewNop(), map[string]*Destination{
+		"open.example.com":  {Ports: []int{443}},
+		"users.example.com": {Ports: []int{443}, Users: []string{"jan"}},
+		"gone.example.com":  {Ports: []int{443}},
+	}, nil, resolver, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		user    string
+		ip      string
+		port    int
+		allowed bool
+		reason  DenyReason
+	}{
+		{"no users allow anyone", "peter", "10.0.0.1", 443, true, 0},
+		{"no users allow clients without a user", "", "10.0.0.1", 443, true, 0},
+		{"user matches", "jan", "10.0.0.2", 443, true, 0},
+		{"user does not match", "peter", "10.0.0.2", 443, false, DenyReasonUserNotAllowed},
+		{"port mismatch", "jan", "10.0.0.2", 80, false, DenyReasonPortNotAllowed},
+		{"unknown destination", "jan", "10.0.0.3", 443, false, DenyReasonUnknownDestination},
+		{"missing user name", "", "10.0.0.2", 443, false, DenyReasonNoUser},
+	}
+	for _, test := range tests {
+		ctx, allowed := sa.Allow(context.Background(), newTestRequest(test.user, test.ip, test.port))
+		if allowed != test.allowed {
+			t.Errorf("%s: expected allowed=%v", test.name, test.allowed)
+			continue
+		}
+		if reason, _ := DenyReasonFromContext(ctx); !allowed && reason != test.reason {
+			t.Errorf("%s: expected %s, got %s", test.name, test.reason, reason)
+		}
+	}
+}
+
+func TestAuthenticatorDecisionCache(t *testing.T) {
+	sa := newTestAuthenticator(
+		map[string]*Destination{
+			"a.example.com": {Users: []string{"jan"}, Ports: []int{443}},
+			"b.example.com": {Ports: []int{443}, Schedule: []string{"00:00-23:59"}},
+		},
+		map[string][]string{
+			"a.example.com": {"10.0.0.1"},
+			"b.example.com": {"10.0.0.2"},
+		},
+	)
+	sa.toResolve = []string{"a.example.com", "b.example.com"}
+	for _, destination := range sa.destinations {
+		if err := destination.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sa.CacheDecisions(time.Minute)
+
+	for i := 0; i < 2; i++ {
+		ctx, allowed := sa.Allow(context.Background(), newTestRequest("jan", "10.0.0.1", 443))
+		if name, _ := DestinationFromContext(ctx); !allowed || name != "a.example.com" {
+			t.Fatalf("jan should be allowed by a.example.com, got %v %q", allowed, name)
+		}
+		ctx, allowed = sa.Allow(context.Background(), newTestRequest("peter", "10.0.0.1", 443))
+		if reason, _ := DenyReasonFromContext(ctx); allowed || reason != DenyReasonUserNotAllowed {
+			t.Fatalf("peter should be denied as not allowed, got %v %s", allowed, reason)
+		}
+	}
+	if count := sa.decisions.ItemCount(); count != 2 {
+		t.Fatal("expected both decisions cached, got", count)
+	}
+	// a cached deny replays the records of the destinations that denied
+	denied, ok := sa.cachedDecision(sa.decisionKey(newTestRequest("peter", "10.0.0.1", 443)))
+	if !ok {
+		t.Fatal("expected the deny of peter cached")
+	}
+	records := []string{}
+	denied.logDenied(zap.NewNop(), func(d *Destination, msg string, name string, fields ...zap.Field) {
+		records = append(records, name+": "+msg)
+	}, zap.Skip(), zap.Skip(), zap.Skip())
+	if len(records) != 1 || records[0] != "a.example.com: denied - user not allowed" {
+		t.Fatal("expected the record of a.example.com replayed, got", records)
+	}
+	if _, allowed := sa.Allow(context.Background(), newTestRequest("jan", "10.0.0.2", 443)); !allowed {
+		t.Fatal("jan should be allowed by b.example.com")
+	}
+	if count := sa.decisions.ItemCount(); count != 2 {
+		t.Fatal("a decision involving a schedule should not be cached, got", count)
+	}
+
+	sa.setResolvedNames(map[string][]string{"a.example.com": {"10.0.0.3"}})
+	if count := sa.decisions.ItemCount(); count != 0 {
+		t.Fatal("changed addresses should drop the cached decisions, got", count)
+	}
+	if _, allowed := sa.Allow(context.Background(), newTestRequest("jan", "10.0.0.1", 443)); allowed {
+		t.Fatal("jan should be denied once a.example.com moved")
+	}
+}
+
+func TestAuthenticatorEvaluate(t *testing.T) {
+	sa := newTestAuthenticator(
+		map[string]*Destination{"a.example.com": {Users: []string{"jan"}, Ports: []int{443}}},
+		map[string][]string{"a.example.com": {"10.0.0.1"}},
+	)
+	sa.CacheDecisions(time.Minute)
+
+	ctx, allowed := sa.Evaluate(context.Background(), newTestRequest("jan", "10.0.0.1", 443))
+	if name, _ := DestinationFromContext(ctx); !allowed || name != "a.example.com" {
+		t.Fatalf("jan should be allowed by a.example.com, got %v %q", allowed, name)
+	}
+	ctx, allowed = sa.Evaluate(context.Background(), newTestRequest("peter", "10.0.0.1", 443))
+	if reason, _ := DenyReasonFromContext(ctx); allowed || reason != DenyReasonUserNotAllowed {
+		t.Fatalf("peter should be denied as not allowed, got %v %s", allowed, reason)
+	}
+	if count := sa.decisions.ItemCount(); count != 0 {
+		t.Fatal("a dry run should not cache decisions, got", count)
+	}
+}
+
+func TestAuthenticatorAllowDeny(t *testing.T) {
+	sa := newTestAuthenticator(
+		map[string]*Destination{
+			"net.example.com": {Ports: []int{80, 443}},
+		},
+		map[string][]string{
+			"net.example.com":     {"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			"blocked.example.com": {"10.0.0.2"},
+			"port.example.com":    {"10.0.0.3"},
+		},
+	)
+	sa.denies = map[string]*Destination{
+		"blocked.example.com": {},
+		"port.example.com":    {Ports: []int{80}, Users: []string{"jan"}},
+	}
+	sa.denyNames = sortedNames(sa.denies)
+	sa.index()
+
+	tests := []struct {
+		user    string
+		ip      string
+		port    int
+		allowed bool
+	}{
+		{"jan", "10.0.0.1", 443, true},
+		{"jan", "10.0.0.2", 443, false},
+		{"jan", "10.0.0.2", 80, false},
+		{"jan", "10.0.0.3", 80, false},
+		{"jan", "10.0.0.3", 443, true},
+		{"peter", "10.0.0.3", 80, true},
+	}
+	for _, test := range tests {
+		_, allowed := sa.Allow(context.Background(), newTestRequest(test.user, test.ip, test.port))
+		if allowed != test.allowed {
+			t.Fatalf("%s to %s:%d: expected allowed=%v", test.user, test.ip, test.port, test.allowed)
+		}
+	}
+}
+
+func TestAuthenticatorAllowCommands(t *testing.T) {
+	sa := newTestAuthenticator(
+		map[string]*Destination{
+			"dns.example.com": {Ports: []int{53}, Commands: []string{"udp"}},
+			"any.example.com": {Ports: []int{53}},
+		},
+		map[string][]string{
+			"dns.example.com": {"10.0.0.1"},
+			"any.example.com": {"10.0.0.2"},
+		},
+	)
+	sa.denies = map[string]*Destination{
+		"any.example.com": {Commands: []string{"bind"}},
+	}
+	sa.denyNames = sortedNames(sa.denies)
+	sa.index()
+
+	tests := []struct {
+		ip      string
+		command uint8
+		allowed bool
+		reason  DenyReason
+	}{
+		{"10.0.0.1", socks5.AssociateCommand, true, 0},
+		{"10.0.0.1", socks5.ConnectCommand, false, DenyReasonCommandNotAllowed},
+		{"10.0.0.1", socks5.BindCommand, false, DenyReasonCommandNotAllowed},
+		{"10.0.0.2", socks5.ConnectCommand, true, 0},
+		{"10.0.0.2", socks5.AssociateCommand, true, 0},
+		{"10.0.0.2", socks5.BindCommand, false, DenyReasonDenyRule},
+	}
+	for _, test := range tests {
+		req := newTestRequest("jan", test.ip, 53)
+		req.Command = test.command
+		ctx, allowed := sa.Allow(context.Background(), req)
+		if allowed != test.allowed {
+			t.Fatalf("command %d to %s: expected allowed=%v", test.command, test.ip, test.allowed)
+		}
+		if reason, _ := DenyReasonFromContext(ctx); !allowed && reason != test.reason {
+			t.Fatalf("command %d to %s: expected %s, got %s", test.command, test.ip, test.reason, reason)
+		}
+	}
+}
+
+func TestAuthenticatorAllowWildcard(t *testing.T) {
+	sa := newTestAuthenticator(
+		map[string]*Destination{
+			"*.internal.example.com": {Ports: []int{443}},
+		},
+		map[string][]string{},
+	)
+
+	tests := []struct {
+		fqdn    string
+		port    int
+		allowed bool
+	}{
+		{"api.internal.example.com", 443, true},
+		{"a.b.Internal.Example.com.", 443, true},
+		{"api.internal.example.com", 80, false},
+		{"internal.example.com", 443, false},
+		{"apiinternal.example.com", 443, false},
+		{"", 443, false},
+	}
+	for _, test := range tests {
+		req := newTestRequest("jan", "10.0.0.1", test.port)
+		req.DestAddr.FQDN = test.fqdn
+		_, allowed := sa.Allow(context.Background(), req)
+		if allowed != test.allowed {
+			t.Fatalf("%s:%d: expected allowed=%v", test.fqdn, test.port, test.allowed)
+		}
+	}
+}
+
+func TestDestinationOpenAt(t *testing.T) {
+	destination := &Destination{
+		Schedule: []string{"Mon-Fri 09:00-18:00", "Sat 22:00-02:00"},
+		Timezone: "UTC",
+	}
+	if err := destination.init(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	tests := []struct {
+		now  string
+		open bool
+	}{
+		{"2022-07-18T09:00:00Z", true},  // Monday
+		{"2022-07-22T17:59:59Z", true},  // Friday
+		{"2022-07-22T18:00:00Z", false}, // Friday
+		{"2022-07-19T08:59:00Z", false}, // Tuesday
+		{"2022-07-23T12:00:00Z", false}, // Saturday
+		{"2022-07-23T23:00:00Z", true},  // Saturday
+		{"2022-07-24T01:00:00Z", true},  // Sunday, still Saturday's window
+		{"2022-07-24T23:00:00Z", false}, // Sunday
+		{"2022-07-18T11:00:00+02:00", true},
+	}
+	for _, test := range tests {
+		now, err := time.Parse(time.RFC3339, test.now)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if open := destination.openAt(now); open != test.open {
+			t.Fatalf("%s: expected open=%v", test.now, test.open)
+		}
+	}
+
+	if err := (&Destination{Schedule: []string{"Mon-Fry 09:00-18:00"}}).init(); err == nil {
+		t.Fatalf("expected an error for an invalid schedule")
+	}
+}
+
+func TestValidateDestinations(t *testing.T) {
+	passwordHashes := map[string]string{"jan": "{SHA}"}
+	valid := map[string]*Destination{
+		"www.example.com": {Ports: []int{443}, Users: []string{"jan"}},
+		"*.example.org":   {AllPorts: true},
+		"10.0.0.0/8":      {Ports: []int{22}},
+	}
+	denies := map[string]*Destination{"10.1.0.0/16": {}}
+	if err := ValidateDestinations(valid, denies, nil, passwordHashes); err != nil {
+		t.Fatal("expected valid destinations, got", err)
+	}
+
+	invalid := map[string]*Destination{
+		"noports.example.com": {},
+		"port.example.com":    {Ports: []int{0}},
+		"user.example.com":    {Ports: []int{443}, Users: []string{"peter"}},
+		"10.0.0.0/33":         {Ports: []int{22}},
+		"empty.example.com":   nil,
+	}
+	err := ValidateDestinations(invalid, nil, nil, passwordHashes)
+	if err == nil {
+		t.Fatal("expected invalid destinations")
+	}
+	for name := range invalid {
+		if !strings.Contains(err.Error(), "destination "+name+":") {
+			t.Fatal("expected a problem reported for", name, "got", err)
+		}
+	}
+
+	err = ValidateDestinations(valid, map[string]*Destination{"10.2.0.0/16": nil}, nil, passwordHashes)
+	if err == nil || !strings.Contains(err.Error(), "deny 10.2.0.0/16: empty destination") || strings.Contains(err.Error(), "allports") {
+		t.Fatal("expected an empty deny reported as an empty destination, got", err)
+	}
+
+	// deny entries apply at all times
+	err = ValidateDestinations(valid, map[string]*Destination{"10.2.0.0/16": {Schedule: []string{"Mon-Fri 09:00-18:00"}}}, nil, passwordHashes)
+	if err == nil || !strings.Contains(err.Error(), "deny 10.2.0.0/16: schedule on a deny entry") {
+		t.Fatal("expected a schedule on a deny reported, got", err)
+	}
+}
+
+func TestAuthenticatorAllowIPv6(t *testing.T) {
+	sa := newTestAuthenticator(
+		map[string]*Destination{
+			"v6.example.com": {Ports: []int{443}},
+		},
+		map[string][]string{
+			"v6.example.com": {"2001:db8::1", "::ffff:10.0.0.1"},
+		},
+	)
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"2001:db8::1", true},
+		{"2001:0db8:0000:0000:0000:0000:0000:0001", true},
+		{"2001:db8::2", false},
+		{"10.0.0.1", true},
+	}
+	for _, test := range tests {
+		_, allowed := sa.Allow(context.Background(), newTestRequest("jan", test.ip, 443))
+		if allowed != test.allowed {
+			t.Fatalf("to [%s]:443: expected allowed=%v", test.ip, test.allowed)
+		}
+	}
+}
+
+func TestSetResolvedNamesKeepsLastKnown(t *testing.T) {
+	sa := newTestAuthenticator(nil, map[string][]string{"flaky.example.com": {"10.0.0.1"}})
+	sa.toResolve = []string{"127.0.0.1", "flaky.example.com", "never.example.com"}
+
+	resolved, _, err := resolveNames(SystemResolver{}, 2, []string{"127.0.0.1", "not a name"})
+	if _, ok := err.(resolveErrors)["not a name"]; !ok {
+		t.Fatal("expected the failing name reported, got", err)
+	}
+	if len(resolved) != 1 || resolved["127.0.0.1"][0] != "127.0.0.1" {
+		t.Fatal("expected the other names resolved, got", resolved)
+	}
+
+	sa.setResolvedNames(resolved)
+	if ips := sa.resolvedNames["flaky.example.com"]; len(ips) != 1 || ips[0] != "10.0.0.1" {
+		t.Fatal("a name failing to resolve should keep its last known addresses, got", ips)
+	}
+	if _, ok := sa.resolvedNames["never.example.com"]; ok {
+		t.Fatal("a name never resolved should have no addresses")
+	}
+	if _, ok := sa.resolvedNames["127.0.0.1"]; !ok {
+		t.Fatal("resolved names should be applied")
+	}
+}
+
+func TestScheduleResolveBackoff(t *testing.T) {
+	sa := newTestAuthenticator(nil, nil)
+	sa.nextResolve = map[string]time.Time{}
+	sa.resolveFailures = map[string]int{}
+	names := []string{"gone.example.com"}
+	failed := resolveErrors{"gone.example.com": errors.New("no such host")}
+
+	for _, expected := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second} {
+		start := time.Now()
+		sa.scheduleResolve(names, nil, failed)
+		if after := sa.nextResolve["gone.example.com"].Sub(start); after < expected || after > expected+time.Second {
+			t.Fatalf("expected a retry after %s, got %s", expected, after)
+		}
+	}
+	if backoff := resolveBackoff(100); backoff != maxResolveBackoff {
+		t.Fatal("expected the backoff capped, got", backoff)
+	}
+
+	start := time.Now()
+	sa.scheduleResolve(names, map[string]time.Duration{"gone.example.com": time.Minute}, nil)
+	if _, ok := sa.resolveFailures["gone.example.com"]; ok {
+		t.Fatal("a successful resolution should clear the failures")
+	}
+	if after := sa.nextResolve["gone.example.com"].Sub(start); after < time.Minute || after > time.Minute+time.Second {
+		t.Fatal("expected a resolve by the ttl, got", after)
+	}
+}
+
+func TestAuthenticatorIPLiterals(t *testing.T) {
+	resolver := LookupFunc(func(name string) ([]string, time.Duration, error) {
+		if net.ParseIP(name) != nil {
+			t.Errorf("the ip %s should not be looked up", name)
+		}
+		return []string{"10.0.0.2"}, 0, nil
+	})
+	sa, err := NewAuthenticator(zap.NewNop(), map[string]*Destination{
+		"192.0.2.10":        {Ports: []int{443}},
+		"2001:0db8:0000::1": {Ports: []int{443}},
+		"name.example.com":  {Ports: []int{443}},
+	}, nil, resolver, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameStrings(sa.toResolve, []string{"name.example.com"}) {
+		t.Fatal("expected only the name to be resolved, got", sa.toResolve)
+	}
+	for _, ip := range []string{"192.0.2.10", "2001:db8::1", "10.0.0.2"} {
+		if _, allowed := sa.Allow(context.Background(), newTestRequest("jan", ip, 443)); !allowed {
+			t.Fatalf("expected %s allowed", ip)
+		}
+	}
+	sa.setResolvedNames(nil)
+	if ips := sa.resolvedNames["2001:0db8:0000::1"]; !sameStrings(ips, []string{"2001:db8::1"}) {
+		t.Fatal("expected the ip to resolve to itself, got", ips)
+	}
+}
+
+func TestWaitResolved(t *testing.T) {
+	var lookups int32
+	resolver := LookupFunc(func(name string) ([]string, time.Duration, error) {
+		// the network comes up after the first lookup of late.example.com
+		if name == "late.example.com" && atomic.AddInt32(&lookups, 1) == 1 {
+			return nil, 0, errors.New("network is unreachable")
+		}
+		if name == "gone.example.com" {
+			return nil, 0, errors.New("no such host")
+		}
+		return []string{"10.0.0.1"}, 0, nil
+	})
+	sa, err := NewAuthenticator(zap.NewNop(), map[string]*Destination{
+		"late.example.com": {Ports: []int{443}},
+	}, nil, resolver, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sa.WaitResolved(5 * time.Second); err != nil {
+		t.Fatal("expected the name resolved on retry, got", err)
+	}
+	if _, allowed := sa.Allow(context.Background(), newTestRequest("jan", "10.0.0.1", 443)); !allowed {
+		t.Fatal("expected late.example.com allowed once resolved")
+	}
+
+	sa, err = NewAuthenticator(zap.NewNop(), map[string]*Destination{
+		"open.example.com": {Ports: []int{443}},
+		"gone.example.com": {Ports: []int{443}},
+	}, nil, resolver, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = sa.WaitResolved(600 * time.Millisecond)
+	if _, ok := err.(resolveErrors)["gone.example.com"]; !ok {
+		t.Fatal("expected gone.example.com reported after the timeout, got", err)
+	}
+	if waited := time.Since(start); waited < 600*time.Millisecond || waited > 2*time.Second {
+		t.Fatal("expected to retry until the timeout, waited", waited)
+	}
+	if _, allowed := sa.Allow(context.Background(), newTestRequest("jan", "10.0.0.1", 443)); !allowed {
+		t.Fatal("expected the names that resolved to be allowed")
+	}
+}
+
+func TestDNSLookupTTL(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.Header.ID, Response: true},
+				Questions: query.Questions,
+			}
+			if query.Questions[0].Type == dnsmessage.TypeA {
+				target := dnsmessage.MustNewName("target.example.com.")
+				response.Answers = []dnsmessage.Resource{
+					{
+						Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 60},
+						Body:   &dnsmessage.CNAMEResource{CNAME: target},
+					},
+					{
+						Header: dnsmessage.ResourceHeader{Name: target, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+						Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+					},
+				}
+			}
+			packed, _ := response.Pack()
+			_, _ = conn.WriteTo(packed, addr)
+		}
+	}()
+
+	l := &DNSLookup{servers: []string{conn.LocalAddr().String()}, timeout: time.Second}
+	addrs, ttl, err := l.query("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+		t.Fatal("expected the address behind the cname, got", addrs)
+	}
+	if ttl != 60*time.Second {
+		t.Fatal("expected the lowest ttl of the answers, got", ttl)
+	}
+}
+
+func TestDoHLookup(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var query dnsmessage.Message
+		if r.Header.Get("Content-Type") != "application/dns-message" || query.Unpack(body) != nil {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		response := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.Header.ID, Response: true},
+			Questions: query.Questions,
+		}
+		if query.Questions[0].Type == dnsmessage.TypeAAAA {
+			response.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: 120},
+				Body:   &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}},
+			}}
+		}
+		packed, _ := response.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(packed)
+	}))
+	defer server.Close()
+
+	l, err := NewDoHLookup(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.client = server.Client()
+	addrs, ttl, err := l.LookupHost("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "2001:db8::1" || ttl != 120*time.Second {
+		t.Fatal("unexpected resolution", addrs, ttl)
+	}
+
+	if _, err := NewDoHLookup("http://dns.example.com/dns-query"); err == nil {
+		t.Fatal("doh should require https")
+	}
+}
+
+func TestAuthenticatorAllowAll(t *testing.T) {
+	sa := newTestAuthenticator(map[string]*Destination{}, map[string][]string{})
+	if _, allowed := sa.Allow(context.Background(), newTestRequest("jan", "10.0.0.1", 22)); allowed {
+		t.Fatal("request should be denied without destinations")
+	}
+	sa.AllowAll = true
+	if _, allowed := sa.Allow(context.Background(), newTestRequest("jan", "10.0.0.1", 22)); !allowed {
+		t.Fatal("request should be allowed with allow all")
+	}
+	sa.denies = map[string]*Destination{"10.0.0.0/24": {}}
+	sa.denyNames = sortedNames(sa.denies)
+	sa.networks = map[string]*net.IPNet{}
+	_, sa.networks["10.0.0.0/24"], _ = net.ParseCIDR("10.0.0.0/24")
+	sa.index()
+	if _, allowed := sa.Allow(context.Background(), newTestRequest("jan", "10.0.0.1", 22)); allowed {
+		t.Fatal("deny rules should apply with allow all")
+	}
+}
+
+func TestDestinationGroups(t *testing.T) {
+	groups := map[string][]string{"team": {"jan"}}
+	destinations := map[string]*Destination{
+		"example.com": {Ports: []int{443}, Groups: []string{"team"}},
+	}
+	for _, destination := range destinations {
+		destination.expandGroups(groups)
+	}
+	passwordHashes := map[string]string{"jan": "x", "peter": "x"}
+	if err := ValidateDestinations(destinations, nil, groups, passwordHashes); err != nil {
+		t.Fatal(err)
+	}
+	sa := newTestAuthenticator(destinations, map[string][]string{"example.com": {"10.0.0.1"}})
+	if _, allowed := sa.Allow(context.Background(), newTestRequest("jan", "10.0.0.1", 443)); !allowed {
+		t.Error("group member jan should be allowed")
+	}
+	if _, allowed := sa.Allow(context.Background(), newTestRequest("peter", "10.0.0.1", 443)); allowed {
+		t.Error("peter is not in the group and should be denied")
+	}
+
+	destinations["example.com"].Groups = []string{"unknown"}
+	if err := ValidateDestinations(destinations, nil, groups, passwordHashes); err == nil || !strings.Contains(err.Error(), "unknown group unknown") {
+		t.Errorf("expected unknown group to fail validation, got %v", err)
+	}
+	groups["team"] = append(groups["team"], "paul")
+	if err := ValidateDestinations(nil, nil, groups, passwordHashes); err == nil || !strings.Contains(err.Error(), "group team: unknown user paul") {
+		t.Errorf("expected unknown group member to fail validation, got %v", err)
+	}
+}
+
+func TestAuthenticatorAllowUserPattern(t *testing.T) {
+	destinations := map[string]*Destination{
+		"billing.example.com": {Ports: []int{443}, Users: []string{"svc-billing-*", "jan"}},
+	}
+	sa := newTestAuthenticator(destinations, map[string][]string{"billing.example.com": {"10.0.0.1"}})
+	for user, want := range map[string]bool{
+		"svc-billing-01": true,
+		"svc-billing-02": true,
+		"jan":            true,
+		"svc-payroll-01": false,
+		"svc-billing":    false,
+	} {
+		if _, allowed := sa.Allow(context.Background(), newTestRequest(user, "10.0.0.1", 443)); allowed != want {
+			t.Errorf("user %s allowed %v, want %v", user, allowed, want)
+		}
+	}
+
+	passwordHashes := map[string]string{"jan": "x"}
+	if err := ValidateDestinations(destinations, nil, nil, passwordHashes); err != nil {
+		t.Errorf("patterns should not need to be in the basic auth file: %v", err)
+	}
+	destinations["billing.example.com"].Users = []string{"svc-[billing"}
+	if err := ValidateDestinations(destinations, nil, nil, passwordHashes); err == nil {
+		t.Error("expected invalid pattern to fail validation")
+	}
+}
+
+// mmdbString encodes a short string of a maxmind db
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+// writeTestGeoIP writes an ipv4 maxmind db locating 10.0.0.0/8 in DE
+func writeTestGeoIP(t *testing.T) string {
+	return writeTestMMDB(t, 24, 4, map[string]string{"10.0.0.0/8": "DE"})
+}
+
+// mmdbExtended encodes the control bytes of an extended type of a maxmind db
+func mmdbExtended(kind, size byte) []byte {
+	return []byte{size, kind - 7}
+}
+
+// mmdbNode is a node of the search tree of a test maxmind db, records are
+// child nodes, or data offsets if data is set
+type mmdbNode struct {
+	records [2]int
+	data    [2]bool
+}
+
+// writeTestMMDB writes a maxmind db with the record size and ip version
+// locating networks in countries. IPv4 networks in ipv6 databases go below
+// ::/96. The records share keys by pointers and carry extended types the
+// lookups skip.
+func writeTestMMDB(t *testing.T, recordSize uint, ipVersion int, networks map[string]string) string {
+	const empty = -1
+	nodes := []mmdbNode{{records: [2]int{empty, empty}}}
+	data := []byte{}
+	var isoCodeKey int
+	for network, country := range networks {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip, ip4 := ipNet.IP.To16(), ipNet.IP.To4()
+		ones, _ := ipNet.Mask.Size()
+		switch {
+		case ip4 == nil && ipVersion == 4:
+			continue
+		case ip4 != nil && ipVersion == 4:
+			ip = ip4
+		case ip4 != nil:
+			ip = append(make(net.IP, 12), ip4...)
+			ones += 96
+		}
+
+		offset := len(data)
+		data = append(data, 7<<5|4)
+		data = append(data, mmdbString("country")...)
+		data = append(data, 7<<5|2)
+		if offset == 0 {
+			isoCodeKey = len(data)
+			data = append(data, mmdbString("iso_code")...)
+		} else {
+			// a pointer to the key of the first record
+			data = append(data, 1<<5|byte(isoCodeKey>>8), byte(isoCodeKey))
+		}
+		data = append(data, mmdbString(country)...)
+		data = append(data, mmdbString("geoname_id")...)
+		data = append(data, 6<<5|3, 0x2c, 0xf5, 0x39)
+		data = append(data, mmdbString("is_in_european_union")...)
+		data = append(data, mmdbExtended(14, 1)...)
+		data = append(data, mmdbString("names")...)
+		data = append(data, mmdbExtended(11, 2)...)
+		data = append(data, mmdbString("de")...)
+		data = append(data, mmdbString("en")...)
+		data = append(data, mmdbString("location")...)
+		data = append(data, 7<<5|3)
+		data = append(data, mmdbString("accuracy_radius")...)
+		data = append(data, mmdbExtended(9, 2)...)
+		data = append(data, 0x03, 0xe8)
+		data = append(data, mmdbString("latitude")...)
+		data = append(data, 3<<5|8, 0x40, 0x49, 0x80, 0, 0, 0, 0, 0)
+		data = append(data, mmdbString("weight")...)
+		data = append(data, mmdbExtended(15, 4)...)
+		data = append(data, 0x3f, 0x80, 0, 0)
+
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[node].records[bit] = offset
+				nodes[node].data[bit] = true
+				break
+			}
+			if nodes[node].records[bit] == empty {
+				nodes = append(nodes, mmdbNode{records: [2]int{empty, empty}})
+				nodes[node].records[bit] = len(nodes) - 1
+			}
+			node = nodes[node].records[bit]
+		}
+	}
+
+	nodeCount := uint32(len(nodes))
+	tree := []byte{}
+	for _, node := range nodes {
+		var records [2]uint32
+		for bit, record := range node.records {
+			switch {
+			case record == empty:
+				records[bit] = nodeCount
+			case node.data[bit]:
+				records[bit] = nodeCount + 16 + uint32(record)
+			default:
+				records[bit] = uint32(record)
+			}
+		}
+		left, right := records[0], records[1]
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left), byte(left>>20)&0xf0|byte(right>>24)&0x0f, byte(right>>16), byte(right>>8), byte(right))
+		default:
+			tree = append(tree, byte(left>>24), byte(left>>16), byte(left>>8), byte(left), byte(right>>24), byte(right>>16), byte(right>>8), byte(right))
+		}
+	}
+
+	metadata := []byte{7<<5 | 3}
+	metadata = append(metadata, mmdbString("node_count")...)
+	metadata = append(metadata, 6<<5|4, byte(nodeCount>>24), byte(nodeCount>>16), byte(nodeCount>>8), byte(nodeCount))
+	metadata = append(metadata, mmdbString("record_size")...)
+	metadata = append(metadata, 5<<5|1, byte(recordSize))
+	metadata = append(metadata, mmdbString("ip_version")...)
+	metadata = append(metadata, 5<<5|1, byte(ipVersion))
+
+	db := append(tree, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, mmdbMetadataMarker...)
+	db = append(db, metadata...)
+	file := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := ioutil.WriteFile(file, db, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestGeoIPDatabases(t *testing.T) {
+	networks := map[string]string{
+		"10.0.0.0/8":     "DE",
+		"11.1.0.0/16":    "FR",
+		"2001:db8::/32":  "NL",
+		"203.0.113.0/24": "JP",
+	}
+	for _, recordSize := range []uint{24, 28, 32} {
+		for _, ipVersion := range []int{4, 6} {
+			geo, err := OpenGeoIP(writeTestMMDB(t, recordSize, ipVersion, networks))
+			if err != nil {
+				t.Fatalf("%d bit ipv%d: %v", recordSize, ipVersion, err)
+			}
+			expected := map[string]string{
+				"10.1.2.3":     "DE",
+				"11.1.255.1":   "FR",
+				"11.2.0.1":     "",
+				"203.0.113.9":  "JP",
+				"2001:db8::1":  "NL",
+				"2001:db9::1":  "",
+				"::ffff:a00:1": "DE",
+			}
+			if ipVersion == 4 {
+				// ipv4 databases know no ipv6 networks
+				expected["2001:db8::1"] = ""
+			}
+			for ip, want := range expected {
+				if got := geo.country(net.ParseIP(ip)); got != want {
+					t.Errorf("%d bit ipv%d: country of %s is %q, want %q", recordSize, ipVersion, ip, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestGeoIPRecords(t *testing.T) {
+	// records beyond 24 bits use the nibbles of the middle byte in 28 bit
+	// trees and all four bytes in 32 bit ones
+	for _, test := range []struct {
+		recordSize  uint
+		tree        []byte
+		left, right uint
+	}{
+		{24, []byte{0xab, 0xcd, 0xef, 0x12, 0x34, 0x56}, 0xabcdef, 0x123456},
+		{28, []byte{0xab, 0xcd, 0xef, 0x97, 0x12, 0x34, 0x56}, 0x9abcdef, 0x7123456},
+		{32, []byte{0xfa, 0xbc, 0xde, 0xf0, 0x01, 0x23, 0x45, 0x67}, 0xfabcdef0, 0x01234567},
+	} {
+		g := &GeoIP{tree: test.tree, recordSize: test.recordSize, nodeCount: 1}
+		if left, right := g.record(0, 0), g.record(0, 1); left != test.left || right != test.right {
+			t.Errorf("%d bit: expected records %x %x, got %x %x", test.recordSize, test.left, test.right, left, right)
+		}
+	}
+}
+
+func TestMMDBDecoder(t *testing.T) {
+	for name, test := range map[string]struct {
+		data     []byte
+		expected interface{}
+	}{
+		"uint16":     {[]byte{5<<5 | 2, 0x01, 0x02}, uint64(0x0102)},
+		"int32":      {append(mmdbExtended(8, 1), 0x05), uint64(5)},
+		"uint128":    {append(mmdbExtended(10, 9), 1, 0, 0, 0, 0, 0, 0, 0, 7), uint64(7)},
+		"false":      {mmdbExtended(14, 0), false},
+		"float":      {append(mmdbExtended(15, 4), 0x3f, 0xc0, 0, 0), 1.5},
+		"bytes":      {[]byte{4<<5 | 2, 0xca, 0xfe}, []byte{0xca, 0xfe}},
+		"long":       {append([]byte{2<<5 | 29, 1}, strings.Repeat("x", 30)...), strings.Repeat("x", 30)},
+		"pointer":    {append([]byte{1 << 5, 2}, mmdbString("DE")...), "DE"},
+		"short data": {[]byte{2<<5 | 3, 'D'}, nil},
+		"loop":       {[]byte{1 << 5, 0}, nil},
+		"unknown":    {mmdbExtended(13, 0), nil},
+	} {
+		value, _, err := mmdbDecoder(test.data).decode(0, 0)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", name, value)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(value) != fmt.Sprint(test.expected) {
+			t.Errorf("%s: expected %v, got %v %v", name, test.expected, value, err)
+		}
+	}
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	geo, err := OpenGeoIP(writeTestGeoIP(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{
+		"10.1.2.3":    "DE",
+		"11.0.0.1":    "",
+		"2001:db8::1": "",
+	} {
+		if got := geo.country(net.ParseIP(ip)); got != want {
+			t.Errorf("country of %s is %q, want %q", ip, got, want)
+		}
+	}
+
+	sa := newTestAuthenticator(map[string]*Destination{
+		"example.com": {Ports: []int{443}, AllowCountries: []string{"de"}},
+	}, map[string][]string{"example.com": {"10.0.0.1", "11.0.0.1"}})
+	sa.geo = geo
+	for _, destination := range sa.destinations {
+		if err := destination.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, allowed := sa.Allow(context.Background(), newTestRequest("", "10.0.0.1", 443)); !allowed {
+		t.Error("ip in DE should be allowed")
+	}
+	if _, allowed := sa.Allow(context.Background(), newTestRequest("", "11.0.0.1", 443)); allowed {
+		t.Error("ip of unknown country should be denied")
+	}
+}
+
+// newIndexTestAuthenticator has many destinations resolving to an IP each,
+// one network and one wildcard
+func newIndexTestAuthenticator(destinations int) *Authenticator {
+	allowed := map[string]*Destination{
+		"10.1.0.0/16":   {Ports: []int{443}},
+		"*.example.org": {Ports: []int{443}},
+	}
+	resolvedNames := map[string][]string{}
+	for i := 0; i < destinations; i++ {
+		name := fmt.Sprintf("host-%d.example.com", i)
+		allowed[name] = &Destination{Ports: []int{443}}
+		resolvedNames[name] = []string{fmt.Sprintf("10.0.%d.%d", i/256, i%256)}
+	}
+	sa := newTestAuthenticator(allowed, resolvedNames)
+	sa.names = sortedNames(allowed)
+	_, network, _ := net.ParseCIDR("10.1.0.0/16")
+	sa.networks = map[string]*net.IPNet{"10.1.0.0/16": network}
+	sa.index()
+	return sa
+}
+
+func TestNameIndexLookup(t *testing.T) {
+	sa := newIndexTestAuthenticator(300)
+	sa.resolvedNames["host-1.example.com"] = []string{"10.0.0.1", "::ffff:10.0.0.1", "fd00::1"}
+	sa.resolvedNames["host-2.example.com"] = []string{"10.0.0.1"}
+	sa.index()
+
+	for _, addr := range []*socks5.AddrSpec{
+		{IP: net.ParseIP("10.0.0.1")},
+		{IP: net.ParseIP("::ffff:10.0.0.1")},
+		{IP: net.ParseIP("fd00:0::1")},
+		{IP: net.ParseIP("10.0.1.44"), FQDN: "www.example.org"},
+		{IP: net.ParseIP("10.1.2.3")},
+		{IP: net.ParseIP("192.0.2.1"), FQDN: "example.org"},
+	} {
+		expected := []string{}
+		for _, name := range sa.names {
+			if sa.matches(name, addr) {
+				expected = append(expected, name)
+			}
+		}
+		if matched := sa.allowIndex.lookup(addr, sa.networks); strings.Join(matched, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s %s: expected %v, got %v", addr.IP, addr.FQDN, expected, matched)
+		}
+	}
+}
+
+// BenchmarkAllow compares finding the destinations of a request by the name
+// index with matching every destination, as Allow did before the index
+func BenchmarkAllow(b *testing.B) {
+	sa := newIndexTestAuthenticator(1000)
+	req := newTestRequest("jan", "10.0.3.200", 443)
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, allowed := sa.Allow(context.Background(), req); !allowed {
+				b.Fatal("expected the request allowed")
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			matched := 0
+			for _, name := range sa.names {
+				if sa.matches(name, req.DestAddr) && sa.destinations[name].allowsPort(req.DestAddr.Port) {
+					matched++
+				}
+			}
+			if matched != 1 {
+				b.Fatal("expected one destination matched")
+			}
+		}
+	})
+}
+
+func TestSetDestinationsWhileAllow(t *testing.T) {
+	resolver := LookupFunc(func(name string) ([]string, time.Duration, error) {
+		return []string{"10.0.0.5"}, time.Hour, nil
+	})
+	// both versions deny 10.0.0.5, by a network and by a name
+	versions := []func() (map[string]*Destination, map[string]*Destination){
+		func() (map[string]*Destination, map[string]*Destination) {
+			return map[string]*Destination{"10.0.0.0/16": {AllPorts: true}},
+				map[string]*Destination{"10.0.0.0/24": {}}
+		},
+		func() (map[string]*Destination, map[string]*Destination) {
+			return map[string]*Destination{"10.0.0.0/16": {AllPorts: true}},
+				map[string]*Destination{"blocked.example.com": {}}
+		},
+	}
+	destinations, denies := versions[0]()
+	sa, err := NewAuthenticator(zap.NewNop(), destinations, denies, resolver, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa.CacheDecisions(time.Minute)
+
+	done := make(chan struct{})
+	var allowedDenied int32
+	finished := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer func() { finished <- struct{}{} }()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, allowed := sa.Allow(context.Background(), newTestRequest("jan", "10.0.0.5", 443)); allowed {
+					atomic.AddInt32(&allowedDenied, 1)
+				}
+				_, _ = sa.Allow(context.Background(), newTestRequest("jan", "10.0.1.1", 443))
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		destinations, denies := versions[i%2]()
+		if err := sa.SetDestinations(destinations, denies); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	for i := 0; i < 4; i++ {
+		<-finished
+	}
+	if n := atomic.LoadInt32(&allowedDenied); n > 0 {
+		t.Errorf("a request denied by every version was allowed %d times during reloads", n)
+	}
+}
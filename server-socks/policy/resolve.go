@@ -0,0 +1,450 @@
+package policy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// resolveInterval is how often destination names are resolved again,
+	// unless the ttl of their records is known
+	resolveInterval = 10 * time.Second
+	// minResolveTTL and maxResolveTTL bound the ttl names are resolved by
+	minResolveTTL = time.Second
+	maxResolveTTL = time.Hour
+	// maxResolveBackoff bounds how long a name failing to resolve waits
+	// before it is retried, the wait doubles from resolveInterval with
+	// every failure in a row
+	maxResolveBackoff = 5 * time.Minute
+	// minWaitResolveBackoff and maxWaitResolveBackoff bound the wait
+	// between the attempts of WaitResolved
+	minWaitResolveBackoff = 250 * time.Millisecond
+	maxWaitResolveBackoff = 10 * time.Second
+)
+
+// ResolvConf lists the nameservers ttl aware lookups query
+const ResolvConf = "/etc/resolv.conf"
+
+// Resolver looks up the addresses of a destination name and how long they
+// may be used, a ttl of 0 means unknown
+type Resolver interface {
+	LookupHost(name string) (addrs []string, ttl time.Duration, err error)
+}
+
+// LookupFunc is a function used as a Resolver, like fixed mappings in tests
+type LookupFunc func(name string) (addrs []string, ttl time.Duration, err error)
+
+func (f LookupFunc) LookupHost(name string) ([]string, time.Duration, error) {
+	return f(name)
+}
+
+// SystemResolver resolves names with net.LookupHost, which does not tell
+// the ttl
+type SystemResolver struct{}
+
+func (SystemResolver) LookupHost(name string) ([]string, time.Duration, error) {
+	addrs, err := net.LookupHost(name)
+	return addrs, 0, err
+}
+
+// resolveNames looks up the IPv4 and IPv6 addresses of names, with up to
+// workers lookups at once, and the ttl they were resolved with. Every name
+// is resolved independently, the ones failing are left out of the result
+// and reported in a resolveErrors.
+func resolveNames(resolver Resolver, workers int, names []string) (map[string][]string, map[string]time.Duration, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	addrs := make([][]string, len(names))
+	ttls := make([]time.Duration, len(names))
+	errs := make([]error, len(names))
+	indexes := make(chan int)
+	wg := &sync.WaitGroup{}
+	for w := 0; w < workers && w < len(names); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				addrs[i], ttls[i], errs[i] = resolver.LookupHost(names[i])
+			}
+		}()
+	}
+	for i := range names {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	newResolvedNames := map[string][]string{}
+	newTTLs := map[string]time.Duration{}
+	failed := resolveErrors{}
+	for i, name := range names {
+		if errs[i] != nil {
+			failed[name] = errs[i]
+			continue
+		}
+		newResolvedNames[name] = addrs[i]
+		newTTLs[name] = ttls[i]
+	}
+	if len(failed) > 0 {
+		return newResolvedNames, newTTLs, failed
+	}
+	return newResolvedNames, newTTLs, nil
+}
+
+// resolveErrors are the lookup errors by the name that failed to resolve
+type resolveErrors map[string]error
+
+func (e resolveErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for name, err := range e {
+		messages = append(messages, fmt.Sprintf("can not resolve destination %s: %v", name, err))
+	}
+	sort.Strings(messages)
+	return strings.Join(messages, "; ")
+}
+
+// scheduleResolve sets when names are resolved again by their ttl, names
+// without a known ttl after resolveInterval. Names in failed are retried
+// after a backoff growing with their failures in a row, which a successful
+// resolution resets.
+func (sa *Authenticator) scheduleResolve(names []string, ttls map[string]time.Duration, failed resolveErrors) {
+	now := time.Now()
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+	for _, name := range names {
+		if _, ok := failed[name]; ok {
+			sa.resolveFailures[name]++
+			sa.nextResolve[name] = now.Add(resolveBackoff(sa.resolveFailures[name]))
+			continue
+		}
+		delete(sa.resolveFailures, name)
+		after := resolveInterval
+		if ttl := ttls[name]; ttl > 0 {
+			after = ttl
+			if after < minResolveTTL {
+				after = minResolveTTL
+			}
+			if after > maxResolveTTL {
+				after = maxResolveTTL
+			}
+		}
+		sa.nextResolve[name] = now.Add(after)
+	}
+}
+
+// resolveBackoff is how long a name waits to be resolved again after
+// failing as many times in a row
+func resolveBackoff(failures int) time.Duration {
+	after := resolveInterval
+	for i := 1; i < failures && after < maxResolveBackoff; i++ {
+		after *= 2
+	}
+	if after > maxResolveBackoff {
+		after = maxResolveBackoff
+	}
+	return after
+}
+
+// untilNextResolve is how long until the next name is due to be resolved
+func (sa *Authenticator) untilNextResolve() time.Duration {
+	sa.lock.RLock()
+	defer sa.lock.RUnlock()
+	until := resolveInterval
+	for _, next := range sa.nextResolve {
+		if d := time.Until(next); d < until {
+			until = d
+		}
+	}
+	if until < minResolveTTL {
+		until = minResolveTTL
+	}
+	return until
+}
+
+// dueNames are the names due to be resolved at now
+func (sa *Authenticator) dueNames(now time.Time) []string {
+	sa.lock.RLock()
+	defer sa.lock.RUnlock()
+	names := []string{}
+	for _, name := range sa.toResolve {
+		if !sa.nextResolve[name].After(now) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// unresolvedNames are the names to resolve without any known addresses
+func (sa *Authenticator) unresolvedNames() []string {
+	sa.lock.RLock()
+	defer sa.lock.RUnlock()
+	names := []string{}
+	for _, name := range sa.toResolve {
+		if _, ok := sa.resolvedNames[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Resolved tells if every name of the destinations resolved at least once,
+// names keep their last resolution once they did
+func (sa *Authenticator) Resolved() bool {
+	return len(sa.unresolvedNames()) == 0
+}
+
+// WaitResolved retries the names that failed to resolve so far, with a
+// backoff growing between the attempts, until all of them resolved or
+// timeout passed. It returns the errors of the names still failing, which
+// match nothing until the background resolution succeeds, meant for the
+// network not being up yet at startup.
+func (sa *Authenticator) WaitResolved(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := minWaitResolveBackoff
+	for {
+		names := sa.unresolvedNames()
+		if len(names) == 0 {
+			return nil
+		}
+		sa.lock.RLock()
+		toResolve := sa.toResolve
+		sa.lock.RUnlock()
+		resolvedNames, ttls, err := resolveNames(sa.resolver, sa.resolveWorkers, names)
+		sa.lock.RLock()
+		reloaded := !sameStrings(toResolve, sa.toResolve)
+		sa.lock.RUnlock()
+		if reloaded {
+			// the names of the new destinations are resolved by the reload
+			return nil
+		}
+		resolved := make([]string, 0, len(resolvedNames))
+		for name := range resolvedNames {
+			resolved = append(resolved, name)
+		}
+		sa.setResolvedNames(resolvedNames)
+		sa.scheduleResolve(resolved, ttls, nil)
+		if err == nil {
+			return nil
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return err
+		}
+		if wait > backoff {
+			wait = backoff
+		}
+		sa.log.Warn("could not resolve names, retrying", zap.Duration("in", wait), zap.Error(err))
+		time.Sleep(wait)
+		if backoff *= 2; backoff > maxWaitResolveBackoff {
+			backoff = maxWaitResolveBackoff
+		}
+	}
+}
+
+// DNSLookup resolves names by querying nameservers directly, which unlike
+// net.LookupHost reports the ttl of the records. Queries go to the
+// nameservers over udp, or to a DNS-over-HTTPS endpoint if dohURL is set.
+// Names the nameservers can not resolve are handed to net.LookupHost,
+// without a ttl, the system resolver is never asked with DNS-over-HTTPS.
+type DNSLookup struct {
+	servers []string
+	dohURL  string
+	client  *http.Client
+	timeout time.Duration
+}
+
+// NewDoHLookup queries a DNS-over-HTTPS endpoint like
+// https://dns.example.com/dns-query with RFC 8484 wireformat messages
+func NewDoHLookup(dohURL string) (*DNSLookup, error) {
+	u, err := url.Parse(dohURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("doh url %q is not an https url", dohURL)
+	}
+	timeout := 5 * time.Second
+	return &DNSLookup{dohURL: dohURL, client: &http.Client{Timeout: timeout}, timeout: timeout}, nil
+}
+
+// NewDNSLookup queries the nameservers listed in a resolv.conf file
+func NewDNSLookup(file string) (*DNSLookup, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	l := &DNSLookup{timeout: 5 * time.Second}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			l.servers = append(l.servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(l.servers) == 0 {
+		return nil, fmt.Errorf("no nameservers in %s", file)
+	}
+	return l, nil
+}
+
+func (l *DNSLookup) LookupHost(name string) ([]string, time.Duration, error) {
+	if net.ParseIP(name) != nil {
+		return []string{name}, 0, nil
+	}
+	addrs, ttl, err := l.query(name)
+	if err != nil && l.dohURL == "" {
+		return SystemResolver{}.LookupHost(name)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return addrs, ttl, nil
+}
+
+// query looks up the A and AAAA records of name, the ttl is the lowest of
+// the records answered, including CNAMEs leading to them
+func (l *DNSLookup) query(name string) ([]string, time.Duration, error) {
+	addrs := []string{}
+	ttl := uint32(0)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, err := l.exchange(name, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, answer := range answers {
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, net.IP(body.A[:]).String())
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, net.IP(body.AAAA[:]).String())
+			case *dnsmessage.CNAMEResource:
+			default:
+				continue
+			}
+			if ttl == 0 || answer.Header.TTL < ttl {
+				ttl = answer.Header.TTL
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, fmt.Errorf("no addresses for %s", name)
+	}
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+// exchange asks the nameservers in turn until one answers
+func (l *DNSLookup) exchange(name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	id := uint16(rand.Intn(1 << 16))
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if l.dohURL != "" {
+		return l.exchangeDoH(packed, id)
+	}
+	var lastErr error
+	for _, server := range l.servers {
+		answers, err := l.exchangeUDP(server, packed, id)
+		if err == nil {
+			return answers, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (l *DNSLookup) exchangeUDP(server string, query []byte, id uint16) ([]dnsmessage.Resource, error) {
+	conn, err := net.DialTimeout("udp", server, l.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(l.timeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1232)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		var response dnsmessage.Message
+		if err := response.Unpack(buf[:n]); err != nil || response.Header.ID != id || !response.Header.Response {
+			// not the answer to the query, keep waiting
+			continue
+		}
+		return answersOf(&response)
+	}
+}
+
+func (l *DNSLookup) exchangeDoH(query []byte, id uint16) ([]dnsmessage.Resource, error) {
+	request, err := http.NewRequest(http.MethodPost, l.dohURL, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+	response, err := l.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh response %s", response.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	var message dnsmessage.Message
+	if err := message.Unpack(body); err != nil {
+		return nil, err
+	}
+	// RFC 8484 allows an id of 0 when the query had one
+	if message.Header.ID != id && message.Header.ID != 0 {
+		return nil, errors.New("doh response to another query")
+	}
+	return answersOf(&message)
+}
+
+// answersOf returns the answers of a successful response
+func answersOf(response *dnsmessage.Message) ([]dnsmessage.Resource, error) {
+	if response.Header.Truncated {
+		return nil, errors.New("truncated dns response")
+	}
+	if response.Header.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("dns response %s", response.Header.RCode)
+	}
+	return response.Answers, nil
+}
@@ -0,0 +1,116 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// accessWindow is a parsed schedule entry like "Mon-Fri 09:00-18:00". The
+// days are optional and default to every day, a window ending before it
+// starts wraps around midnight into the next day.
+type accessWindow struct {
+	days       [7]bool
+	start, end time.Duration
+}
+
+func parseAccessWindow(window string) (accessWindow, error) {
+	w := accessWindow{}
+	fields := strings.Fields(window)
+	switch len(fields) {
+	case 1:
+		for day := range w.days {
+			w.days[day] = true
+		}
+	case 2:
+		if err := w.parseDays(fields[0]); err != nil {
+			return w, fmt.Errorf("invalid schedule %q: %v", window, err)
+		}
+	default:
+		return w, fmt.Errorf("invalid schedule %q", window)
+	}
+	var err error
+	w.start, w.end, err = ParseHours(fields[len(fields)-1])
+	if err != nil {
+		return w, fmt.Errorf("invalid schedule %q: %v", window, err)
+	}
+	return w, nil
+}
+
+// parseDays parses comma separated days or day ranges like "Mon-Fri,Sun"
+func (w *accessWindow) parseDays(days string) error {
+	for _, days := range strings.Split(days, ",") {
+		bounds := strings.SplitN(days, "-", 2)
+		first, firstOK := weekdays[strings.ToLower(bounds[0])]
+		last, lastOK := first, firstOK
+		if len(bounds) == 2 {
+			last, lastOK = weekdays[strings.ToLower(bounds[1])]
+		}
+		if !firstOK || !lastOK {
+			return fmt.Errorf("unknown days %q", days)
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (w accessWindow) contains(now time.Time) bool {
+	day := now.Weekday()
+	since := SinceMidnight(now)
+	if w.start <= w.end {
+		return w.days[day] && since >= w.start && since < w.end
+	}
+	return (w.days[day] && since >= w.start) || (w.days[(day+6)%7] && since < w.end)
+}
+
+// ParseHours parses a time of day range like "09:00-18:00"
+func ParseHours(hours string) (start, end time.Duration, err error) {
+	bounds := strings.SplitN(hours, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("invalid hours %q", hours)
+	}
+	if start, err = parseClock(bounds[0]); err != nil {
+		return 0, 0, err
+	}
+	if end, err = parseClock(bounds[1]); err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+// parseClock parses "15:04" into the duration since midnight
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %v", clock, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// SinceMidnight is the time of day of t
+func SinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+// LoadLocation returns the named timezone, defaulting to the local one
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
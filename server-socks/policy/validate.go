@@ -0,0 +1,102 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ValidateDestinations checks the destinations and denies read from a
+// config against the users of the realm before they are used, reporting
+// every invalid entry at once. Names are resolved later, those that do not
+// resolve are logged and match nothing until they do.
+func ValidateDestinations(destinations, denies map[string]*Destination, groups map[string][]string, passwordHashes map[string]string) error {
+	problems := []string{}
+	groupNames := make([]string, 0, len(groups))
+	for group := range groups {
+		groupNames = append(groupNames, group)
+	}
+	sort.Strings(groupNames)
+	for _, group := range groupNames {
+		for _, user := range groups[group] {
+			if _, ok := passwordHashes[user]; !ok {
+				problems = append(problems, fmt.Sprintf("group %s: unknown user %s, not in the basic auth file", group, user))
+			}
+		}
+	}
+	for _, name := range sortedNames(destinations) {
+		for _, problem := range validateDestination(name, destinations[name], groups, passwordHashes, false) {
+			problems = append(problems, fmt.Sprintf("destination %s: %s", name, problem))
+		}
+	}
+	for _, name := range sortedNames(denies) {
+		for _, problem := range validateDestination(name, denies[name], groups, passwordHashes, true) {
+			problems = append(problems, fmt.Sprintf("deny %s: %s", name, problem))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid destinations config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func validateDestination(name string, d *Destination, groups map[string][]string, passwordHashes map[string]string, isDeny bool) (problems []string) {
+	if isCIDR(name) {
+		if _, _, err := net.ParseCIDR(name); err != nil {
+			problems = append(problems, "invalid cidr")
+		}
+	} else if strings.TrimPrefix(name, "*.") == "" || strings.ContainsAny(name, " /") {
+		problems = append(problems, "not a hostname, ip, wildcard or cidr")
+	}
+	if d == nil && isDeny {
+		// an empty deny entry would deny nothing rather than everything
+		return append(problems, "empty destination, write {} to deny every port, user and command")
+	}
+	if d == nil {
+		return append(problems, "empty entry, list ports or set allports: true")
+	}
+	if !isDeny && len(d.Ports) == 0 && !d.AllPorts {
+		problems = append(problems, "no ports, list ports or set allports: true")
+	}
+	if isDeny && len(d.Schedule) > 0 {
+		// deny rules apply at all times
+		problems = append(problems, "schedule on a deny entry, deny entries apply at all times")
+	}
+	if d.AllPorts && len(d.Ports) > 0 {
+		problems = append(problems, "ports listed along with allports")
+	}
+	for _, port := range d.Ports {
+		if port < 1 || port > 65535 {
+			problems = append(problems, fmt.Sprintf("invalid port %d", port))
+		}
+	}
+	for _, command := range d.Commands {
+		if _, ok := commandNames[strings.ToLower(command)]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown command %s, use connect, udp or bind", command))
+		}
+	}
+	for _, user := range d.Users {
+		if isUserPattern(user) {
+			if _, err := path.Match(user, ""); err != nil {
+				problems = append(problems, fmt.Sprintf("invalid user pattern %s", user))
+			}
+			continue
+		}
+		if _, ok := passwordHashes[user]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown user %s, not in the basic auth file", user))
+		}
+	}
+	for _, group := range d.Groups {
+		if _, ok := groups[group]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown group %s, not under groups", group))
+		}
+	}
+	return problems
+}
+
+// isCIDR tells if a destination name is a network like 10.0.0.0/8
+func isCIDR(name string) bool {
+	return strings.Contains(name, "/")
+}
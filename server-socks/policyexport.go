@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"server-socks/policy"
+)
+
+// policyExport is the effective policy of a realm exported for audits
+type policyExport struct {
+	Realm        string              `json:"realm"`
+	Destinations []destinationPolicy `json:"destinations"`
+	Denies       []destinationPolicy `json:"denies"`
+}
+
+// destinationPolicy is a destination or deny along with the IPs it
+// currently matches. Members are the users of the Groups, empty Users and
+// Groups allow everyone.
+type destinationPolicy struct {
+	Name       string     `json:"name"`
+	IPs        []string   `json:"ips"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	Users      []string   `json:"users"`
+	Groups     []string   `json:"groups"`
+	Members    []string   `json:"members"`
+	Ports      []int      `json:"ports"`
+	AllPorts   bool       `json:"all_ports"`
+	Commands   []string   `json:"commands"`
+	Schedule   []string   `json:"schedule,omitempty"`
+	Timezone   string     `json:"timezone,omitempty"`
+}
+
+// exportPolicies returns the effective policy of every realm, sorted by
+// realm name
+func exportPolicies(realms map[string]*realm) []policyExport {
+	policies := make([]policyExport, 0, len(realms))
+	for name, realm := range realms {
+		policies = append(policies, exportPolicy(name, realm.authenticator))
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Realm < policies[j].Realm
+	})
+	return policies
+}
+
+func exportPolicy(realmName string, p policy.Policy) policyExport {
+	// the destinations and what they resolved to are taken at once, so a
+	// reload in between can not mix them up
+	destinations, denies, resolved := p.Snapshot()
+	resolutions := map[string]policy.Resolution{}
+	for _, resolution := range resolved {
+		resolutions[resolution.Name] = resolution
+	}
+	return policyExport{
+		Realm:        realmName,
+		Destinations: exportDestinations(destinations, resolutions),
+		Denies:       exportDestinations(denies, resolutions),
+	}
+}
+
+func exportDestinations(destinations map[string]*policy.Destination, resolutions map[string]policy.Resolution) []destinationPolicy {
+	exported := make([]destinationPolicy, 0, len(destinations))
+	for name, d := range destinations {
+		if d == nil {
+			d = &policy.Destination{}
+		}
+		e := destinationPolicy{
+			Name:     name,
+			IPs:      []string{},
+			Users:    nonNilStrings(d.Users),
+			Groups:   nonNilStrings(d.Groups),
+			Members:  nonNilStrings(d.Members()),
+			Ports:    d.Ports,
+			AllPorts: d.AllPorts,
+			Commands: nonNilStrings(d.Commands),
+			Schedule: d.Schedule,
+			Timezone: d.Timezone,
+		}
+		if e.Ports == nil {
+			e.Ports = []int{}
+		}
+		if resolution, ok := resolutions[name]; ok {
+			e.IPs = nonNilStrings(resolution.IPs)
+			resolvedAt := resolution.ResolvedAt
+			e.ResolvedAt = &resolvedAt
+		} else if _, _, err := net.ParseCIDR(name); err == nil {
+			// networks match without being resolved
+			e.IPs = []string{name}
+		}
+		exported = append(exported, e)
+	}
+	sort.Slice(exported, func(i, j int) bool {
+		return exported[i].Name < exported[j].Name
+	})
+	return exported
+}
+
+// nonNilStrings keeps empty lists as [] rather than null in the export
+func nonNilStrings(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"time"
+	"util"
+
+	"go.uber.org/zap"
+)
+
+// probeTimeout bounds how long clients may take to send their first bytes
+const probeTimeout = 10 * time.Second
+
+// probeFilter rejects clients not speaking TLS, like scanners sending plain
+// http, by the first bytes of their connection before any handshake is
+// attempted. TLS connections start with a handshake record, content type
+// 0x16 followed by the major version 3.
+type probeFilter struct {
+	log *zap.Logger
+	// response is written to rejected clients before closing, if not empty
+	response []byte
+}
+
+// filter returns conn with the inspected bytes still to be read, or nil if
+// conn has been closed because its client does not speak TLS
+func (f *probeFilter) filter(conn net.Conn) net.Conn {
+	if f == nil {
+		return conn
+	}
+	zapFrom := zap.String("from", conn.RemoteAddr().String())
+	reader := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	header, err := reader.Peek(2)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		f.log.Debug("no first bytes received", zapFrom, zap.Error(err))
+		plaintextProbes.WithLabelValues("no_data").Inc()
+		util.SilentClose(conn)
+		return nil
+	}
+	if header[0] != 0x16 || header[1] != 0x03 {
+		f.log.Info("rejected plaintext probe", zapFrom, zap.ByteString("first_bytes", header))
+		plaintextProbes.WithLabelValues("plaintext").Inc()
+		if len(f.response) > 0 {
+			_ = conn.SetWriteDeadline(time.Now().Add(probeTimeout))
+			_, _ = conn.Write(f.response)
+		}
+		util.SilentClose(conn)
+		return nil
+	}
+	return &peekedConn{Conn: conn, reader: reader}
+}
+
+// peekedConn reads the bytes peeked at by probeFilter before the rest
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"util"
+
+	"go.uber.org/zap"
+)
+
+// proxyProtocolV2Signature starts PROXY protocol v2 headers
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errNoProxyHeader = errors.New("no proxy protocol header")
+
+// proxyProtocol reads the PROXY protocol header, v1 or v2, middle-proxy or
+// a load balancer puts ahead of the client's traffic. Only connections from
+// trusted sources are expected to have one, it is required from them and
+// the client address it carries becomes the remote address of the
+// connection.
+type proxyProtocol struct {
+	log     *zap.Logger
+	trusted []*net.IPNet
+	// all trusts every source, for servers reachable through the load
+	// balancer only
+	all bool
+}
+
+func newProxyProtocol(log *zap.Logger, trusted []string) (*proxyProtocol, error) {
+	networks, err := parseNetworks(trusted)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocol{log: log, trusted: networks}, nil
+}
+
+// parseNetworks parses ips and cidrs, ips become networks of their own
+func parseNetworks(sources []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, source := range sources {
+		if !strings.Contains(source, "/") {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", source)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				bits = 32
+			}
+			source = fmt.Sprintf("%s/%d", source, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, ipNet)
+	}
+	return networks, nil
+}
+
+// expects tells if conn has to start with a header, the remote address of
+// such a connection is only known once it has been read
+func (p *proxyProtocol) expects(conn net.Conn) bool {
+	return p != nil && p.isTrusted(conn.RemoteAddr())
+}
+
+func (p *proxyProtocol) isTrusted(addr net.Addr) bool {
+	if p.all {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range p.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// accept returns conn reporting the client address from its header, or nil
+// if conn has been closed for a missing or invalid header
+func (p *proxyProtocol) accept(conn net.Conn) net.Conn {
+	if !p.expects(conn) {
+		return conn
+	}
+	zapFrom := zap.String("from", conn.RemoteAddr().String())
+	reader := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	clientAddr, err := readProxyHeader(reader)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		p.log.Info("rejected connection without valid proxy protocol header", zapFrom, zap.Error(err))
+		util.SilentClose(conn)
+		return nil
+	}
+	if clientAddr == nil {
+		// a health check of the proxy, or a protocol it can not describe
+		clientAddr = conn.RemoteAddr()
+	}
+	return &proxiedConn{peekedConn: peekedConn{Conn: conn, reader: reader}, remoteAddr: clientAddr}
+}
+
+// proxiedConn is a connection reporting the client address from its PROXY
+// protocol header as its remote address
+type proxiedConn struct {
+	peekedConn
+	remoteAddr net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header and returns the
+// client address it carries, nil if the header does not carry one
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	start, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch start[0] {
+	case 'P':
+		return readProxyHeaderV1(reader)
+	case proxyProtocolV2Signature[0]:
+		return readProxyHeaderV2(reader)
+	default:
+		return nil, errNoProxyHeader
+	}
+}
+
+// readProxyHeaderV1 reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 8000\r\n"
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	// the longest v1 header has 107 bytes
+	line := make([]byte, 0, 107)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == cap(line) {
+			return nil, errNoProxyHeader
+		}
+	}
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errNoProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unknown proxy protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed proxy protocol header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed proxy protocol source %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a binary v2 header
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyProtocolV2Signature) {
+		return nil, errNoProxyHeader
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy protocol version %d", header[12]>>4)
+	}
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, addresses); err != nil {
+		return nil, err
+	}
+	// the LOCAL command is sent by the proxy itself, like for health checks
+	if header[12]&0xf == 0 {
+		return nil, nil
+	}
+	switch header[13] {
+	case 0x11: // tcp over ipv4
+		if len(addresses) < 12 {
+			return nil, errors.New("short proxy protocol ipv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[:4]), Port: int(binary.BigEndian.Uint16(addresses[8:]))}, nil
+	case 0x21: // tcp over ipv6
+		if len(addresses) < 36 {
+			return nil, errors.New("short proxy protocol ipv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[:16]), Port: int(binary.BigEndian.Uint16(addresses[32:]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"server-socks/policy"
+	"socks5"
+
+	"go.uber.org/zap"
+)
+
+// quotaSaveInterval is how often the usage is written to the quota file
+const quotaSaveInterval = time.Minute
+
+// quota reset schedules, periods start at midnight in the local time
+const (
+	quotaResetDaily   = "daily"
+	quotaResetWeekly  = "weekly"
+	quotaResetMonthly = "monthly"
+)
+
+// quotas track the bytes transferred by every authenticated user within
+// the current period and deny new connections of users exceeding their
+// quota. The usage is kept in a file, if any, to survive restarts.
+type quotas struct {
+	log   *zap.Logger
+	file  string
+	reset string
+	// defaultQuota in bytes per period for users without one in their
+	// limits, 0 means unlimited
+	defaultQuota int64
+	limits       map[string]*UserLimit
+	lock         sync.Mutex
+	periodStart  time.Time
+	// usage in bytes by user, counted atomically by the connections
+	usage map[string]*int64
+}
+
+// quotaFile is the persisted usage of a period
+type quotaFile struct {
+	PeriodStart time.Time        `json:"period_start"`
+	Usage       map[string]int64 `json:"usage"`
+}
+
+// quotaUsage is the usage of a user reported by the admin api
+type quotaUsage struct {
+	User  string `json:"user"`
+	Bytes int64  `json:"bytes"`
+	Quota int64  `json:"quota"`
+}
+
+func newQuotas(log *zap.Logger, file, reset string, defaultQuota int64, limits map[string]*UserLimit) (*quotas, error) {
+	q := &quotas{
+		log:          log,
+		file:         file,
+		reset:        reset,
+		defaultQuota: defaultQuota,
+		limits:       limits,
+		usage:        map[string]*int64{},
+	}
+	now := time.Now()
+	q.periodStart = q.start(now)
+	if q.periodStart.IsZero() {
+		return nil, fmt.Errorf("unknown quota reset %q, use one of daily, weekly or monthly", reset)
+	}
+	if file == "" {
+		return q, nil
+	}
+	fileBytes, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can not read quota file: %v", err)
+	}
+	saved := quotaFile{}
+	if err := json.Unmarshal(fileBytes, &saved); err != nil {
+		return nil, fmt.Errorf("can not parse quota file: %v", err)
+	}
+	// usage of a past period is dropped
+	if saved.PeriodStart.Equal(q.periodStart) {
+		for userName, bytes := range saved.Usage {
+			usage := bytes
+			q.usage[userName] = &usage
+		}
+	}
+	return q, nil
+}
+
+// start returns when the period containing now started, zero for an
+// unknown reset schedule
+func (q *quotas) start(now time.Time) time.Time {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch q.reset {
+	case quotaResetDaily:
+		return midnight
+	case quotaResetWeekly:
+		// weeks start on monday
+		return midnight.AddDate(0, 0, -(int(midnight.Weekday())+6)%7)
+	case quotaResetMonthly:
+		return midnight.AddDate(0, 0, 1-midnight.Day())
+	}
+	return time.Time{}
+}
+
+// quota returns the bytes per period userName may transfer, 0 is unlimited
+func (q *quotas) quota(userName string) int64 {
+	if limit, ok := q.limits[userName]; ok && limit.Quota > 0 {
+		return limit.Quota
+	}
+	return q.defaultQuota
+}
+
+// counter returns the usage of userName the bytes of its connections are
+// added to, nil if the user has no quota
+func (q *quotas) counter(userName string) *int64 {
+	if q == nil || userName == "" || q.quota(userName) == 0 {
+		return nil
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.rollover(time.Now())
+	usage, ok := q.usage[userName]
+	if !ok {
+		usage = new(int64)
+		q.usage[userName] = usage
+	}
+	return usage
+}
+
+// charge adds n bytes to the usage of userName, false if the user used up
+// the quota already and the bytes are not to be transferred. It meters
+// traffic not going through a counted connection, like udp datagrams.
+func (q *quotas) charge(userName string, n int) bool {
+	usage := q.counter(userName)
+	if usage == nil {
+		return true
+	}
+	if atomic.LoadInt64(usage) >= q.quota(userName) {
+		return false
+	}
+	atomic.AddInt64(usage, int64(n))
+	return true
+}
+
+// rollover resets the usage once a new period started, the counters stay
+// in place as open connections keep adding to them
+func (q *quotas) rollover(now time.Time) {
+	if start := q.start(now); start.After(q.periodStart) {
+		q.periodStart = start
+		for _, usage := range q.usage {
+			atomic.StoreInt64(usage, 0)
+		}
+		q.log.Info("quota period started", zap.Time("period_start", start))
+	}
+}
+
+// used returns the bytes userName transferred in the current period
+func (q *quotas) used(userName string) int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.rollover(time.Now())
+	if usage, ok := q.usage[userName]; ok {
+		return atomic.LoadInt64(usage)
+	}
+	return 0
+}
+
+// usages returns the usage of every user in the current period
+func (q *quotas) usages() []quotaUsage {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.rollover(time.Now())
+	usages := make([]quotaUsage, 0, len(q.usage))
+	for userName, usage := range q.usage {
+		usages = append(usages, quotaUsage{User: userName, Bytes: atomic.LoadInt64(usage), Quota: q.quota(userName)})
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].User < usages[j].User
+	})
+	return usages
+}
+
+// save writes the usage to the quota file, replacing it at once
+func (q *quotas) save() error {
+	if q == nil || q.file == "" {
+		return nil
+	}
+	q.lock.Lock()
+	saved := quotaFile{PeriodStart: q.periodStart, Usage: make(map[string]int64, len(q.usage))}
+	for userName, usage := range q.usage {
+		saved.Usage[userName] = atomic.LoadInt64(usage)
+	}
+	q.lock.Unlock()
+
+	fileBytes, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmpFile := q.file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, fileBytes, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, q.file)
+}
+
+// run saves the usage every quotaSaveInterval until ctx is done
+func (q *quotas) run(ctx context.Context) {
+	ticker := time.NewTicker(quotaSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := q.save(); err != nil {
+				q.log.Error("can not save quota file", zap.String("file", q.file), zap.Error(err))
+			}
+		}
+	}
+}
+
+func (q *quotas) wrap(rules socks5.RuleSet) socks5.RuleSet {
+	if q == nil {
+		return rules
+	}
+	return &quotaRules{rules: rules, quotas: q}
+}
+
+// quotaRules wraps a socks5.RuleSet denying requests of users who used up
+// their quota before asking the wrapped rules
+type quotaRules struct {
+	rules  socks5.RuleSet
+	quotas *quotas
+}
+
+func (r *quotaRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	userName := req.AuthContext.Payload["Username"]
+	// the peer of a bind is covered by the bind
+	if quota := r.quotas.quota(userName); userName != "" && quota > 0 && !req.BindPeer() {
+		if used := r.quotas.used(userName); used >= quota {
+			r.quotas.log.Info(
+				"denied - quota exceeded",
+				zap.String("to", req.DestAddr.String()),
+				zap.String("for", userName),
+				zap.String("from", policy.SourceIP(req)),
+				zap.Int64("used", used),
+				zap.Int64("quota", quota),
+				policy.DenyReasonQuotaExceeded.Field(),
+			)
+			return policy.DenyReasonQuotaExceeded.Context(ctx), false
+		}
+	}
+	return r.rules.Allow(ctx, req)
+}
+
+func (r *quotaRules) Release(ctx context.Context, req *socks5.Request) {
+	if releaser, ok := r.rules.(socks5.RuleReleaser); ok {
+		releaser.Release(ctx, req)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"util"
+
+	"server-socks/policy"
+)
+
+// UserLimit configures the bandwidth of an authenticated user, shared by
+// all of that user's connections, and the tier of the user
+type UserLimit struct {
+	// Tier of the user, with -max-active-conns higher tiers are served
+	// first under load, users without a limit are in tier 0
+	Tier int
+	// Rate in bytes per second, 0 means unlimited
+	Rate int64
+	// Quota in bytes the user may transfer per quota period, overriding
+	// -quota-bytes, 0 keeps the default
+	Quota int64
+	// Timezone the schedules are evaluated in, defaults to the local one
+	Timezone string
+	// Schedules override Rate during their time window, the first
+	// matching schedule wins
+	Schedules []RateSchedule
+
+	location *time.Location
+}
+
+// RateSchedule applies Rate during Hours, like "09:00-18:00". Windows
+// ending before they start wrap around midnight.
+type RateSchedule struct {
+	Hours string
+	Rate  int64
+
+	start, end time.Duration
+}
+
+func (l *UserLimit) init() (err error) {
+	if l.location, err = policy.LoadLocation(l.Timezone); err != nil {
+		return err
+	}
+	for i := range l.Schedules {
+		schedule := &l.Schedules[i]
+		if schedule.start, schedule.end, err = policy.ParseHours(schedule.Hours); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rateAt returns the rate that applies at the given time
+func (l *UserLimit) rateAt(now time.Time) int64 {
+	since := policy.SinceMidnight(now.In(l.location))
+	for _, schedule := range l.Schedules {
+		if schedule.start <= schedule.end {
+			if since >= schedule.start && since < schedule.end {
+				return schedule.Rate
+			}
+		} else if since >= schedule.start || since < schedule.end {
+			return schedule.Rate
+		}
+	}
+	return l.Rate
+}
+
+// userRateLimiter throttles outbound connections by the user they are
+// dialed for
+type userRateLimiter struct {
+	limits  map[string]*UserLimit
+	lock    sync.Mutex
+	buckets map[string]*util.TokenBucket
+}
+
+func newUserRateLimiter(limits map[string]*UserLimit) (*userRateLimiter, error) {
+	for userName, limit := range limits {
+		if err := limit.init(); err != nil {
+			return nil, fmt.Errorf("invalid limit for %s: %v", userName, err)
+		}
+	}
+	return &userRateLimiter{
+		limits:  limits,
+		buckets: map[string]*util.TokenBucket{},
+	}, nil
+}
+
+func (l *userRateLimiter) bucket(userName string) *util.TokenBucket {
+	limit, limitOK := l.limits[userName]
+	if !limitOK {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	bucket, bucketOK := l.buckets[userName]
+	if !bucketOK {
+		bucket = util.NewTokenBucket(func() int64 {
+			return limit.rateAt(time.Now())
+		})
+		l.buckets[userName] = bucket
+	}
+	return bucket
+}
+
+// limit throttles conn by the bandwidth of the user it was dialed for
+func (l *userRateLimiter) limit(ctx context.Context, conn net.Conn) net.Conn {
+	if bucket := l.bucket(policy.UserFromContext(ctx)); bucket != nil {
+		return util.NewRateLimitedConn(conn, bucket)
+	}
+	return conn
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"util"
+
+	"server-socks/policy"
+	"socks5"
+
+	"go.uber.org/zap"
+)
+
+// RealmConfig describes a tenant served by the same process with its own
+// credentials and destinations. Connections are routed to a realm by the
+// TLS SNI or by the listen address the client used.
+type RealmConfig struct {
+	// Auth is the basic auth file of the realm
+	Auth string
+	// Users is a users file of the realm like -users-file, in place of Auth
+	Users string
+	// Destinations is the destinations config of the realm
+	Destinations string
+	// SNI names routed to the realm on any listener
+	SNI []string
+	// Addr optionally gives the realm listeners of its own, comma separated
+	// like -addr
+	Addr string
+}
+
+// realmSettings are shared by all realms
+type realmSettings struct {
+	disableBasicAuthCaching bool
+	authCacheMaxUsers       int
+	maxConnsPerUser         int
+	udpAssociate            bool
+	bind                    bool
+	requireBasicAuth        bool
+	socks4                  bool
+	socks4TrustUserID       bool
+	allowAll                bool
+	logAllowed              bool
+	handshakeTimeout        time.Duration
+	upgradeBcryptCost       int
+	resolver                policy.Resolver
+	resolveWorkers          int
+	resolveWait             time.Duration
+	requireResolved         bool
+	decisionCacheTTL        time.Duration
+	authFailures            *authFailures
+	tierQueue               *tierQueue
+	quotas                  *quotas
+	accessLog               *accessLog
+	geo                     *policy.GeoIP
+	dial                    func(ctx context.Context, network, addr string) (net.Conn, error)
+	bindConn                func(ctx context.Context, peer net.Conn) net.Conn
+	datagram                func(ctx context.Context, n int, up bool) bool
+	associate               associateFunc
+	self                    *selfAddrs
+}
+
+type realm struct {
+	name          string
+	files         realmFiles
+	credentials   *Credentials
+	authenticator policy.Policy
+	server        *socks5.Server
+}
+
+func newRealm(log *zap.Logger, name string, files realmFiles, settings *realmSettings) (*realm, error) {
+	if name != "" {
+		log = log.With(zap.String("realm", name))
+	}
+
+	loaded, err := files.load()
+	if err != nil {
+		return nil, err
+	}
+	credentials := &Credentials{disableCaching: settings.disableBasicAuthCaching, htpasswd: loaded.passwordHashes}
+	// inline users can not be rehashed in place
+	if settings.upgradeBcryptCost > 0 && loaded.htpasswdFile != "" {
+		credentials.upgrader = newHashUpgrader(log, settings.upgradeBcryptCost, loaded.htpasswdFile)
+	}
+	if settings.authCacheMaxUsers > 0 {
+		credentials.cachedUsers = newAuthCacheUsers(settings.authCacheMaxUsers)
+	}
+
+	suxx5, err := policy.NewAuthenticator(log, loaded.destinations, loaded.denies, settings.resolver, settings.resolveWorkers, settings.geo)
+	if err != nil {
+		return nil, fmt.Errorf("policy.NewAuthenticator failed: %v", err)
+	}
+	suxx5.AllowAll = settings.allowAll
+	suxx5.QuietAllowed = !settings.logAllowed
+	if settings.decisionCacheTTL > 0 {
+		suxx5.CacheDecisions(settings.decisionCacheTTL)
+	}
+	if settings.resolveWait > 0 || settings.requireResolved {
+		if err := suxx5.WaitResolved(settings.resolveWait); err != nil {
+			if settings.requireResolved {
+				return nil, fmt.Errorf("destinations do not resolve: %v", err)
+			}
+			log.Warn("starting with destinations that do not resolve yet, they match nothing until they do", zap.Error(err))
+		}
+	}
+
+	var rules socks5.RuleSet = newSelfGuard(log, suxx5, settings.self)
+	var connLimiter *userConnLimiter
+	if settings.maxConnsPerUser > 0 {
+		connLimiter = newUserConnLimiter(log, rules, settings.maxConnsPerUser)
+		rules = connLimiter
+	}
+	rules = settings.quotas.wrap(rules)
+	rules = settings.tierQueue.wrap(rules)
+	rules = settings.accessLog.wrap(rules, name)
+
+	autenticator := settings.authFailures.wrap(socks5.UserPassAuthenticator{Credentials: credentials})
+	authMethods := []socks5.Authenticator{autenticator}
+	if !settings.requireBasicAuth {
+		// clients without credentials only reach destinations without users
+		authMethods = append(authMethods, socks5.NoAuthAuthenticator{})
+	}
+
+	conf := &socks5.Config{
+		Rules:       rules,
+		AuthMethods: authMethods,
+		Dial:        settings.dial,
+		// bound peers are counted and limited like dialed destinations
+		BindConn: settings.bindConn,
+		// and datagrams are charged to the quotas
+		Datagram: settings.datagram,
+		// udp associations count as connections of their user and are
+		// rate limited by the datagrams
+		Associate: connLimiter.associate(settings.associate),
+		// datagrams are checked against the destinations one by one
+		EnableAssociate: settings.udpAssociate,
+		// the peer connecting to a bound port is checked like a destination
+		EnableBind: settings.bind,
+		// socks4 clients are denied unless basic auth is optional
+		EnableSOCKS4: settings.socks4,
+		// and only trusted with their userid on request
+		SOCKS4TrustUserID: settings.socks4TrustUserID,
+		// stalled handshakes are closed, established connections are left
+		// to the idle timeout
+		HandshakeTimeout: settings.handshakeTimeout,
+	}
+	server, err := socks5.New(conf)
+	if err != nil {
+		return nil, fmt.Errorf("socks5.New failed: %v", err)
+	}
+	return &realm{
+		name:          name,
+		files:         files,
+		credentials:   credentials,
+		authenticator: suxx5,
+		server:        server,
+	}, nil
+}
+
+// reload reads the auth and destinations files of the realm again and
+// returns a summary of what changed. Nothing changes if either is invalid.
+func (r *realm) reload() (changes []string, err error) {
+	loaded, err := r.files.load()
+	if err != nil {
+		return nil, err
+	}
+
+	oldDestinations, oldDenies := r.authenticator.Destinations()
+	if err := r.authenticator.SetDestinations(loaded.destinations, loaded.denies); err != nil {
+		return nil, err
+	}
+	oldPasswordHashes := r.credentials.passwordHashes()
+	r.credentials.setHtpasswd(loaded.passwordHashes)
+
+	changes = append(changes, diffPasswordHashes(oldPasswordHashes, loaded.passwordHashes)...)
+	changes = append(changes, diffDestinations("destinations", oldDestinations, loaded.destinations)...)
+	changes = append(changes, diffDestinations("denies", oldDenies, loaded.denies)...)
+	return changes, nil
+}
+
+// realmRouter hands connections to the realm matching their TLS SNI
+type realmRouter struct {
+	log       *zap.Logger
+	padding   bool
+	tlsConfig *tls.Config
+	// mux serves clients multiplexing connections along with plain ones
+	mux bool
+	// muxMaxStreams caps the open streams of a session, 0 is unlimited
+	muxMaxStreams int
+	// muxIdleTimeout closes sessions without open streams for as long, 0
+	// keeps them open
+	muxIdleTimeout time.Duration
+	// handshakeTimeout bounds the tls handshake, 0 means unbounded
+	handshakeTimeout time.Duration
+	// certificate is reloaded along with the realms
+	certificate *certificateHolder
+	// proxyProtocol reads the client address from trusted proxies, nil
+	// disables it
+	proxyProtocol *proxyProtocol
+	// ipRate limits the rate connections are accepted per source ip, nil
+	// means unlimited
+	ipRate *ipRateLimit
+	// conns caps the connections served at once, nil means unlimited
+	conns *connLimit
+	// probes rejects non TLS clients, nil lets them fail the handshake
+	probes *probeFilter
+	// realms by name, the default realm is named ""
+	realms map[string]*realm
+	bySNI  map[string]*realm
+	audit  *reloadAudit
+	// quotas are reported by the admin api, nil if disabled
+	quotas *quotas
+	// reloading serializes reloads
+	reloading sync.Mutex
+	// listeners and active connections, closed on shutdown
+	connsLock sync.Mutex
+	listeners []net.Listener
+	active    map[net.Conn]struct{}
+	draining  sync.WaitGroup
+}
+
+func newRealmRouter(log *zap.Logger, padding bool) *realmRouter {
+	return &realmRouter{
+		log:     log,
+		padding: padding,
+		realms:  map[string]*realm{},
+		bySNI:   map[string]*realm{},
+		audit:   newReloadAudit(log),
+		active:  map[net.Conn]struct{}{},
+	}
+}
+
+func (r *realmRouter) add(realm *realm, sniNames []string) error {
+	if _, ok := r.realms[realm.name]; ok {
+		return fmt.Errorf("duplicate realm %q", realm.name)
+	}
+	r.realms[realm.name] = realm
+	for _, sni := range sniNames {
+		sni = strings.ToLower(sni)
+		if other, ok := r.bySNI[sni]; ok {
+			return fmt.Errorf("sni %q used by realms %q and %q", sni, other.name, realm.name)
+		}
+		r.bySNI[sni] = realm
+	}
+	return nil
+}
+
+// serve accepts tcp connections from listener and serves them over TLS,
+// connections without a matching SNI go to the fallback realm
+func (r *realmRouter) serve(listener net.Listener, fallback *realm) error {
+	r.addListener(listener)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		// connections with a proxy protocol header are limited by the
+		// client address it carries in serveConn
+		if !r.proxyProtocol.expects(conn) && !r.ipRate.allow(conn) {
+			continue
+		}
+		go func() {
+			// waiting for a slot must not hold up accepting other clients
+			if !r.conns.acquire(conn) {
+				return
+			}
+			defer r.conns.release()
+			defer r.track(conn)()
+			r.serveConn(conn, fallback)
+		}()
+	}
+}
+
+func (r *realmRouter) serveConn(conn net.Conn, fallback *realm) {
+	if r.proxyProtocol.expects(conn) {
+		if conn = r.proxyProtocol.accept(conn); conn == nil || !r.ipRate.allow(conn) {
+			return
+		}
+	}
+	if conn = r.probes.filter(conn); conn == nil {
+		return
+	}
+	if r.handshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(r.handshakeTimeout))
+	}
+	tlsConn := tls.Server(conn, r.tlsConfig)
+	conn = tlsConn
+
+	realm := fallback
+	if len(r.bySNI) > 0 {
+		if err := tlsConn.Handshake(); err != nil {
+			r.log.Debug("tls handshake failed", zap.Error(err), zap.String("from", conn.RemoteAddr().String()))
+			util.SilentClose(conn)
+			return
+		}
+		if sniRealm, ok := r.bySNI[strings.ToLower(tlsConn.ConnectionState().ServerName)]; ok {
+			realm = sniRealm
+		}
+	}
+	if r.padding {
+		conn = util.NewPaddedConn(conn)
+	}
+	if conn = r.acceptMux(conn, realm); conn == nil {
+		return
+	}
+	_ = realm.server.ServeConn(conn)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"server-socks/policy"
+
+	"go.uber.org/zap"
+)
+
+// reloadAuditSize is how many reload events the admin api keeps
+const reloadAuditSize = 50
+
+// what a reloadEvent reloaded
+const (
+	reloadConfigRealm       = "auth and destinations"
+	reloadConfigCertificate = "tls certificate"
+)
+
+// reloadEvent records one configuration reload
+type reloadEvent struct {
+	Time   time.Time `json:"time"`
+	Config string    `json:"config"`
+	// Realm the auth and destinations were reloaded for
+	Realm string `json:"realm"`
+	// Trigger is what caused the reload like "signal SIGHUP" or "api 10.0.0.1"
+	Trigger string   `json:"trigger"`
+	Success bool     `json:"success"`
+	Changes []string `json:"changes"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// reloadAudit logs reload events and keeps the last ones for the admin api
+type reloadAudit struct {
+	log    *zap.Logger
+	lock   sync.Mutex
+	events []reloadEvent
+}
+
+func newReloadAudit(log *zap.Logger) *reloadAudit {
+	return &reloadAudit{log: log}
+}
+
+func (a *reloadAudit) record(event reloadEvent) {
+	fields := []zap.Field{
+		zap.String("config", event.Config),
+		zap.String("realm", event.Realm),
+		zap.String("trigger", event.Trigger),
+		zap.Bool("success", event.Success),
+		zap.Strings("changes", event.Changes),
+	}
+	if event.Success {
+		a.log.Info("config reloaded", fields...)
+	} else {
+		a.log.Warn("config reload failed", append(fields, zap.String("error", event.Error))...)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.events = append(a.events, event)
+	if len(a.events) > reloadAuditSize {
+		a.events = a.events[len(a.events)-reloadAuditSize:]
+	}
+}
+
+// last returns the recorded events, oldest first
+func (a *reloadAudit) last() []reloadEvent {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return append([]reloadEvent{}, a.events...)
+}
+
+// reload reloads every realm and the certificate, recording an event for
+// each
+func (r *realmRouter) reload(trigger string) {
+	r.reloading.Lock()
+	defer r.reloading.Unlock()
+	names := make([]string, 0, len(r.realms))
+	for name := range r.realms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		event := reloadEvent{Time: time.Now(), Config: reloadConfigRealm, Realm: name, Trigger: trigger, Changes: []string{}}
+		changes, err := r.realms[name].reload()
+		if err != nil {
+			event.Error = err.Error()
+		} else {
+			event.Success = true
+			event.Changes = append(event.Changes, changes...)
+		}
+		r.audit.record(event)
+	}
+	r.certificate.reload(trigger)
+}
+
+// diffPasswordHashes summarizes added, removed and changed users, without
+// revealing any hashes
+func diffPasswordHashes(old, new map[string]string) []string {
+	added, removed, changed := []string{}, []string{}, []string{}
+	for user, hash := range new {
+		if oldHash, ok := old[user]; !ok {
+			added = append(added, user)
+		} else if oldHash != hash {
+			changed = append(changed, user)
+		}
+	}
+	for user := range old {
+		if _, ok := new[user]; !ok {
+			removed = append(removed, user)
+		}
+	}
+	return summarizeDiff("users", added, removed, changed)
+}
+
+func diffDestinations(kind string, old, new map[string]*policy.Destination) []string {
+	added, removed, changed := []string{}, []string{}, []string{}
+	for name, destination := range new {
+		if oldDestination, ok := old[name]; !ok {
+			added = append(added, name)
+		} else if !sameConfig(oldDestination, destination) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	return summarizeDiff(kind, added, removed, changed)
+}
+
+// sameConfig compares the configured, exported fields of a and b
+func sameConfig(a, b interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && string(aJSON) == string(bJSON)
+}
+
+func summarizeDiff(kind string, added, removed, changed []string) []string {
+	summary := []string{}
+	for _, diff := range []struct {
+		what  string
+		names []string
+	}{{"added", added}, {"removed", removed}, {"changed", changed}} {
+		if len(diff.names) > 0 {
+			sort.Strings(diff.names)
+			summary = append(summary, kind+" "+diff.what+": "+strings.Join(diff.names, ", "))
+		}
+	}
+	return summary
+}
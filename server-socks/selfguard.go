@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"server-socks/policy"
+	"socks5"
+
+	"go.uber.org/zap"
+)
+
+// selfAddrs knows the addresses the server can be reached at and the local
+// addresses of the connections it dialed, to tell requests looping back
+// into the server
+type selfAddrs struct {
+	lock     sync.RWMutex
+	listen   []*net.TCPAddr
+	localIPs []net.IP
+	outbound map[string]struct{}
+}
+
+func newSelfAddrs() (*selfAddrs, error) {
+	interfaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	s := &selfAddrs{outbound: map[string]struct{}{}}
+	for _, interfaceAddr := range interfaceAddrs {
+		if ipNet, ok := interfaceAddr.(*net.IPNet); ok {
+			s.localIPs = append(s.localIPs, ipNet.IP)
+		}
+	}
+	return s, nil
+}
+
+// add registers an address the server listens on or is advertised at,
+// unspecified ips like 0.0.0.0 stand for all local ips
+func (s *selfAddrs) add(addr *net.TCPAddr) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.listen = append(s.listen, addr)
+}
+
+// isSelf tells if ip and port reach the server itself
+func (s *selfAddrs) isSelf(ip net.IP, port int) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, addr := range s.listen {
+		if addr.Port != port {
+			continue
+		}
+		if addr.IP.Equal(ip) || (addr.IP == nil || addr.IP.IsUnspecified()) && s.isLocalIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *selfAddrs) isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, localIP := range s.localIPs {
+		if localIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveTCPAddrs resolves a host:port to an address per ip of the host
+func resolveTCPAddrs(hostPort string) ([]*net.TCPAddr, error) {
+	host, portString, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort("tcp", portString)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]*net.TCPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, &net.TCPAddr{IP: ip, Port: port})
+	}
+	return addrs, nil
+}
+
+// track remembers the local address of an outbound connection until it is
+// closed
+func (s *selfAddrs) track(conn net.Conn) net.Conn {
+	if s == nil {
+		return conn
+	}
+	localAddr := conn.LocalAddr().String()
+	s.lock.Lock()
+	s.outbound[localAddr] = struct{}{}
+	s.lock.Unlock()
+	return &trackedConn{Conn: conn, self: s, localAddr: localAddr}
+}
+
+// isOutbound tells if a client connects from one of our outbound connections
+func (s *selfAddrs) isOutbound(addr *socks5.AddrSpec) bool {
+	if addr == nil {
+		return false
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	_, ok := s.outbound[addr.Address()]
+	return ok
+}
+
+type trackedConn struct {
+	net.Conn
+	self      *selfAddrs
+	localAddr string
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.self.lock.Lock()
+		delete(c.self.outbound, c.localAddr)
+		c.self.lock.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// CloseWrite keeps half closing working for wrapped tcp connections
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// selfGuard wraps a socks5.RuleSet and denies requests to the server itself
+// and requests arriving over connections the server dialed, which would make
+// it proxy to itself in a loop
+type selfGuard struct {
+	log   *zap.Logger
+	rules socks5.RuleSet
+	self  *selfAddrs
+}
+
+func newSelfGuard(log *zap.Logger, rules socks5.RuleSet, self *selfAddrs) *selfGuard {
+	return &selfGuard{log: log, rules: rules, self: self}
+}
+
+func (g *selfGuard) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if g.self.isSelf(req.DestAddr.IP, req.DestAddr.Port) {
+		g.log.Warn(
+			"denied - connection to the proxy itself",
+			zap.String("to", req.DestAddr.String()),
+			zap.String("for", req.AuthContext.Payload["Username"]),
+			zap.String("from", policy.SourceIP(req)),
+		)
+		return ctx, false
+	}
+	if g.self.isOutbound(req.RemoteAddr) {
+		g.log.Warn(
+			"denied - connection loop",
+			zap.String("to", req.DestAddr.String()),
+			zap.String("for", req.AuthContext.Payload["Username"]),
+			zap.String("from", req.RemoteAddr.Address()),
+		)
+		return ctx, false
+	}
+	return g.rules.Allow(ctx, req)
+}
+
+func (g *selfGuard) Release(ctx context.Context, req *socks5.Request) {
+	if r, ok := g.rules.(socks5.RuleReleaser); ok {
+		r.Release(ctx, req)
+	}
+}
@@ -1,215 +1,579 @@
-package main
-
-import (
-	"context"
-	"crypto/tls"
-	"flag"
-	"io/ioutil"
-	"net"
-	"time"
-	"util"
-
-	"socks5"
-
-	"github.com/foomo/htpasswd"
-	"github.com/patrickmn/go-cache"
-	"github.com/spaolacci/murmur3"
-	"go.uber.org/zap"
-	"golang.org/x/crypto/bcrypt"
-	"gopkg.in/yaml.v2"
-)
-
-type Destination struct {
-	Users []string
-	Ports []int
-}
-
-func main() {
-
-	log, _ := zap.NewProduction()
-	defer log.Sync()
-
-	flagAddr := flag.String("addr", "0.0.0.0:8000", "where to listen like 127.0.0.1:8000")
-	flagHtpasswdFile := flag.String("auth", "./users.htpasswd", "basic auth file")
-	flagDestinationsFile := flag.String("destinations", "destinations.yaml", "file with destinations config")
-	flagCert := flag.String("cert", "certificate.crt", "path to server cert.pem")
-	flagKey := flag.String("key", "certificate.key", "path to server key.pem")
-	flagDisableBasicAuthCaching := flag.Bool("disable-basic-auth-caching", false, "if set disables caching of basic auth user and password")
-	flag.Parse()
-
-	destinationBytes, err := ioutil.ReadFile(*flagDestinationsFile)
-	util.TryFatal(log, err, "can not read destinations config")
-
-	destinations := map[string]*Destination{}
-
-	util.TryFatal(log, yaml.Unmarshal(destinationBytes, destinations), "can not parse destinations")
-
-	passwordHashes, err := htpasswd.ParseHtpasswdFile(*flagHtpasswdFile)
-	util.TryFatal(log, err, "basic auth file sucks")
-	credentials := Credentials{disableCaching: *flagDisableBasicAuthCaching, htpasswd: passwordHashes}
-
-	suxx5, err := newAuthenticator(log, destinations)
-	util.TryFatal(log, err, "newAuthenticator failed")
-
-	autenticator := socks5.UserPassAuthenticator{Credentials: credentials}
-
-	conf := &socks5.Config{
-		Rules:       suxx5,
-		AuthMethods: []socks5.Authenticator{autenticator},
-	}
-	server, err := socks5.New(conf)
-	util.TryFatal(log, err, "socks5.New failed")
-
-	log.Info(
-		"starting tls server",
-		zap.String("addr", *flagAddr),
-		zap.String("cert", *flagCert),
-		zap.String("key", *flagKey),
-	)
-
-	cert, err := tls.LoadX509KeyPair(*flagCert, *flagKey)
-	util.TryFatal(log, err, "could not load server key pair")
-
-	listener, err := tls.Listen("tcp", *flagAddr, &tls.Config{Certificates: []tls.Certificate{cert}})
-	util.TryFatal(log, err, "could not listen for tcp / tls", zap.String("addr", *flagAddr))
-
-	util.TryFatal(log, server.Serve(listener), "server failed")
-}
-
-const defaultBasicAuthTTL = 90 * time.Second
-
-var basicAuthCache = cache.New(120*time.Second, 60*time.Minute)
-
-type Credentials struct {
-	disableCaching bool
-	htpasswd       map[string]string
-}
-
-func (s Credentials) Valid(user, password string) bool {
-	hashedPW := s.htpasswd[user]
-	hashedPWb := []byte(hashedPW)
-	plainPWb := []byte(password)
-
-	if s.disableCaching {
-		return nil == bcrypt.CompareHashAndPassword(hashedPWb, plainPWb)
-	}
-
-	hasher := murmur3.New64()
-
-	cachedPass, inCache := basicAuthCache.Get(hashedPW)
-	if !inCache {
-		ok := nil == bcrypt.CompareHashAndPassword(hashedPWb, plainPWb)
-		if !ok {
-			return false
-		}
-
-		hasher.Write(plainPWb)
-		basicAuthCache.Set(hashedPW, string(hasher.Sum(nil)), defaultBasicAuthTTL)
-		return true
-	}
-
-	hasher.Write(plainPWb)
-	if cachedPass.(string) != string(hasher.Sum(nil)) {
-		return nil == bcrypt.CompareHashAndPassword(hashedPWb, plainPWb)
-	}
-
-	return true
-}
-
-type authenticator struct {
-	log           *zap.Logger
-	Destinations  map[string]*Destination
-	resolvedNames map[string][]string
-}
-
-func newAuthenticator(log *zap.Logger, destinations map[string]*Destination) (*authenticator, error) {
-	sa := &authenticator{
-		log:          log,
-		Destinations: destinations,
-	}
-	names := make([]string, 0, len(destinations))
-	for name := range destinations {
-		names = append(names, name)
-	}
-
-	resolvedNames, err := resolveNames(names)
-	if err != nil {
-		return nil, err
-	}
-	sa.resolvedNames = resolvedNames
-
-	go func() {
-		time.Sleep(time.Second * 10)
-
-		resolvedNames, err := resolveNames(names)
-		if err == nil {
-			sa.resolvedNames = resolvedNames
-		} else {
-			log.Warn("could not resolve names", zap.Error(err))
-		}
-	}()
-	return sa, nil
-}
-
-func resolveNames(names []string) (map[string][]string, error) {
-	newResolvedNames := map[string][]string{}
-	for _, name := range names {
-		addrs, err := net.LookupHost(name)
-		if err != nil {
-			return nil, err
-		}
-		newResolvedNames[name] = addrs
-	}
-	return newResolvedNames, nil
-}
-
-func (sa *authenticator) Allow(ctx context.Context, req *socks5.Request) (newCtx context.Context, allowed bool) {
-	allowed = false
-	newCtx = ctx
-	zapTo := zap.String("to", req.DestAddr.String())
-	zapUser := zap.String("for", req.AuthContext.Payload["Username"])
-
-	for name, ips := range sa.resolvedNames {
-		zapName := zap.String("name", name)
-		for _, ip := range ips {
-			if ip == req.DestAddr.IP.String() {
-				destination, destinationOK := sa.Destinations[name]
-				if destinationOK {
-					for _, allowedPort := range destination.Ports {
-						if allowedPort == req.DestAddr.Port {
-							if len(destination.Users) == 0 {
-								allowed = true
-							}
-							if !allowed {
-								userNameInContext, userNameInContextOK := req.AuthContext.Payload["Username"]
-								if !userNameInContextOK {
-									// explicit user expected, but not found
-									sa.log.Info("denied - no user found", zapName, zapTo)
-									return
-								}
-								for _, userName := range destination.Users {
-									if userName == userNameInContext {
-										allowed = true
-										break
-									}
-								}
-								if !allowed {
-									sa.log.Info("denied", zapName, zapTo, zapUser)
-									return
-								}
-							}
-							if allowed {
-								sa.log.Info("allowed", zapName, zapTo, zapUser)
-
-								allowed = true
-								return
-							}
-						}
-					}
-				}
-			}
-		}
-	}
-	sa.log.Info("denied", zapTo, zapUser)
-	return
-}
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"util"
+
+	"server-socks/policy"
+
+	"github.com/GehirnInc/crypt/apr1_crypt"
+	"github.com/patrickmn/go-cache"
+	"github.com/spaolacci/murmur3"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+func main() {
+	flagConfig := flag.String("config", "", "yaml file with addr, users mapping names to bcrypt hashes, destinations, cert, key and clientca, overriding -addr, -auth, -destinations, -cert, -key and -client-ca")
+	flagAddr := flag.String("addr", "0.0.0.0:8000", "where to listen like 127.0.0.1:8000, comma separated to listen on several addresses like 10.0.0.1:8000,[fd00::1]:8000")
+	flagHtpasswdFile := flag.String("auth", "./users.htpasswd", "basic auth file")
+	flagUsersFile := flag.String("users-file", "", "yaml file with users by name, each with its bcrypt hash and the destinations it may reach in addition, instead of -auth, only destinations with users or groups may be listed as those without are open to every user anyway")
+	flagDestinationsFile := flag.String("destinations", "destinations.yaml", "file with destinations config")
+	flagCert := flag.String("cert", "certificate.crt", "path to server cert.pem")
+	flagKey := flag.String("key", "certificate.key", "path to server key.pem")
+	flagACMEDomains := flag.String("acme-domains", "", "comma separated domains to obtain and renew certificates for from let's encrypt using the tls-alpn-01 challenge, -cert and -key are ignored then")
+	flagACMECacheDir := flag.String("acme-cache-dir", "acme-cache", "directory acme account keys and certificates are cached in")
+	flagACMEEmail := flag.String("acme-email", "", "optional contact email for the acme account")
+	flagDisableBasicAuthCaching := flag.Bool("disable-basic-auth-caching", false, "if set disables caching of basic auth user and password")
+	flagAuthCacheMaxUsers := flag.Int("auth-cache-max-users", 0, "max distinct users in the basic auth cache, least recently used ones are evicted first, 0 means unlimited")
+	flagAuthMaxFailures := flag.Int("auth-max-failures", 0, "failed authentications per source ip within -auth-failure-window before it is locked out, 0 disables the lockout")
+	flagAuthFailureWindow := flag.Duration("auth-failure-window", time.Minute, "window in which failed authentications are counted")
+	flagAuthLockout := flag.Duration("auth-lockout", 5*time.Minute, "how long a source ip stays locked out")
+	flagMaxConnsPerUser := flag.Int("max-conns-per-user", 0, "max concurrent connections per authenticated user, udp associations count as one each, 0 means unlimited")
+	flagMaxConns := flag.Int("max-conns", 0, "max client connections served at once across all listeners, further ones are closed right after being accepted, 0 means unlimited")
+	flagMaxConnsWait := flag.Duration("max-conns-wait", 0, "how long a connection accepted at -max-conns waits for a slot before it is closed")
+	flagDialTimeout := flag.Duration("dial-timeout", 10*time.Second, "timeout dialing destinations, unreachable ones fail after it, 0 waits for the os")
+	flagKeepAlive := flag.Duration("keepalive", 30*time.Second, "tcp keepalive period of connections to destinations, negative disables it")
+	flagIdleTimeout := flag.Duration("idle-timeout", 0, "close proxied connections without traffic in either direction for as long, 0 keeps idle connections open")
+	flagFirstByteTimeout := flag.Duration("first-byte-timeout", 0, "close proxied connections no traffic went through in either direction for as long after they were established, unlike -idle-timeout only until the first bytes, 0 waits forever")
+	flagConnRate := flag.Float64("conn-rate", 0, "connections per second accepted from each source ip, further ones are closed right after being accepted, 0 means unlimited")
+	flagConnBurst := flag.Int("conn-burst", 10, "connections a source ip may open at once before -conn-rate applies")
+	flagConnRateExempt := flag.String("conn-rate-exempt", "", "comma separated ips or cidrs not limited by -conn-rate")
+	flagMaxActiveConns := flag.Int("max-active-conns", 0, "max connections served at once, further ones wait for a slot handed out by user tier from -user-limits, 0 means unlimited")
+	flagConnQueueSize := flag.Int("conn-queue-size", 100, "max connections waiting for a slot with -max-active-conns, when full the lowest tier waiter is shed")
+	flagConnQueueTimeout := flag.Duration("conn-queue-timeout", 10*time.Second, "how long a connection waits for a slot with -max-active-conns before it is shed")
+	flagGeoIPDB := flag.String("geoip-db", "", "maxmind db like GeoLite2-Country.mmdb locating destination ips for allowcountries and denycountries, loaded once at startup")
+	flagTestPolicy := flag.String("test-policy", "", `print whether a user may reach host:port like "jan example.com:443" with the destinations of the default realm, and the rule deciding it, then exit with 0 if allowed and 1 if denied`)
+	flagAllowAll := flag.Bool("allow-all", false, "INSECURE: allow every request of authenticated clients regardless of the destinations, deny rules still apply, needs -require-basic-auth, for smoke testing only")
+	flagRequireBasicAuth := flag.Bool("require-basic-auth", true, "require basic auth, if false clients without credentials may connect to destinations without users")
+	flagEnableSOCKS4 := flag.Bool("enable-socks4", false, "accept socks4 and 4a clients, which can not authenticate and are denied unless -require-basic-auth=false, they are served as clients without a user")
+	flagSOCKS4TrustUserID := flag.Bool("socks4-trust-userid", false, "INSECURE: let the unverified userid socks4 clients send count as their user, so any client can claim the destinations of any user, needs -enable-socks4 and -require-basic-auth=false")
+	flagUDPAssociate := flag.Bool("udp-associate", false, "enable udp associate, every datagram destination is checked against the destinations")
+	flagEnableBind := flag.Bool("enable-bind", false, "enable the bind command listening for one inbound connection on behalf of the client, the request and the peer that connects are checked against the destinations")
+	flagUpgradeBcryptCost := flag.Int("upgrade-bcrypt-cost", 0, "on login rehash passwords stored with a weaker hash than bcrypt at this cost and write them back to the htpasswd file, which has to be writable, 0 disables")
+	flagResolveWorkers := flag.Int("resolve-workers", 8, "number of destination names looked up at once")
+	flagResolveWait := flag.Duration("resolve-wait", 0, "how long to retry destination names failing to resolve at startup, like while the network comes up, before serving, 0 starts right away")
+	flagRequireResolved := flag.Bool("require-resolved", false, "exit if destination names still fail to resolve after -resolve-wait instead of starting with them matching nothing until they resolve")
+	flagDecisionCacheTTL := flag.Duration("decision-cache-ttl", 0, "how long allow and deny decisions are cached by user, destination and port, the cache is dropped when destinations or their addresses change, 0 disables it")
+	flagResolveTTL := flag.Bool("resolve-ttl", false, "resolve destination names again when their dns records expire, querying the nameservers of /etc/resolv.conf, instead of every 10s")
+	flagDoHURL := flag.String("doh-url", "", "resolve destination names with this DNS-over-HTTPS endpoint like https://dns.example.com/dns-query instead of the system resolver, names are resolved again when their records expire")
+	flagRateLimit := flag.Int64("rate-limit", 0, "default bandwidth per connection, and per destination of an udp association, in bytes per second, 0 means unlimited")
+	flagQuotaBytes := flag.Int64("quota-bytes", 0, "bytes every authenticated user may transfer per -quota-reset period before new connections are denied, user limits may set their own quota, 0 means unlimited")
+	flagQuotaReset := flag.String("quota-reset", quotaResetDaily, "when the quota usage is reset, at local midnight daily, on mondays weekly or on the first of the month monthly")
+	flagQuotaFile := flag.String("quota-file", "", "file the quota usage is saved to every minute and on shutdown and read from on startup, empty keeps it in memory only")
+	flagUserLimitsFile := flag.String("user-limits", "", "optional file with per user bandwidth limits and schedules")
+	flagPrometheusAddr := flag.String("prometheus-addr", "", "where to serve prometheus metrics like :9201, disabled if empty")
+	flagAdminAddr := flag.String("admin-addr", "", "where to serve the admin api like 127.0.0.1:8090, disabled if empty")
+	flagHealthAddr := flag.String("health-addr", "", "where to serve /healthz, /readyz and the effective policy as json on /policy like :8091, disabled if empty. /policy is not authenticated, anyone reaching the address reads the destinations and users allowed, -admin-addr serves it as well")
+	flagRealmsFile := flag.String("realms", "", "optional file with additional realms, each with its own auth and destinations")
+	metricLabels := util.MetricLabels{}
+	flag.Var(metricLabels, "metric-label", "constant label added to all metrics like region=eu, may be repeated or comma separated")
+	flagPadding := flag.Bool("padding", false, "chunk and pad tunneled traffic into fixed size frames, clients have to use -padding too")
+	flagAdvertiseAddrs := flag.String("advertise-addrs", "", "comma separated extra addresses the server is reachable at like proxy.example.com:8000, requests to them are denied like to the listen addresses")
+	flagReusePort := flag.Bool("reuse-port", false, "set SO_REUSEPORT on listeners so several processes can share a port, linux, bsd and macos only")
+	flagListenBacklog := flag.Int("listen-backlog", 0, "accept backlog of listeners capped by the os limit like net.core.somaxconn, 0 keeps the default, linux, bsd and macos only")
+	flagTLSMinVersion := flag.String("tls-min-version", "1.2", "min tls version accepted from clients, one of 1.0, 1.1, 1.2 or 1.3")
+	flagTLSCiphers := flag.String("tls-ciphers", "", "comma separated cipher suites accepted for tls 1.2 and below like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, empty keeps the go defaults")
+	flagHandshakeTimeout := flag.Duration("handshake-timeout", 30*time.Second, "how long clients may take for the tls handshake and then for the socks5 handshake up to an established connection before they are closed, 0 waits forever")
+	flagMux := flag.Bool("mux", false, "accept clients using -mux, which carry many connections over a single tls connection, clients without -mux are still served")
+	flagMuxMaxStreams := flag.Int("mux-max-streams", 64, "how many streams a -mux session may have open at once, further ones are reset, a session counts once against -max-conns however many streams it has, 0 is unlimited")
+	flagMuxIdleTimeout := flag.Duration("mux-idle-timeout", time.Minute, "close -mux sessions without open streams for as long, 0 keeps them open")
+	flagALPN := flag.String("alpn", "", "comma separated alpn protocols like socks5-tls offered to clients, handshakes negotiating none of them are rejected, empty accepts any")
+	flagClientCA := flag.String("client-ca", "", "file with the ca certificates client certificates are verified against, clients without one are still accepted unless -require-client-cert")
+	flagRequireClientCert := flag.Bool("require-client-cert", false, "only complete tls handshakes with clients presenting a certificate signed by -client-ca, basic auth still applies on top")
+	flagAcceptProxyProtocol := flag.Bool("accept-proxy-protocol", false, "require a proxy protocol v1 or v2 header giving the client address from every connection, for servers only reachable through a load balancer sending them, connections without one are closed")
+	flagProxyProtocolFrom := flag.String("proxy-protocol-from", "", "comma separated ips or cidrs of proxies like middle-proxy -proxy-protocol, connections from them have to start with a proxy protocol v1 or v2 header giving the client address")
+	flagRejectPlaintext := flag.Bool("reject-plaintext", false, "close connections not starting with a tls handshake right away, instead of failing their handshake")
+	flagPlaintextResponse := flag.String("plaintext-response", "", `written to rejected plaintext clients before closing like "HTTP/1.1 400 Bad Request\r\n\r\n" with -reject-plaintext, go escapes are interpreted`)
+	flagLogLevel := flag.String("log-level", "info", "log level, one of debug, info, warn or error")
+	flagShutdownGrace := flag.Duration("shutdown-grace", 30*time.Second, "how long to wait for active connections to end on SIGINT or SIGTERM before closing them")
+	flagLogAllowed := flag.Bool("log-allowed", true, "log a line per allowed request, if false only denials and errors are logged while the access log still records allowed requests")
+	flagLogFile := flag.String("log-file", "", "file to append logs to instead of stderr")
+	flagAccessLog := flag.String("access-log", "", "file to append a json line per request to, with user, destination, decision, bytes and duration, reopened on SIGHUP")
+	flagVersion := flag.Bool("version", false, "print the version and exit")
+	util.ParseFlags()
+	if *flagVersion {
+		fmt.Println(util.VersionString("server-socks"))
+		os.Exit(0)
+	}
+
+	log, err := util.NewLogger(*flagLogLevel, *flagLogFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "can not create logger:", err)
+		os.Exit(2)
+	}
+	defer log.Sync()
+
+	if *flagConfig != "" {
+		config, err := loadServerConfig(*flagConfig)
+		util.TryFatal(log, err, "invalid config", zap.String("file", *flagConfig))
+		overrideFlag(flagAddr, config.Addr)
+		overrideFlag(flagCert, config.Cert)
+		overrideFlag(flagKey, config.Key)
+		overrideFlag(flagClientCA, config.ClientCA)
+	}
+
+	if *flagUsersFile != "" {
+		if flagGiven("auth") {
+			log.Fatal("-auth and -users-file are mutually exclusive")
+		}
+		*flagHtpasswdFile = ""
+	}
+	defaultFiles := realmFiles{htpasswd: *flagHtpasswdFile, users: *flagUsersFile, destinations: *flagDestinationsFile, config: *flagConfig}
+	var geo *policy.GeoIP
+	if *flagGeoIPDB != "" {
+		geo, err = policy.OpenGeoIP(*flagGeoIPDB)
+		util.TryFatal(log, err, "can not open geoip db", zap.String("file", *flagGeoIPDB))
+	}
+	var resolver policy.Resolver
+	if *flagDoHURL != "" {
+		resolver, err = policy.NewDoHLookup(*flagDoHURL)
+		util.TryFatal(log, err, "invalid -doh-url")
+	} else if *flagResolveTTL {
+		resolver, err = policy.NewDNSLookup(policy.ResolvConf)
+		util.TryFatal(log, err, "can not set up ttl aware resolution")
+	}
+	// the policy is tested before anything of the server is set up, so
+	// nothing is served, started or recorded
+	if *flagTestPolicy != "" {
+		testSettings := &realmSettings{allowAll: *flagAllowAll, resolver: resolver, resolveWorkers: *flagResolveWorkers, geo: geo}
+		allowed, err := runTestPolicy(log, os.Stdout, defaultFiles, testSettings, *flagTestPolicy)
+		util.TryFatal(log, err, "can not test policy")
+		if !allowed {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	util.RegisterMetrics(metricLabels)
+
+	serverHealth := &health{}
+	if *flagHealthAddr != "" {
+		go runHealthHandler(context.Background(), log, *flagHealthAddr, serverHealth)
+	}
+
+	self, err := newSelfAddrs()
+	util.TryFatal(log, err, "can not list local addresses")
+	for _, advertiseAddr := range splitList(*flagAdvertiseAddrs) {
+		addrs, err := resolveTCPAddrs(advertiseAddr)
+		util.TryFatal(log, err, "can not resolve advertise address", zap.String("addr", advertiseAddr))
+		for _, addr := range addrs {
+			self.add(addr)
+		}
+	}
+
+	dialer := &dialer{
+		log:              log,
+		rateLimit:        *flagRateLimit,
+		self:             self,
+		net:              net.Dialer{Timeout: *flagDialTimeout, KeepAlive: *flagKeepAlive},
+		idleTimeout:      *flagIdleTimeout,
+		firstByteTimeout: *flagFirstByteTimeout,
+	}
+	userLimits := map[string]*UserLimit{}
+	if *flagUserLimitsFile != "" {
+		userLimitsBytes, err := ioutil.ReadFile(*flagUserLimitsFile)
+		util.TryFatal(log, err, "can not read user limits config")
+		util.TryFatal(log, yaml.Unmarshal(userLimitsBytes, userLimits), "can not parse user limits")
+
+		dialer.userRateLimiter, err = newUserRateLimiter(userLimits)
+		util.TryFatal(log, err, "invalid user limits")
+	}
+	if *flagQuotaBytes > 0 || hasQuota(userLimits) {
+		dialer.quotas, err = newQuotas(log, *flagQuotaFile, *flagQuotaReset, *flagQuotaBytes, userLimits)
+		util.TryFatal(log, err, "invalid quotas")
+		go dialer.quotas.run(context.Background())
+	}
+
+	settings := &realmSettings{
+		disableBasicAuthCaching: *flagDisableBasicAuthCaching,
+		authCacheMaxUsers:       *flagAuthCacheMaxUsers,
+		maxConnsPerUser:         *flagMaxConnsPerUser,
+		udpAssociate:            *flagUDPAssociate,
+		bind:                    *flagEnableBind,
+		requireBasicAuth:        *flagRequireBasicAuth,
+		socks4:                  *flagEnableSOCKS4,
+		socks4TrustUserID:       *flagSOCKS4TrustUserID,
+		allowAll:                *flagAllowAll,
+		logAllowed:              *flagLogAllowed,
+		handshakeTimeout:        *flagHandshakeTimeout,
+		upgradeBcryptCost:       *flagUpgradeBcryptCost,
+		resolveWorkers:          *flagResolveWorkers,
+		resolveWait:             *flagResolveWait,
+		requireResolved:         *flagRequireResolved,
+		decisionCacheTTL:        *flagDecisionCacheTTL,
+		resolver:                resolver,
+		geo:                     geo,
+		dial:                    dialer.Dial,
+		bindConn:                dialer.BindConn,
+		datagram:                dialer.Datagram,
+		associate:               dialer.Associate,
+		quotas:                  dialer.quotas,
+		self:                    self,
+	}
+	if *flagAccessLog != "" {
+		settings.accessLog, err = openAccessLog(log, *flagAccessLog)
+		util.TryFatal(log, err, "can not open access log", zap.String("file", *flagAccessLog))
+	}
+	if *flagUpgradeBcryptCost != 0 && (*flagUpgradeBcryptCost < bcrypt.MinCost || *flagUpgradeBcryptCost > bcrypt.MaxCost) {
+		log.Fatal("invalid bcrypt cost", zap.Int("cost", *flagUpgradeBcryptCost), zap.Int("min", bcrypt.MinCost), zap.Int("max", bcrypt.MaxCost))
+	}
+	if *flagAllowAll {
+		if !*flagRequireBasicAuth {
+			log.Fatal("-allow-all needs -require-basic-auth, clients without credentials would reach everything")
+		}
+		log.Warn("INSECURE: -allow-all allows every request not denied regardless of the destinations")
+	}
+	if *flagSOCKS4TrustUserID {
+		if !*flagEnableSOCKS4 || *flagRequireBasicAuth {
+			log.Fatal("-socks4-trust-userid needs -enable-socks4 and -require-basic-auth=false")
+		}
+		log.Warn("INSECURE: -socks4-trust-userid lets socks4 clients claim any user")
+	}
+	if *flagEnableSOCKS4 && *flagRequireBasicAuth {
+		log.Warn("socks4 clients will be denied as basic auth is required")
+	}
+	if *flagMaxActiveConns > 0 {
+		settings.tierQueue = newTierQueue(log, *flagMaxActiveConns, *flagConnQueueSize, *flagConnQueueTimeout, userLimits)
+	}
+	if *flagAuthMaxFailures > 0 {
+		settings.authFailures = newAuthFailures(log, *flagAuthMaxFailures, *flagAuthFailureWindow, *flagAuthLockout)
+	}
+
+	router := newRealmRouter(log, *flagPadding)
+	router.quotas = dialer.quotas
+	router.mux = *flagMux
+	router.muxMaxStreams = *flagMuxMaxStreams
+	router.muxIdleTimeout = *flagMuxIdleTimeout
+	router.handshakeTimeout = *flagHandshakeTimeout
+	if *flagMaxConns > 0 {
+		router.conns = newConnLimit(log, *flagMaxConns, *flagMaxConnsWait)
+	}
+	if *flagConnRate > 0 {
+		router.ipRate, err = newIPRateLimit(log, *flagConnRate, *flagConnBurst, splitList(*flagConnRateExempt))
+		util.TryFatal(log, err, "invalid connection rate limit")
+	}
+	defaultRealm, err := newRealm(log, "", defaultFiles, settings)
+	util.TryFatal(log, err, "can not set up default realm")
+	util.TryFatal(log, router.add(defaultRealm, nil), "can not add default realm")
+
+	realmConfigs := map[string]*RealmConfig{}
+	if *flagRealmsFile != "" {
+		realmsBytes, err := ioutil.ReadFile(*flagRealmsFile)
+		util.TryFatal(log, err, "can not read realms config")
+		util.TryFatal(log, yaml.Unmarshal(realmsBytes, realmConfigs), "can not parse realms")
+	}
+	for name, realmConfig := range realmConfigs {
+		if name == "" {
+			log.Fatal("realms need a name")
+		}
+		realm, err := newRealm(log, name, realmFiles{htpasswd: realmConfig.Auth, users: realmConfig.Users, destinations: realmConfig.Destinations}, settings)
+		util.TryFatal(log, err, "can not set up realm", zap.String("realm", name))
+		util.TryFatal(log, router.add(realm, realmConfig.SNI), "can not add realm", zap.String("realm", name))
+	}
+
+	serverHealth.setRouter(router)
+
+	if *flagPrometheusAddr != "" {
+		go util.RunPrometheusHandler(context.Background(), log, *flagPrometheusAddr)
+	}
+	if *flagAdminAddr != "" {
+		go runAdminHandler(context.Background(), log, *flagAdminAddr, router)
+	}
+
+	if acmeDomains := splitList(*flagACMEDomains); len(acmeDomains) > 0 {
+		log.Info(
+			"starting tls server with acme certificates",
+			zap.Strings("addr", splitList(*flagAddr)),
+			zap.Strings("domains", acmeDomains),
+			zap.String("cache_dir", *flagACMECacheDir),
+		)
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(*flagACMECacheDir),
+			HostPolicy: autocert.HostWhitelist(acmeDomains...),
+			Email:      *flagACMEEmail,
+		}
+		router.tlsConfig = &tls.Config{
+			GetCertificate: manager.GetCertificate,
+			NextProtos:     []string{acme.ALPNProto},
+		}
+	} else {
+		log.Info(
+			"starting tls server",
+			zap.Strings("addr", splitList(*flagAddr)),
+			zap.String("cert", *flagCert),
+			zap.String("key", *flagKey),
+		)
+		router.certificate, err = newCertificateHolder(log, *flagCert, *flagKey, router.audit)
+		util.TryFatal(log, err, "could not load server key pair")
+		go router.certificate.watch()
+		router.tlsConfig = &tls.Config{GetCertificate: router.certificate.GetCertificate}
+	}
+	router.tlsConfig.MinVersion, err = util.ParseTLSVersion(*flagTLSMinVersion)
+	util.TryFatal(log, err, "invalid -tls-min-version")
+	router.tlsConfig.CipherSuites, err = util.ParseCipherSuites(*flagTLSCiphers)
+	util.TryFatal(log, err, "invalid -tls-ciphers")
+	if alpn := splitList(*flagALPN); len(alpn) > 0 {
+		requireALPN(router.tlsConfig, alpn)
+		log.Info("requiring alpn", zap.Strings("alpn", alpn))
+	}
+	if *flagClientCA != "" {
+		router.tlsConfig.ClientCAs, err = loadCertPool(*flagClientCA)
+		util.TryFatal(log, err, "can not load client ca", zap.String("file", *flagClientCA))
+		router.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if *flagRequireClientCert {
+		if *flagClientCA == "" {
+			log.Fatal("-require-client-cert needs -client-ca")
+		}
+		router.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		log.Info("requiring client certificates", zap.String("client_ca", *flagClientCA))
+	}
+
+	if proxies := splitList(*flagProxyProtocolFrom); len(proxies) > 0 {
+		router.proxyProtocol, err = newProxyProtocol(log, proxies)
+		util.TryFatal(log, err, "invalid -proxy-protocol-from")
+	}
+	if *flagAcceptProxyProtocol {
+		if router.proxyProtocol == nil {
+			router.proxyProtocol = &proxyProtocol{log: log}
+		}
+		router.proxyProtocol.all = true
+		log.Info("requiring proxy protocol headers from all connections")
+	}
+	if *flagPlaintextResponse != "" && !*flagRejectPlaintext {
+		log.Warn("-plaintext-response needs -reject-plaintext")
+	}
+	if *flagRejectPlaintext {
+		plaintextResponse, err := strconv.Unquote(`"` + *flagPlaintextResponse + `"`)
+		util.TryFatal(log, err, "invalid plaintext response")
+		router.probes = &probeFilter{log: log, response: []byte(plaintextResponse)}
+	}
+
+	if *flagPadding {
+		log.Info("padding tunneled traffic", zap.Int("frame_size", util.PaddedFrameSize))
+	}
+
+	// every address is bound before any is served, so startup fails as a
+	// whole if one of them can not be bound
+	listenOptions := util.ListenOptions{ReusePort: *flagReusePort, Backlog: *flagListenBacklog}
+	serves := []func(errCh chan<- error){}
+	listen := func(addr string, fallback *realm) {
+		listener, err := util.Listen(addr, listenOptions)
+		util.TryFatal(log, err, "could not listen for tcp / tls", zap.String("addr", addr))
+		if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok {
+			self.add(tcpAddr)
+		}
+		serves = append(serves, func(errCh chan<- error) {
+			errCh <- router.serve(listener, fallback)
+		})
+	}
+	addrs := splitList(*flagAddr)
+	if len(addrs) == 0 {
+		log.Fatal("-addr lists no address to listen on")
+	}
+	for _, addr := range addrs {
+		listen(addr, defaultRealm)
+	}
+	for name, realmConfig := range realmConfigs {
+		for _, addr := range splitList(realmConfig.Addr) {
+			log.Info("starting tls server for realm", zap.String("realm", name), zap.String("addr", addr))
+			listen(addr, router.realms[name])
+		}
+	}
+	errCh := make(chan error, len(serves))
+	for _, serve := range serves {
+		go serve(errCh)
+	}
+
+	serverHealth.setListening()
+	ctx := util.CtxCancelOnOsSignal(log)
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := settings.accessLog.reopen(); err != nil {
+				log.Error("can not reopen access log", zap.String("file", *flagAccessLog), zap.Error(err))
+			}
+			router.reload("signal SIGHUP")
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		util.TryFatal(log, err, "server failed")
+	case <-ctx.Done():
+		router.shutdown(*flagShutdownGrace)
+		if err := dialer.quotas.save(); err != nil {
+			log.Error("can not save quota file", zap.String("file", *flagQuotaFile), zap.Error(err))
+		}
+	}
+}
+
+const defaultBasicAuthTTL = 90 * time.Second
+
+var basicAuthCache = cache.New(120*time.Second, 60*time.Minute)
+
+type Credentials struct {
+	disableCaching bool
+	lock           sync.RWMutex
+	htpasswd       map[string]string
+	// cachedUsers bounds the number of cached users, nil means unbounded
+	cachedUsers *authCacheUsers
+	// upgrader rehashes weak hashes on login, nil leaves them alone
+	upgrader *hashUpgrader
+}
+
+// setHtpasswd replaces the password hashes by user
+func (s *Credentials) setHtpasswd(htpasswd map[string]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.htpasswd = htpasswd
+}
+
+// replacePasswordHash replaces the hash of user, if it still is hashedPW
+func (s *Credentials) replacePasswordHash(user, hashedPW, newHashedPW string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.htpasswd[user] != hashedPW {
+		return
+	}
+	htpasswd := make(map[string]string, len(s.htpasswd))
+	for otherUser, otherHashedPW := range s.htpasswd {
+		htpasswd[otherUser] = otherHashedPW
+	}
+	htpasswd[user] = newHashedPW
+	s.htpasswd = htpasswd
+}
+
+// verify checks the password of user against its hash, possibly upgrading
+// the hash once verified
+func (s *Credentials) verify(user, hashedPW string, password []byte) bool {
+	if !verifyPassword(hashedPW, password) {
+		return false
+	}
+	s.upgrader.upgrade(s, user, hashedPW, password)
+	return true
+}
+
+func (s *Credentials) passwordHashes() map[string]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.htpasswd
+}
+
+func (s *Credentials) Valid(user, password string) bool {
+	hashedPW := s.passwordHashes()[user]
+	plainPWb := []byte(password)
+
+	if s.disableCaching {
+		return s.verify(user, hashedPW, plainPWb)
+	}
+
+	hasher := murmur3.New64()
+
+	cachedPass, inCache := basicAuthCache.Get(hashedPW)
+	if !inCache {
+		ok := s.verify(user, hashedPW, plainPWb)
+		if !ok {
+			return false
+		}
+
+		hasher.Write(plainPWb)
+		basicAuthCache.Set(hashedPW, string(hasher.Sum(nil)), defaultBasicAuthTTL)
+		s.cachedUsers.touch(user, hashedPW)
+		return true
+	}
+
+	hasher.Write(plainPWb)
+	if cachedPass.(string) != string(hasher.Sum(nil)) {
+		return s.verify(user, hashedPW, plainPWb)
+	}
+
+	s.cachedUsers.touch(user, hashedPW)
+	return true
+}
+
+// verifyPassword checks password against an htpasswd hash, detecting the
+// algorithm from the hash prefix. bcrypt ($2y$, htpasswd -B) is recommended,
+// SHA1 ({SHA}, htpasswd -s) and apr1 MD5 ($apr1$, htpasswd -m) are supported
+// to reuse existing Apache htpasswd files.
+func verifyPassword(hashedPW string, password []byte) bool {
+	switch {
+	case strings.HasPrefix(hashedPW, "{SHA}"):
+		sum := sha1.Sum(password)
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hashedPW), []byte(expected)) == 1
+	case strings.HasPrefix(hashedPW, "$apr1$"):
+		return nil == apr1_crypt.New().Verify(hashedPW, password)
+	default:
+		return nil == bcrypt.CompareHashAndPassword([]byte(hashedPW), password)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// hasQuota tells if any user limit sets a quota
+func hasQuota(limits map[string]*UserLimit) bool {
+	for _, limit := range limits {
+		if limit.Quota > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// flagGiven tells if the flag name was set on the command line or by its
+// environment variable rather than left to its default
+func flagGiven(name string) (given bool) {
+	flag.Visit(func(f *flag.Flag) {
+		given = given || f.Name == name
+	})
+	_, inEnv := os.LookupEnv(util.EnvName(name))
+	return given || inEnv
+}
+
+// overrideFlag sets flag to value from the config, unless it is empty
+func overrideFlag(flag *string, value string) {
+	if value != "" {
+		*flag = value
+	}
+}
+
+// splitList splits a comma separated flag value, dropping empty entries
+func splitList(list string) []string {
+	values := []string{}
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
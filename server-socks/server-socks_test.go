@@ -0,0 +1,1360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"util"
+
+	"server-socks/policy"
+	"socks5"
+
+	"go.uber.org/zap"
+)
+
+// newTestPolicy returns an authenticator resolving destination names by
+// resolved alone
+func newTestPolicy(t *testing.T, destinations, denies map[string]*policy.Destination, resolved map[string][]string) *policy.Authenticator {
+	resolver := policy.LookupFunc(func(name string) ([]string, time.Duration, error) {
+		if addrs, ok := resolved[name]; ok {
+			return addrs, 0, nil
+		}
+		return nil, 0, fmt.Errorf("no such host %s", name)
+	})
+	sa, err := policy.NewAuthenticator(zap.NewNop(), destinations, denies, resolver, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sa
+}
+
+func newTestRequest(user string, ip string, port int) *socks5.Request {
+	payload := map[string]string{}
+	if user != "" {
+		payload["Username"] = user
+	}
+	return &socks5.Request{
+		Command:     socks5.ConnectCommand,
+		AuthContext: &socks5.AuthContext{Method: socks5.UserPassAuth, Payload: payload},
+		DestAddr:    &socks5.AddrSpec{IP: net.ParseIP(ip), Port: port},
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	// htpasswd -nbs jan secret
+	if !verifyPassword("{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", []byte("secret")) {
+		t.Fatalf("expected sha password to verify")
+	}
+	if verifyPassword("{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", []byte("wrong")) {
+		t.Fatalf("expected wrong sha password to fail")
+	}
+	if verifyPassword("", []byte("secret")) {
+		t.Fatalf("expected missing hash to fail")
+	}
+}
+
+// shaHash is the htpasswd {SHA} hash of password
+func shaHash(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestAuthCacheUsers(t *testing.T) {
+	credentials := &Credentials{
+		htpasswd: map[string]string{
+			"cache-a": shaHash("cache-a-secret"),
+			"cache-b": shaHash("cache-b-secret"),
+			"cache-c": shaHash("cache-c-secret"),
+		},
+		cachedUsers: newAuthCacheUsers(2),
+	}
+	defer func() {
+		for _, hashedPW := range credentials.htpasswd {
+			basicAuthCache.Delete(hashedPW)
+		}
+	}()
+	cached := func(user string) bool {
+		_, ok := basicAuthCache.Get(credentials.htpasswd[user])
+		return ok
+	}
+
+	for _, user := range []string{"cache-a", "cache-b", "cache-c"} {
+		if !credentials.Valid(user, user+"-secret") {
+			t.Fatalf("expected %s to be valid", user)
+		}
+	}
+	// the least recently used user is evicted beyond the cap
+	if cached("cache-a") || !cached("cache-b") || !cached("cache-c") {
+		t.Fatal("expected only the 2 most recent users cached")
+	}
+	if !credentials.Valid("cache-b", "cache-b-secret") || !credentials.Valid("cache-a", "cache-a-secret") {
+		t.Fatal("expected the users to stay valid")
+	}
+	if !cached("cache-a") || !cached("cache-b") || cached("cache-c") {
+		t.Fatal("expected the user used least recently to be evicted")
+	}
+	if users := len(credentials.cachedUsers.users); users != 2 {
+		t.Errorf("expected 2 users tracked, got %d", users)
+	}
+}
+
+// testAuthenticator fails authentications with err, counting them
+type testAuthenticator struct {
+	err   error
+	calls int
+}
+
+func (a *testAuthenticator) Authenticate(io.Reader, io.Writer) (*socks5.AuthContext, error) {
+	a.calls++
+	if a.err != nil {
+		return nil, a.err
+	}
+	return &socks5.AuthContext{Method: socks5.UserPassAuth}, nil
+}
+
+func (a *testAuthenticator) GetCode() uint8 {
+	return socks5.UserPassAuth
+}
+
+// testClientWriter is a writer to a client at addr
+type testClientWriter struct {
+	bytes.Buffer
+	addr net.Addr
+}
+
+func (w *testClientWriter) RemoteAddr() net.Addr {
+	return w.addr
+}
+
+func TestAuthFailuresLockout(t *testing.T) {
+	inner := &testAuthenticator{}
+	authenticator := newAuthFailures(zap.NewNop(), 2, time.Minute, time.Minute).wrap(inner)
+	client := &testClientWriter{addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}}
+	other := &testClientWriter{addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 40000}}
+	authenticate := func(w *testClientWriter, err error) error {
+		inner.err = err
+		_, err = authenticator.Authenticate(nil, w)
+		return err
+	}
+
+	// a success resets the failures of the ip
+	_ = authenticate(client, socks5.UserAuthFailed)
+	if err := authenticate(client, nil); err != nil {
+		t.Fatal(err)
+	}
+	_ = authenticate(client, socks5.UserAuthFailed)
+	if err := authenticate(client, nil); err != nil {
+		t.Fatal("expected no lockout after a success, got", err)
+	}
+
+	// failures in a row lock out the ip alone
+	_ = authenticate(client, socks5.UserAuthFailed)
+	_ = authenticate(client, socks5.UserAuthFailed)
+	calls := inner.calls
+	if err := authenticate(client, nil); err != errLockedOut {
+		t.Fatalf("expected the ip locked out, got %v", err)
+	}
+	if inner.calls != calls {
+		t.Error("expected a locked out ip not to be authenticated")
+	}
+	if err := authenticate(other, nil); err != nil {
+		t.Fatal("expected other ips not to be locked out, got", err)
+	}
+}
+
+func TestSelfAddrsIsSelf(t *testing.T) {
+	self := &selfAddrs{localIPs: []net.IP{net.ParseIP("192.168.1.10")}, outbound: map[string]struct{}{}}
+	self.add(&net.TCPAddr{Port: 8000})
+	self.add(&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 443})
+
+	tests := []struct {
+		ip   string
+		port int
+		self bool
+	}{
+		{"127.0.0.1", 8000, true},
+		{"192.168.1.10", 8000, true},
+		{"::1", 8000, true},
+		{"192.168.1.11", 8000, false},
+		{"192.168.1.10", 8001, false},
+		{"203.0.113.7", 443, true},
+		{"203.0.113.7", 8000, false},
+	}
+	for _, test := range tests {
+		if isSelf := self.isSelf(net.ParseIP(test.ip), test.port); isSelf != test.self {
+			t.Fatalf("%s:%d: expected self=%v", test.ip, test.port, test.self)
+		}
+	}
+}
+
+func TestReloadDiff(t *testing.T) {
+	changes := diffPasswordHashes(
+		map[string]string{"jan": "a", "peter": "b", "paul": "c"},
+		map[string]string{"jan": "a", "peter": "x", "mary": "d"},
+	)
+	changes = append(changes, diffDestinations(
+		"destinations",
+		map[string]*policy.Destination{"a.example.com": {Ports: []int{443}}, "b.example.com": {Ports: []int{80}}},
+		map[string]*policy.Destination{"a.example.com": {Ports: []int{443}}, "b.example.com": {Ports: []int{80, 443}}},
+	)...)
+	expected := []string{
+		"users added: mary",
+		"users removed: paul",
+		"users changed: peter",
+		"destinations changed: b.example.com",
+	}
+	if strings.Join(changes, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+}
+
+func TestReplaceHtpasswdHash(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.htpasswd")
+	if err := os.WriteFile(file, []byte("jan:{SHA}old\npeter:$2y$05$abc\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := replaceHtpasswdHash(file, "jan", "{SHA}old", "$2a$12$new"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(content) != "jan:$2a$12$new\npeter:$2y$05$abc\n" {
+		t.Fatalf("unexpected htpasswd file: %q", content)
+	}
+	if err := replaceHtpasswdHash(file, "jan", "{SHA}old", "$2a$12$newer"); err == nil {
+		t.Fatalf("expected an error for a hash changed in the meantime")
+	}
+}
+
+func TestTierQueue(t *testing.T) {
+	q := newTierQueue(zap.NewNop(), 1, 2, time.Second, map[string]*UserLimit{"premium": {Tier: 1}})
+	if ok, _ := q.acquire(q.tier("free")); !ok {
+		t.Fatal("a free slot should be taken right away")
+	}
+
+	order := make(chan string, 2)
+	wait := func(userName string) {
+		if ok, _ := q.acquire(q.tier(userName)); ok {
+			order <- userName
+		}
+	}
+	go wait("free")
+	waitForWaiters(t, q, 1)
+	go wait("premium")
+	waitForWaiters(t, q, 2)
+
+	// the queue is full, a free tier connection is shed right away
+	if ok, reason := q.acquire(0); ok || reason != shedReasonQueueFull {
+		t.Fatal("a full queue should shed a connection of the lowest tier, got", ok, reason)
+	}
+
+	q.release()
+	if first := <-order; first != "premium" {
+		t.Fatal("the higher tier should be served first, got", first)
+	}
+	q.release()
+	if second := <-order; second != "free" {
+		t.Fatal("the lower tier should be served next, got", second)
+	}
+}
+
+func waitForWaiters(t *testing.T, q *tierQueue, n int) {
+	for i := 0; i < 100; i++ {
+		q.lock.Lock()
+		waiting := len(q.waiting)
+		q.lock.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("waiters did not queue up")
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := append([]byte{}, proxyProtocolV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x1f, 0x40)
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 56324 8000\r\n", "192.0.2.1:56324"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 8000\r\n", "[2001:db8::1]:56324"},
+		{"PROXY UNKNOWN\r\n", "<nil>"},
+		{string(v2), "192.0.2.1:56324"},
+	}
+	for _, test := range tests {
+		reader := bufio.NewReader(strings.NewReader(test.header + "\x16\x03"))
+		addr, err := readProxyHeader(reader)
+		if err != nil {
+			t.Fatal(test.header, err)
+		}
+		if got := fmt.Sprint(addr); got != test.want {
+			t.Fatal("expected", test.want, "got", got)
+		}
+		if rest, _ := reader.Peek(2); string(rest) != "\x16\x03" {
+			t.Fatal("the header should be consumed, left", rest)
+		}
+	}
+
+	if _, err := readProxyHeader(bufio.NewReader(strings.NewReader("\x16\x03\x01"))); err != errNoProxyHeader {
+		t.Fatal("a tls handshake should not be taken for a header, got", err)
+	}
+}
+
+func TestIPRateLimit(t *testing.T) {
+	limit, err := newIPRateLimit(zap.NewNop(), 0.1, 2, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, true, false} {
+		if got := limit.take("192.0.2.1"); got != want {
+			t.Errorf("connection %d allowed %v, want %v", i, got, want)
+		}
+	}
+	if !limit.take("192.0.2.2") {
+		t.Error("other ip should have a bucket of its own")
+	}
+	if _, err := newIPRateLimit(zap.NewNop(), 1, 1, []string{"not an ip"}); err == nil {
+		t.Error("expected invalid exempt network to fail")
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	file := t.TempDir() + "/access.log"
+	accessLog, err := openAccessLog(zap.NewNop(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa := newTestPolicy(t, map[string]*policy.Destination{
+		"example.com": {Ports: []int{443}, Users: []string{"jan"}, Labels: map[string]string{"service": "billing"}},
+	}, nil, map[string][]string{"example.com": {"10.0.0.1"}})
+	rules := accessLog.wrap(sa, "")
+
+	if _, allowed := rules.Allow(context.Background(), newTestRequest("peter", "10.0.0.1", 443)); allowed {
+		t.Fatal("peter should be denied")
+	}
+	req := newTestRequest("jan", "10.0.0.1", 443)
+	ctx, allowed := rules.Allow(context.Background(), req)
+	if !allowed {
+		t.Fatal("jan should be allowed")
+	}
+	record := accessRecordFromContext(ctx)
+	conn := &countingConn{Conn: nopConn{}, counts: &record.counts}
+	_, _ = conn.Write(make([]byte, 5))
+	_, _ = conn.Read(make([]byte, 7))
+	rules.(socks5.RuleReleaser).Release(ctx, req)
+
+	logBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(logBytes)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %q", logBytes)
+	}
+	var denied, served accessRecord
+	if err := json.Unmarshal([]byte(lines[0]), &denied); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &served); err != nil {
+		t.Fatal(err)
+	}
+	if denied.Decision != accessDecisionDenied || denied.User != "peter" {
+		t.Errorf("unexpected denied record %+v", denied)
+	}
+	if served.Decision != accessDecisionAllowed || served.Destination != "example.com" || served.Labels["service"] != "billing" || served.BytesUp != 5 || served.BytesDown != 7 {
+		t.Errorf("unexpected allowed record %+v", served)
+	}
+}
+
+// nopConn reads and writes whole buffers without going anywhere
+type nopConn struct {
+	net.Conn
+}
+
+func (nopConn) Read(b []byte) (int, error)  { return len(b), nil }
+func (nopConn) Write(b []byte) (int, error) { return len(b), nil }
+
+func TestCountingConnReapIdle(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := &countingConn{Conn: client, counts: &byteCounts{}, lastActivity: time.Now().UnixNano()}
+	reaped := make(chan time.Duration, 1)
+	conn.reapIdle(50*time.Millisecond, func(idle time.Duration) {
+		reaped <- idle
+	})
+
+	// traffic keeps the connection open past the timeout
+	go func() { _, _ = io.Copy(ioutil.Discard, server) }()
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if _, err := conn.Write([]byte("x")); err != nil {
+			t.Fatalf("connection closed while active: %v", err)
+		}
+	}
+	select {
+	case idle := <-reaped:
+		if idle < 50*time.Millisecond {
+			t.Errorf("reaped after being idle for %s only", idle)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle connection was not reaped")
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Error("reaped connection should be closed")
+	}
+}
+
+func TestCountingConnReapAfterClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := &countingConn{Conn: client, counts: &byteCounts{}, lastActivity: time.Now().UnixNano()}
+	reaped := make(chan time.Duration, 1)
+	conn.reapIdle(20*time.Millisecond, func(idle time.Duration) {
+		reaped <- idle
+	})
+
+	// the timer fires while Close holds the lock, with fresh activity that
+	// would have it re-armed
+	conn.timerLock.Lock()
+	time.Sleep(40 * time.Millisecond)
+	atomic.StoreInt64(&conn.lastActivity, time.Now().UnixNano())
+	conn.timerLock.Unlock()
+	_ = conn.Close()
+	select {
+	case idle := <-reaped:
+		t.Fatalf("closed connection reaped after being idle for %s", idle)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCountingConnReapShortTimeout(t *testing.T) {
+	// the timers may fire before reapIdle and reapSilent returned
+	for i := 0; i < 100; i++ {
+		client, server := net.Pipe()
+		conn := &countingConn{Conn: client, counts: &byteCounts{}}
+		reaped := make(chan struct{}, 2)
+		conn.reapIdle(time.Nanosecond, func(time.Duration) { reaped <- struct{}{} })
+		conn.reapSilent(time.Nanosecond, func() { reaped <- struct{}{} })
+		select {
+		case <-reaped:
+		case <-time.After(time.Second):
+			t.Fatal("connection was not reaped")
+		}
+		_ = server.Close()
+	}
+}
+
+func TestCountingConnReapSilent(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	silent := &countingConn{Conn: client, counts: &byteCounts{}}
+	reaped := make(chan struct{}, 1)
+	silent.reapSilent(20*time.Millisecond, func() {
+		reaped <- struct{}{}
+	})
+	select {
+	case <-reaped:
+	case <-time.After(time.Second):
+		t.Fatal("connection without traffic was not reaped")
+	}
+	if _, err := silent.Write([]byte("x")); err == nil {
+		t.Error("reaped connection should be closed")
+	}
+
+	// once bytes went through the connection stays open, even if idle
+	client, server = net.Pipe()
+	defer server.Close()
+	go func() { _, _ = io.Copy(ioutil.Discard, server) }()
+	active := &countingConn{Conn: client, counts: &byteCounts{}}
+	active.reapSilent(20*time.Millisecond, func() {
+		reaped <- struct{}{}
+	})
+	if _, err := active.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := active.Write([]byte("x")); err != nil {
+		t.Errorf("connection with traffic should stay open: %v", err)
+	}
+	select {
+	case <-reaped:
+		t.Error("connection with traffic was reaped")
+	default:
+	}
+	_ = active.Close()
+}
+
+func TestDialerBindConn(t *testing.T) {
+	q, err := newQuotas(zap.NewNop(), "", quotaResetDaily, 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &dialer{log: zap.NewNop(), quotas: q}
+	sa := newTestPolicy(t, map[string]*policy.Destination{
+		"127.0.0.0/8": {AllPorts: true, Users: []string{"jan"}},
+	}, nil, nil)
+	ctx, allowed := sa.Allow(context.Background(), newTestRequest("jan", "127.0.0.1", 4000))
+	if !allowed {
+		t.Fatal("jan should be allowed")
+	}
+
+	client, peer := net.Pipe()
+	defer client.Close()
+	bound := d.BindConn(ctx, peer)
+	go func() { _, _ = client.Write([]byte("ping")) }()
+	if _, err := io.ReadFull(bound, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _, _ = io.ReadFull(client, make([]byte, 6)) }()
+	if _, err := bound.Write([]byte("pong!!")); err != nil {
+		t.Fatal(err)
+	}
+	_ = bound.Close()
+	if used := q.used("jan"); used != 10 {
+		t.Errorf("expected the bound peer to be charged 10 bytes, got %d", used)
+	}
+}
+
+func TestTestPolicy(t *testing.T) {
+	sa := newTestPolicy(t, map[string]*policy.Destination{
+		"10.0.0.0/24": {Ports: []int{443}, Users: []string{"jan"}},
+	}, map[string]*policy.Destination{
+		"10.0.0.2/32": {},
+	}, nil)
+
+	tests := []struct {
+		query   string
+		allowed bool
+		output  string
+	}{
+		{"jan 10.0.0.1:443", true, "allowed jan to 10.0.0.1:443 by destination 10.0.0.0/24\n"},
+		{"peter 10.0.0.1:443", false, "denied peter to 10.0.0.1:443: user_not_allowed\n"},
+		{"10.0.0.1:443", false, "denied no user to 10.0.0.1:443: no_user\n"},
+		{"jan 10.0.0.1:80", false, "denied jan to 10.0.0.1:80: port_not_allowed\n"},
+		{"jan 10.0.0.2:443", false, "denied jan to 10.0.0.2:443 by deny 10.0.0.2/32\n"},
+	}
+	for _, test := range tests {
+		out := &strings.Builder{}
+		allowed, err := testPolicy(out, sa, test.query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		if allowed != test.allowed || out.String() != test.output {
+			t.Errorf("%s: expected %v %q, got %v %q", test.query, test.allowed, test.output, allowed, out.String())
+		}
+	}
+	for _, query := range []string{"", "jan", "jan 10.0.0.1", "jan 10.0.0.1:http", "a b c"} {
+		if _, err := testPolicy(ioutil.Discard, sa, query); err == nil {
+			t.Errorf("%q: expected an error", query)
+		}
+	}
+}
+
+func TestRequireALPN(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("certificate.crt", "certificate.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	requireALPN(serverConfig, []string{"socks5-tls"})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	for _, test := range []struct {
+		protos []string
+		ok     bool
+	}{
+		{[]string{"socks5-tls"}, true},
+		{[]string{"h2", "socks5-tls"}, true},
+		{[]string{"h2"}, false},
+		{nil, false},
+	} {
+		serverErr := make(chan error, 1)
+		go func() {
+			server, err := listener.Accept()
+			if err != nil {
+				serverErr <- err
+				return
+			}
+			serverErr <- tls.Server(server, serverConfig).Handshake()
+			server.Close()
+		}()
+		client, _ := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: test.protos})
+		err := <-serverErr
+		if client != nil {
+			client.Close()
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("%v: expected ok=%v, got %v", test.protos, test.ok, err)
+		}
+	}
+}
+
+func TestCertificateHolderCheckFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "certificate.crt"), filepath.Join(dir, "certificate.key")
+	certPEM, err := ioutil.ReadFile("certificate.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := ioutil.ReadFile("certificate.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-time.Hour)
+	writeCert := func(cert []byte) {
+		if err := ioutil.WriteFile(certFile, cert, 0600); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Minute)
+		if err := os.Chtimes(certFile, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCert(certPEM)
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(keyFile, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	audit := newReloadAudit(zap.NewNop())
+	h, err := newCertificateHolder(zap.NewNop(), certFile, keyFile, audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ := h.GetCertificate(nil)
+
+	// unchanged files are not reloaded
+	h.checkFiles()
+	if events := audit.last(); len(events) != 0 {
+		t.Fatalf("expected no reload, got %v", events)
+	}
+
+	// a broken certificate is reported once and the previous one kept
+	writeCert([]byte("broken"))
+	h.checkFiles()
+	h.checkFiles()
+	if events := audit.last(); len(events) != 1 || events[0].Success {
+		t.Fatalf("expected one failed reload, got %v", events)
+	}
+	if cert, _ := h.GetCertificate(nil); cert != loaded {
+		t.Error("expected the previous certificate to be kept")
+	}
+
+	// fixing the files loads them again
+	writeCert(certPEM)
+	h.checkFiles()
+	if events := audit.last(); len(events) != 2 || !events[1].Success {
+		t.Fatalf("expected a successful reload, got %v", events)
+	}
+	if cert, _ := h.GetCertificate(nil); cert == loaded {
+		t.Error("expected the certificate to be replaced")
+	}
+}
+
+func TestProbeFilter(t *testing.T) {
+	for _, test := range []struct {
+		filter   *probeFilter
+		first    string
+		passed   bool
+		response string
+	}{
+		// without -reject-plaintext every client is left to the handshake
+		{nil, "GET / HTTP/1.1\r\n", true, ""},
+		{nil, "\x16\x03\x01", true, ""},
+		{&probeFilter{log: zap.NewNop(), response: []byte("HTTP/1.1 400 Bad Request\r\n\r\n")}, "GET / HTTP/1.1\r\n", false, "HTTP/1.1 400 Bad Request\r\n\r\n"},
+		{&probeFilter{log: zap.NewNop()}, "\x16\x03\x01", true, ""},
+	} {
+		client, server := net.Pipe()
+		go func() { _, _ = client.Write([]byte(test.first)) }()
+		responses := make(chan string, 1)
+		if !test.passed {
+			go func() {
+				response, _ := ioutil.ReadAll(client)
+				responses <- string(response)
+			}()
+		}
+		conn := test.filter.filter(server)
+		if (conn != nil) != test.passed {
+			t.Fatalf("%q: expected passed %v", test.first, test.passed)
+		}
+		if conn != nil {
+			// the inspected bytes are still read
+			first := make([]byte, len(test.first))
+			if _, err := io.ReadFull(conn, first); err != nil || string(first) != test.first {
+				t.Errorf("%q: expected the first bytes, got %q %v", test.first, first, err)
+			}
+		} else if response := <-responses; response != test.response {
+			t.Errorf("%q: expected the response %q, got %q", test.first, test.response, response)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "quotas.json")
+	limits := map[string]*UserLimit{"peter": {Quota: 100}}
+	q, err := newQuotas(zap.NewNop(), file, quotaResetDaily, 10, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := q.wrap(socks5.PermitAll())
+
+	atomic.AddInt64(q.counter("jan"), 9)
+	atomic.AddInt64(q.counter("peter"), 50)
+	if q.counter("") != nil {
+		t.Error("clients without a user have no quota")
+	}
+	if _, allowed := rules.Allow(context.Background(), newTestRequest("jan", "10.0.0.1", 443)); !allowed {
+		t.Error("jan is below the quota and should be allowed")
+	}
+	atomic.AddInt64(q.counter("jan"), 1)
+	ctx, allowed := rules.Allow(context.Background(), newTestRequest("jan", "10.0.0.1", 443))
+	if reason, _ := policy.DenyReasonFromContext(ctx); allowed || reason != policy.DenyReasonQuotaExceeded {
+		t.Errorf("jan used up the quota and should be denied, got %v %v", allowed, reason)
+	}
+	if _, allowed := rules.Allow(context.Background(), newTestRequest("peter", "10.0.0.1", 443)); !allowed {
+		t.Error("peter is below the quota of the user limits and should be allowed")
+	}
+
+	// the usage survives restarts within the period
+	if err := q.save(); err != nil {
+		t.Fatal(err)
+	}
+	q, err = newQuotas(zap.NewNop(), file, quotaResetDaily, 10, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usages := q.usages(); len(usages) != 2 || usages[0] != (quotaUsage{"jan", 10, 10}) || usages[1] != (quotaUsage{"peter", 50, 100}) {
+		t.Errorf("unexpected usages %v", usages)
+	}
+
+	// and is reset by a new period
+	q.periodStart = q.periodStart.AddDate(0, 0, -1)
+	if used := q.used("jan"); used != 0 {
+		t.Errorf("expected the usage to be reset, got %d", used)
+	}
+}
+
+func TestQuotasCharge(t *testing.T) {
+	q, err := newQuotas(zap.NewNop(), "", quotaResetDaily, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &dialer{quotas: q}
+	sa := newTestPolicy(t, map[string]*policy.Destination{"10.0.0.0/8": {AllPorts: true}}, nil, nil)
+	ctx, _ := sa.Allow(context.Background(), newTestRequest("jan", "10.0.0.1", 53))
+	// datagrams pass until the quota is used up, the last one may exceed it
+	for i, expected := range []bool{true, true, false} {
+		if metered := d.Datagram(ctx, 6, i%2 == 0); metered != expected {
+			t.Fatalf("datagram %d: expected %v, got %v", i, expected, metered)
+		}
+	}
+	if used := q.used("jan"); used != 12 {
+		t.Errorf("expected 12 bytes used, got %d", used)
+	}
+	if !(&dialer{}).Datagram(ctx, 6, true) {
+		t.Error("datagrams should pass without quotas")
+	}
+}
+
+func TestUserConnLimiterAssociate(t *testing.T) {
+	limiter := newUserConnLimiter(zap.NewNop(), socks5.PermitAll(), 1)
+	nextCalled := false
+	associate := limiter.associate(func(ctx context.Context, req *socks5.Request) (context.Context, func(), bool) {
+		nextCalled = true
+		return ctx, nil, true
+	})
+	association := newTestRequest("jan", "0.0.0.0", 0)
+	association.Command = socks5.AssociateCommand
+
+	_, done, ok := associate(context.Background(), association)
+	if !ok || !nextCalled {
+		t.Fatal("the first association of jan should be accepted")
+	}
+	// the association holds the only slot of jan
+	if _, _, ok := associate(context.Background(), association); ok {
+		t.Error("a second association should be rejected")
+	}
+	if _, allowed := limiter.Allow(context.Background(), newTestRequest("jan", "10.0.0.1", 443)); allowed {
+		t.Error("a connection should be denied while the association lasts")
+	}
+	// its datagrams are covered by the slot of the association
+	datagram := newTestRequest("jan", "10.0.0.1", 53)
+	datagram.Command = socks5.AssociateCommand
+	for i := 0; i < 2; i++ {
+		ctx, allowed := limiter.Allow(context.Background(), datagram)
+		if !allowed {
+			t.Fatal("a datagram should be allowed while the association holds the slot of jan")
+		}
+		limiter.Release(ctx, datagram)
+	}
+	if active := limiter.active["jan"]; active != 1 {
+		t.Errorf("expected the association to hold 1 slot, got %d", active)
+	}
+	done()
+	if _, allowed := limiter.Allow(context.Background(), newTestRequest("jan", "10.0.0.1", 443)); !allowed {
+		t.Error("the slot should be free once the association ended")
+	}
+	if (*userConnLimiter)(nil).associate(nil) != nil {
+		t.Error("without a limiter next should be returned")
+	}
+}
+
+func TestUserConnLimiterBind(t *testing.T) {
+	limiter := newUserConnLimiter(zap.NewNop(), socks5.PermitAll(), 1)
+	server, err := socks5.New(&socks5.Config{
+		Credentials: socks5.StaticCredentials{"jan": "secret"},
+		Rules:       limiter,
+		EnableBind:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() { _ = server.Serve(listener) }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, _ = conn.Write([]byte{5, 1, socks5.UserPassAuth})
+	_, _ = conn.Write(append([]byte{1, 3}, []byte("jan\x06secret")...))
+	_, _ = conn.Write([]byte{5, socks5.BindCommand, 0, 1, 127, 0, 0, 1, 0, 0})
+	replies := make([]byte, 2+2+10)
+	if _, err := io.ReadFull(conn, replies); err != nil {
+		t.Fatal(err)
+	}
+	if replies[3] != 0 || replies[5] != 0 {
+		t.Fatalf("expected the bind to be accepted, got %v", replies)
+	}
+	bound := &net.TCPAddr{IP: net.IP(replies[8:12]), Port: int(replies[12])<<8 | int(replies[13])}
+
+	// the peer is covered by the only slot of jan, taken by the bind
+	peer, err := net.Dial("tcp", bound.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	second := make([]byte, 10)
+	if _, err := io.ReadFull(conn, second); err != nil {
+		t.Fatal(err)
+	}
+	if second[1] != 0 {
+		t.Fatalf("expected the peer to be allowed, got %v", second)
+	}
+	limiter.lock.Lock()
+	active := limiter.active["jan"]
+	limiter.lock.Unlock()
+	if active != 1 {
+		t.Errorf("expected the bind to take 1 slot, got %d", active)
+	}
+}
+
+func TestDialerDatagramRateLimit(t *testing.T) {
+	d := &dialer{rateLimit: 1000}
+	sa := newTestPolicy(t, map[string]*policy.Destination{
+		"10.0.0.0/8":   {AllPorts: true},
+		"192.0.2.0/24": {AllPorts: true, RateLimit: 1000000},
+	}, nil, nil)
+	associated, _, _ := d.Associate(context.Background(), newTestRequest("jan", "0.0.0.0", 0))
+	throttled, _ := sa.Allow(associated, newTestRequest("jan", "10.0.0.1", 53))
+	fast, _ := sa.Allow(associated, newTestRequest("jan", "192.0.2.1", 53))
+
+	// the default rate applies, unless the destination has its own
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if !d.Datagram(throttled, 100, true) {
+			t.Fatal("datagram should pass without quotas")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected 200 bytes at 1000 bytes per second to take about 200ms, took %s", elapsed)
+	}
+	start = time.Now()
+	_ = d.Datagram(fast, 100, true)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected the rate of the destination to apply, took %s", elapsed)
+	}
+}
+
+func TestQuotasStart(t *testing.T) {
+	now := time.Date(2024, 5, 16, 13, 30, 0, 0, time.UTC) // a thursday
+	for reset, expected := range map[string]time.Time{
+		quotaResetDaily:   time.Date(2024, 5, 16, 0, 0, 0, 0, time.UTC),
+		quotaResetWeekly:  time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC),
+		quotaResetMonthly: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		if start := (&quotas{reset: reset}).start(now); !start.Equal(expected) {
+			t.Errorf("%s: expected %v, got %v", reset, expected, start)
+		}
+	}
+	if _, err := newQuotas(zap.NewNop(), "", "hourly", 10, nil); err == nil {
+		t.Error("expected an unknown reset to fail")
+	}
+}
+
+func TestAcceptMux(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	server, err := socks5.New(&socks5.Config{Rules: socks5.PermitAll()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newRealmRouter(zap.NewNop(), false)
+	router.mux = true
+	realm := &realm{server: server}
+
+	// plain clients are passed on with their first bytes
+	client, conn := net.Pipe()
+	go func() { _, _ = client.Write([]byte{5, 1, 0}) }()
+	plain := router.acceptMux(conn, realm)
+	if plain == nil {
+		t.Fatal("expected a plain connection")
+	}
+	first := make([]byte, 3)
+	if _, err := io.ReadFull(plain, first); err != nil || !bytes.Equal(first, []byte{5, 1, 0}) {
+		t.Fatalf("expected the first bytes to be kept, got %v %v", first, err)
+	}
+	client.Close()
+
+	client, conn = net.Pipe()
+	defer client.Close()
+	go router.acceptMux(conn, realm)
+	session, err := util.NewMuxClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoAddr := echo.Addr().(*net.TCPAddr)
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			stream, err := session.Open()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer stream.Close()
+			_ = stream.SetDeadline(time.Now().Add(5 * time.Second))
+			request := []byte{5, 1, 0, 5, 1, 0, 1}
+			request = append(append(request, echoAddr.IP.To4()...), byte(echoAddr.Port>>8), byte(echoAddr.Port))
+			if _, err := stream.Write(request); err != nil {
+				errs <- err
+				return
+			}
+			reply := make([]byte, 2+10)
+			if _, err := io.ReadFull(stream, reply); err != nil || reply[3] != 0 {
+				errs <- fmt.Errorf("connect failed: %v %v", reply, err)
+				return
+			}
+			// more than the window of a stream goes through both ways
+			go func() { _, _ = stream.Write(payload) }()
+			echoed := make([]byte, len(payload))
+			if _, err := io.ReadFull(stream, echoed); err != nil || !bytes.Equal(echoed, payload) {
+				errs <- fmt.Errorf("echo failed: %v", err)
+				return
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestAcceptMuxLimits(t *testing.T) {
+	server, err := socks5.New(&socks5.Config{Rules: socks5.PermitAll()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newRealmRouter(zap.NewNop(), false)
+	router.mux = true
+	router.muxMaxStreams = 1
+	router.muxIdleTimeout = 100 * time.Millisecond
+	router.conns = newConnLimit(zap.NewNop(), 10, 0)
+	// the connection of the session holds its slot
+	router.conns.slots <- struct{}{}
+	realm := &realm{server: server}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	served := make(chan struct{})
+	go func() {
+		router.acceptMux(conn, realm)
+		close(served)
+	}()
+	session, err := util.NewMuxClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stream beyond the cap is reset
+	first, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Errorf("expected the stream beyond the cap to be reset, got %v", err)
+	}
+	if slots := len(router.conns.slots); slots != 1 {
+		t.Errorf("expected the streams to take no slot beyond the session, %d taken", slots)
+	}
+
+	// the session is closed once it has no open streams for the idle timeout
+	_ = first.Close()
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle mux session was not closed")
+	}
+}
+
+// countingListener counts the connections accepted from it
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func TestRealmRouterConnLimitWait(t *testing.T) {
+	server, err := socks5.New(&socks5.Config{Rules: socks5.PermitAll()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newRealmRouter(zap.NewNop(), false)
+	router.tlsConfig = &tls.Config{}
+	router.conns = newConnLimit(zap.NewNop(), 1, time.Minute)
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &countingListener{Listener: tcpListener}
+	defer listener.Close()
+	go func() { _ = router.serve(listener, &realm{server: server}) }()
+
+	// the first client holds the slot in its handshake, the others waiting
+	// for it do not hold up accepting
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&listener.accepted) != 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if accepted := atomic.LoadInt32(&listener.accepted); accepted != 3 {
+		t.Errorf("expected 3 connections accepted while waiting for a slot, got %d", accepted)
+	}
+	if slots := len(router.conns.slots); slots != 1 {
+		t.Errorf("expected 1 connection slot taken, got %d", slots)
+	}
+}
+
+func TestRealmRouterShutdown(t *testing.T) {
+	router := newRealmRouter(zap.NewNop(), false)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.addListener(listener)
+	endingClient, ending := net.Pipe()
+	defer endingClient.Close()
+	stuckClient, stuck := net.Pipe()
+	defer stuckClient.Close()
+	untrack := router.track(ending)
+	router.track(stuck)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		untrack()
+	}()
+
+	// connections still active after the grace period are closed
+	start := time.Now()
+	router.shutdown(200 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected shutdown to wait for the grace period, took %v", elapsed)
+	}
+	if _, err := listener.Accept(); err == nil {
+		t.Error("expected the listener closed")
+	}
+	_ = stuckClient.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := stuckClient.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the stuck connection closed, got %v", err)
+	}
+
+	// shutdown returns once all connections ended
+	router = newRealmRouter(zap.NewNop(), false)
+	_, ending = net.Pipe()
+	untrack = router.track(ending)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		untrack()
+	}()
+	start = time.Now()
+	router.shutdown(time.Minute)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected shutdown to return once the connections ended, took %v", elapsed)
+	}
+}
+
+func TestHealthReady(t *testing.T) {
+	resolved := newTestPolicy(t, map[string]*policy.Destination{
+		"db.internal": {Ports: []int{5432}},
+	}, nil, map[string][]string{"db.internal": {"10.0.1.5"}})
+	if err := resolved.WaitResolved(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	unresolved := newTestPolicy(t, map[string]*policy.Destination{
+		"missing.internal": {Ports: []int{443}},
+	}, nil, nil)
+
+	h := &health{}
+	router := newRealmRouter(zap.NewNop(), false)
+	router.realms["resolved"] = &realm{name: "resolved", authenticator: resolved}
+	h.setRouter(router)
+	if h.ready() {
+		t.Error("expected not ready before listening")
+	}
+	h.setListening()
+	if !h.ready() {
+		t.Error("expected ready once listening with resolved destinations")
+	}
+	// a realm whose destinations failed to resolve keeps the server unready
+	router.realms["unresolved"] = &realm{name: "unresolved", authenticator: unresolved}
+	if h.ready() {
+		t.Error("expected not ready while destinations do not resolve")
+	}
+}
+
+func TestProxyProtocolAll(t *testing.T) {
+	p := &proxyProtocol{log: zap.NewNop()}
+	client, conn := net.Pipe()
+	if p.expects(conn) {
+		t.Error("only trusted sources are expected to send a header")
+	}
+	p.all = true
+
+	go func() { _, _ = client.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 8000\r\n")) }()
+	proxied := p.accept(conn)
+	if proxied == nil || proxied.RemoteAddr().String() != "192.0.2.1:56324" {
+		t.Fatalf("expected the client address of the header, got %v", proxied)
+	}
+	client.Close()
+
+	client, conn = net.Pipe()
+	go func() { _, _ = client.Write([]byte{5, 1, 0}) }()
+	if p.accept(conn) != nil {
+		t.Error("connections without a header should be rejected")
+	}
+	client.Close()
+}
+
+func TestExportPolicy(t *testing.T) {
+	sa := newTestPolicy(t, map[string]*policy.Destination{
+		"db.internal": {Ports: []int{5432}, Users: []string{"jan"}, Commands: []string{"connect"}},
+		"10.0.0.0/24": {AllPorts: true},
+	}, map[string]*policy.Destination{
+		"10.0.0.2/32": {},
+	}, map[string][]string{"db.internal": {"10.0.1.5"}})
+	if err := sa.WaitResolved(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	exported := exportPolicies(map[string]*realm{"": {authenticator: sa}})
+	if len(exported) != 1 || len(exported[0].Destinations) != 2 || len(exported[0].Denies) != 1 {
+		t.Fatalf("unexpected export %+v", exported)
+	}
+	network, db := exported[0].Destinations[0], exported[0].Destinations[1]
+	if network.Name != "10.0.0.0/24" || !network.AllPorts || len(network.IPs) != 1 || network.IPs[0] != "10.0.0.0/24" || network.ResolvedAt != nil {
+		t.Errorf("unexpected network %+v", network)
+	}
+	if db.Name != "db.internal" || len(db.IPs) != 1 || db.IPs[0] != "10.0.1.5" || db.ResolvedAt == nil ||
+		len(db.Users) != 1 || db.Users[0] != "jan" || len(db.Ports) != 1 || db.Ports[0] != 5432 {
+		t.Errorf("unexpected destination %+v", db)
+	}
+	if deny := exported[0].Denies[0]; deny.Name != "10.0.0.2/32" {
+		t.Errorf("unexpected deny %+v", deny)
+	}
+
+	exportedJSON, err := json.Marshal(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(exportedJSON), "null") {
+		t.Errorf("expected empty lists in %s", exportedJSON)
+	}
+
+	// the health and admin handlers serve the export
+	router := newRealmRouter(zap.NewNop(), false)
+	router.realms["internal"] = &realm{name: "internal", authenticator: sa}
+	for _, test := range []struct {
+		method, url string
+		status      int
+	}{
+		{http.MethodGet, "/policy", http.StatusOK},
+		{http.MethodGet, "/policy?realm=internal", http.StatusOK},
+		{http.MethodGet, "/policy?realm=unknown", http.StatusNotFound},
+		{http.MethodPost, "/policy", http.StatusMethodNotAllowed},
+	} {
+		recorder := httptest.NewRecorder()
+		servePolicy(zap.NewNop(), recorder, httptest.NewRequest(test.method, test.url, nil), router)
+		if recorder.Code != test.status {
+			t.Errorf("%s %s: expected status %d, got %d", test.method, test.url, test.status, recorder.Code)
+			continue
+		}
+		if test.status == http.StatusOK && !strings.Contains(recorder.Body.String(), `"realm":"internal"`) {
+			t.Errorf("%s %s: expected the policy of the realm, got %s", test.method, test.url, recorder.Body)
+		}
+	}
+}
+
+func TestRealmPolicyAddUsers(t *testing.T) {
+	loaded := &realmPolicy{destinations: map[string]*policy.Destination{
+		"db.internal":     {Ports: []int{5432}, Users: []string{"peter"}},
+		"git.internal":    {Ports: []int{22}, Groups: []string{"devs"}},
+		"www.example.com": {Ports: []int{443}},
+	}}
+	err := loaded.addUsers(map[string]*UserConfig{
+		"jan":   {Hash: "$2y$05$hash", Destinations: []string{"db.internal", "git.internal"}},
+		"peter": {Hash: "$2y$05$other"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.passwordHashes) != 2 || loaded.passwordHashes["jan"] != "$2y$05$hash" {
+		t.Errorf("unexpected password hashes %v", loaded.passwordHashes)
+	}
+	if users := loaded.destinations["db.internal"].Users; len(users) != 2 || users[0] != "peter" || users[1] != "jan" {
+		t.Errorf("unexpected users of db.internal %v", users)
+	}
+	if users := loaded.destinations["git.internal"].Users; len(users) != 1 || users[0] != "jan" {
+		t.Errorf("unexpected users of git.internal %v", users)
+	}
+	if users := loaded.destinations["www.example.com"].Users; len(users) != 0 {
+		t.Errorf("www.example.com should stay open, got users %v", users)
+	}
+
+	err = loaded.addUsers(map[string]*UserConfig{
+		"jan":   {Hash: "$2y$05$hash", Destinations: []string{"unknown.internal", "www.example.com"}},
+		"peter": nil,
+	})
+	if err == nil || !strings.Contains(err.Error(), "unknown destination unknown.internal") || !strings.Contains(err.Error(), "peter: missing hash") {
+		t.Errorf("expected unknown destination and missing hash, got %v", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "destination www.example.com is open to every user") {
+		t.Errorf("expected listing an open destination to fail, got %v", err)
+	}
+	if users := loaded.destinations["www.example.com"].Users; len(users) != 0 {
+		t.Errorf("www.example.com should stay open, got users %v", users)
+	}
+
+	file := filepath.Join(t.TempDir(), "users.yaml")
+	if _, err := (realmFiles{htpasswd: "users.htpasswd", users: file}).load(); err == nil {
+		t.Error("expected an error combining a basic auth file and a users file")
+	}
+}
+
+func TestRealmFilesConfig(t *testing.T) {
+	destinations := filepath.Join(t.TempDir(), "destinations.yaml")
+	if err := ioutil.WriteFile(destinations, []byte("www.example.com:\n  ports: [443]\n  users: [jan]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	files := realmFiles{htpasswd: "users.htpasswd", destinations: destinations, config: "config.yaml"}
+	users := map[string]string{"jan": shaHash("secret")}
+
+	// the users of the config replace the basic auth file
+	loaded, err := files.loadWith(&ServerConfig{Users: users})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.htpasswdFile != "" || len(loaded.passwordHashes) != 1 || loaded.passwordHashes["jan"] != users["jan"] {
+		t.Errorf("expected the users of the config, got %v from %q", loaded.passwordHashes, loaded.htpasswdFile)
+	}
+	loaded, err = files.loadWith(&ServerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.htpasswdFile != "users.htpasswd" {
+		t.Errorf("expected the basic auth file without users in the config, got %q", loaded.htpasswdFile)
+	}
+
+	files.users = "users.yaml"
+	if _, err := files.loadWith(&ServerConfig{Users: users}); err == nil {
+		t.Error("expected an error combining a users file and the users of a config")
+	}
+	if _, err := (realmFiles{config: filepath.Join(t.TempDir(), "missing.yaml")}).load(); err == nil {
+		t.Error("expected an error for a missing config")
+	}
+
+	// settings of the config override the flags, unset ones keep them
+	addr, cert := "0.0.0.0:8000", "certificate.crt"
+	overrideFlag(&addr, "127.0.0.1:9000")
+	overrideFlag(&cert, "")
+	if addr != "127.0.0.1:9000" || cert != "certificate.crt" {
+		t.Errorf("expected only the addr overridden, got %s and %s", addr, cert)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"time"
+	"util"
+
+	"go.uber.org/zap"
+)
+
+// addListener registers listener to be closed on shutdown
+func (r *realmRouter) addListener(listener net.Listener) {
+	r.connsLock.Lock()
+	defer r.connsLock.Unlock()
+	r.listeners = append(r.listeners, listener)
+}
+
+// track registers conn as active until the returned func is called
+func (r *realmRouter) track(conn net.Conn) (untrack func()) {
+	r.connsLock.Lock()
+	defer r.connsLock.Unlock()
+	r.active[conn] = struct{}{}
+	r.draining.Add(1)
+	return func() {
+		r.connsLock.Lock()
+		defer r.connsLock.Unlock()
+		delete(r.active, conn)
+		r.draining.Done()
+	}
+}
+
+// shutdown stops accepting connections and waits up to grace for the
+// active ones to end before closing the rest
+func (r *realmRouter) shutdown(grace time.Duration) {
+	r.connsLock.Lock()
+	for _, listener := range r.listeners {
+		util.SilentClose(listener)
+	}
+	active := len(r.active)
+	r.connsLock.Unlock()
+	r.log.Info("stopped accepting connections, waiting for active ones", zap.Int("active", active), zap.Duration("grace", grace))
+
+	done := make(chan struct{})
+	go func() {
+		r.draining.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		r.log.Info("all connections ended")
+		return
+	case <-time.After(grace):
+	}
+
+	r.connsLock.Lock()
+	defer r.connsLock.Unlock()
+	r.log.Warn("grace period expired, closing active connections", zap.Int("active", len(r.active)), zap.Duration("grace", grace))
+	for conn := range r.active {
+		util.SilentClose(conn)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"server-socks/policy"
+	"socks5"
+
+	"go.uber.org/zap"
+)
+
+// runTestPolicy loads the policy of the default realm on its own, before
+// anything of the server is set up, and prints its decision on query
+func runTestPolicy(log *zap.Logger, out io.Writer, files realmFiles, settings *realmSettings, query string) (bool, error) {
+	loaded, err := files.load()
+	if err != nil {
+		return false, err
+	}
+	sa, err := policy.NewAuthenticator(log, loaded.destinations, loaded.denies, settings.resolver, settings.resolveWorkers, settings.geo)
+	if err != nil {
+		return false, err
+	}
+	sa.AllowAll = settings.allowAll
+	return testPolicy(out, sa, query)
+}
+
+// testPolicy asks the policy whether a user may reach host:port,
+// given like "jan example.com:443" or just "example.com:443" for clients
+// without a user, and prints the decision along with the destination or
+// deny rule that made it. The decision is a dry run, it is not logged,
+// written to log sinks or cached.
+func testPolicy(out io.Writer, p policy.Policy, query string) (bool, error) {
+	req, err := policyRequest(query)
+	if err != nil {
+		return false, err
+	}
+	ctx, allowed := p.Evaluate(context.Background(), req)
+	user := req.AuthContext.Payload["Username"]
+	if user == "" {
+		user = "no user"
+	}
+	if allowed {
+		name, _ := policy.DestinationFromContext(ctx)
+		if name == "" {
+			fmt.Fprintf(out, "allowed %s to %s by -allow-all\n", user, req.DestAddr)
+		} else {
+			fmt.Fprintf(out, "allowed %s to %s by destination %s\n", user, req.DestAddr, name)
+		}
+		return true, nil
+	}
+	reason, _ := policy.DenyReasonFromContext(ctx)
+	if rule := policy.DenyRuleFromContext(ctx); rule != "" {
+		fmt.Fprintf(out, "denied %s to %s by deny %s\n", user, req.DestAddr, rule)
+	} else {
+		fmt.Fprintf(out, "denied %s to %s: %s\n", user, req.DestAddr, reason)
+	}
+	return false, nil
+}
+
+// policyRequest builds the connect request of a -test-policy query, names
+// are resolved like the server resolves requested names
+func policyRequest(query string) (*socks5.Request, error) {
+	fields := strings.Fields(query)
+	user, hostPort := "", ""
+	switch len(fields) {
+	case 1:
+		hostPort = fields[0]
+	case 2:
+		user, hostPort = fields[0], fields[1]
+	default:
+		return nil, fmt.Errorf("invalid query %q, expected \"user host:port\"", query)
+	}
+	host, portString, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination %q: %v", hostPort, err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %q", portString)
+	}
+	dest := &socks5.AddrSpec{IP: net.ParseIP(host), Port: port}
+	if dest.IP == nil {
+		addr, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return nil, fmt.Errorf("can not resolve %s: %v", host, err)
+		}
+		dest.FQDN = host
+		dest.IP = addr.IP
+	}
+
+	payload := map[string]string{}
+	if user != "" {
+		payload["Username"] = user
+	}
+	return &socks5.Request{
+		Command:     socks5.ConnectCommand,
+		AuthContext: &socks5.AuthContext{Method: socks5.UserPassAuth, Payload: payload},
+		DestAddr:    dest,
+	}, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"server-socks/policy"
+	"socks5"
+
+	"go.uber.org/zap"
+)
+
+// reasons for a queued connection to be shed
+const (
+	shedReasonQueueFull = "queue_full"
+	shedReasonTimeout   = "timeout"
+)
+
+// tierQueue caps the connections served at once across all realms. Once
+// at capacity, connections wait for a slot and are handed one by the tier
+// of their user, higher tiers first. A full queue sheds its lowest tier
+// waiter to make room for a higher tier, and waiters give up after timeout.
+type tierQueue struct {
+	log       *zap.Logger
+	max       int
+	queueSize int
+	timeout   time.Duration
+	tiers     map[string]*UserLimit
+	lock      sync.Mutex
+	active    int
+	waiting   []*tierWaiter
+	seq       uint64
+}
+
+type tierWaiter struct {
+	tier int
+	seq  uint64
+	// granted receives whether a slot was handed over or the waiter was shed
+	granted chan bool
+}
+
+func newTierQueue(log *zap.Logger, max, queueSize int, timeout time.Duration, tiers map[string]*UserLimit) *tierQueue {
+	return &tierQueue{
+		log:       log,
+		max:       max,
+		queueSize: queueSize,
+		timeout:   timeout,
+		tiers:     tiers,
+	}
+}
+
+// wrap returns rules queueing allowed connect requests, nil disables it
+func (q *tierQueue) wrap(rules socks5.RuleSet) socks5.RuleSet {
+	if q == nil {
+		return rules
+	}
+	return &tierQueueRules{rules: rules, queue: q}
+}
+
+func (q *tierQueue) tier(userName string) int {
+	if limit, ok := q.tiers[userName]; ok {
+		return limit.Tier
+	}
+	return 0
+}
+
+// acquire takes a slot, waiting for one if needed. It returns false if the
+// connection was shed along with the reason.
+func (q *tierQueue) acquire(tier int) (bool, string) {
+	q.lock.Lock()
+	if q.active < q.max && len(q.waiting) == 0 {
+		q.active++
+		q.lock.Unlock()
+		tierAccepted.WithLabelValues(strconv.Itoa(tier)).Inc()
+		return true, ""
+	}
+	if len(q.waiting) >= q.queueSize {
+		lowest := q.lowest()
+		if lowest == -1 || q.waiting[lowest].tier >= tier {
+			q.lock.Unlock()
+			return false, shedReasonQueueFull
+		}
+		q.waiting[lowest].granted <- false
+		q.remove(lowest)
+	}
+	q.seq++
+	waiter := &tierWaiter{tier: tier, seq: q.seq, granted: make(chan bool, 1)}
+	q.waiting = append(q.waiting, waiter)
+	q.lock.Unlock()
+
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	select {
+	case granted := <-waiter.granted:
+		return q.granted(waiter, granted)
+	case <-timer.C:
+	}
+
+	q.lock.Lock()
+	for i, w := range q.waiting {
+		if w == waiter {
+			q.remove(i)
+			q.lock.Unlock()
+			return false, shedReasonTimeout
+		}
+	}
+	q.lock.Unlock()
+	// handed a slot or shed right as the timer fired
+	return q.granted(waiter, <-waiter.granted)
+}
+
+func (q *tierQueue) granted(waiter *tierWaiter, granted bool) (bool, string) {
+	if !granted {
+		return false, shedReasonQueueFull
+	}
+	tierAccepted.WithLabelValues(strconv.Itoa(waiter.tier)).Inc()
+	return true, ""
+}
+
+// release gives back a slot, handing it to the highest tier waiter
+func (q *tierQueue) release() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.active--
+	if len(q.waiting) == 0 || q.active >= q.max {
+		return
+	}
+	next := 0
+	for i, w := range q.waiting {
+		if w.tier > q.waiting[next].tier {
+			next = i
+		}
+	}
+	q.active++
+	q.waiting[next].granted <- true
+	q.remove(next)
+}
+
+// lowest returns the index of the lowest tier waiter, the latest of them
+// if several share it, or -1 if nobody waits
+func (q *tierQueue) lowest() int {
+	lowest := -1
+	for i, w := range q.waiting {
+		if lowest == -1 || w.tier <= q.waiting[lowest].tier {
+			lowest = i
+		}
+	}
+	return lowest
+}
+
+// remove drops the waiter at index i, keeping the order of the others
+func (q *tierQueue) remove(i int) {
+	q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+}
+
+// tierQueueRules wraps a socks5.RuleSet making allowed connect requests
+// wait in a tierQueue. The slot taken in Allow is given back in Release.
+type tierQueueRules struct {
+	rules socks5.RuleSet
+	queue *tierQueue
+}
+
+func (r *tierQueueRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	newCtx, allowed := r.rules.Allow(ctx, req)
+	if !allowed || req.Command != socks5.ConnectCommand {
+		return newCtx, allowed
+	}
+	userName := req.AuthContext.Payload["Username"]
+	tier := r.queue.tier(userName)
+	if ok, reason := r.queue.acquire(tier); !ok {
+		tierShed.WithLabelValues(strconv.Itoa(tier), reason).Inc()
+		r.queue.log.Info(
+			"denied - shed under load",
+			zap.String("to", req.DestAddr.String()),
+			zap.String("for", userName),
+			zap.String("from", policy.SourceIP(req)),
+			zap.Int("tier", tier),
+			zap.String("reason", reason),
+		)
+		r.release(newCtx, req)
+		return newCtx, false
+	}
+	return newCtx, true
+}
+
+func (r *tierQueueRules) Release(ctx context.Context, req *socks5.Request) {
+	if req.Command == socks5.ConnectCommand {
+		r.queue.release()
+	}
+	r.release(ctx, req)
+}
+
+// release passes the release on to the wrapped rules
+func (r *tierQueueRules) release(ctx context.Context, req *socks5.Request) {
+	if releaser, ok := r.rules.(socks5.RuleReleaser); ok {
+		releaser.Release(ctx, req)
+	}
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"socks5"
 )
 
@@ -14,7 +19,20 @@ func main() {
 	}
 
 	// Create SOCKS5 proxy on localhost port 8000
-	if err := server.ListenAndServe("tcp", "0.0.0.0:8000"); err != nil {
+	listener, err := net.Listen("tcp", "0.0.0.0:8000")
+	if err != nil {
+		panic(err)
+	}
+
+	// Stop serving on SIGINT or SIGTERM
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Stop()
+	}()
+
+	if err := server.Serve(listener); err != nil && err != socks5.ErrServerStopped {
 		panic(err)
 	}
 }
@@ -0,0 +1,112 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// bindAcceptTimeout is how long a bind waits for the peer to connect
+const bindAcceptTimeout = 2 * time.Minute
+
+// bind handles a bind command. It listens for a single inbound connection
+// on behalf of the client and replies twice, first with the address it
+// listens on and then with the address of the peer that connected, before
+// relaying between the client and the peer.
+func (s *Server) bind(ctx context.Context, conn conn, req *Request) error {
+	// Check if this is allowed
+	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
+		if err := sendReply(conn, denyReply(ctx_), nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Bind to %v blocked by rules", req.DestAddr)
+	} else {
+		ctx = ctx_
+	}
+	defer s.release(ctx, req)
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: s.bindIP(conn)})
+	if err != nil {
+		if err := sendReply(conn, serverFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Bind failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// First reply, the address the peer is expected to connect to
+	local := listener.Addr().(*net.TCPAddr)
+	if err := sendReply(conn, successReply, &AddrSpec{IP: local.IP, Port: local.Port}); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+	// waiting for the peer is bounded by bindAcceptTimeout instead
+	s.handshakeDone(conn)
+
+	_ = listener.SetDeadline(time.Now().Add(bindAcceptTimeout))
+	peer, err := listener.AcceptTCP()
+	if err != nil {
+		if err := sendReply(conn, ttlExpired, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Bind failed to accept: %v", err)
+	}
+	defer peer.Close()
+	// only a single peer is accepted
+	_ = listener.Close()
+
+	// Check the peer that connected, a bind can not pick who connects
+	remote := peer.RemoteAddr().(*net.TCPAddr)
+	peerReq := *req
+	peerReq.DestAddr = &AddrSpec{IP: remote.IP, Port: req.DestAddr.Port}
+	peerReq.realDestAddr = peerReq.DestAddr
+	peerReq.bindPeer = true
+	var relayed net.Conn = peer
+	if ctx_, ok := s.config.Rules.Allow(ctx, &peerReq); !ok {
+		if err := sendReply(conn, denyReply(ctx_), nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Bind peer %v blocked by rules", remote)
+	} else {
+		defer s.release(ctx_, &peerReq)
+		if s.config.BindConn != nil {
+			relayed = s.config.BindConn(ctx_, peer)
+			defer relayed.Close()
+		}
+	}
+
+	// Second reply, the address of the peer
+	if err := sendReply(conn, successReply, &AddrSpec{IP: remote.IP, Port: remote.Port}); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+
+	// Start proxying
+	errCh := make(chan error, 2)
+	go proxy(relayed, req.bufConn, errCh)
+	go proxy(conn, relayed, errCh)
+
+	// Wait
+	for i := 0; i < 2; i++ {
+		e := <-errCh
+		if e != nil {
+			// return from this function closes peer (and conn).
+			return e
+		}
+	}
+	return nil
+}
+
+// bindIP is the ip bind and udp associate listen on, BindIP or else the
+// local ip of the control connection
+func (s *Server) bindIP(conn conn) net.IP {
+	if s.config.BindIP != nil {
+		return s.config.BindIP
+	}
+	if local, ok := conn.(interface{ LocalAddr() net.Addr }); ok {
+		if tcpAddr, ok := local.LocalAddr().(*net.TCPAddr); ok {
+			return tcpAddr.IP
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// permitIP allows requests to a single ip only
+type permitIP struct {
+	ip net.IP
+}
+
+func (r permitIP) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return ctx, req.DestAddr.IP.Equal(r.ip)
+}
+
+// countedConn counts the bytes read from and written to a connection
+type countedConn struct {
+	net.Conn
+	read, written int64
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func TestSOCKS5_Bind(t *testing.T) {
+	for _, test := range []struct {
+		expected net.IP
+		accepted bool
+	}{
+		{net.IPv4(127, 0, 0, 1), true},
+		// the peer connects from 127.0.0.1 instead of the expected ip
+		{net.IPv4(127, 0, 0, 2), false},
+	} {
+		// Create a socks server
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		counted := make(chan *countedConn, 1)
+		serv, err := New(&Config{
+			Rules:      permitIP{test.expected},
+			EnableBind: true,
+			Logger:     log.New(os.Stdout, "", log.LstdFlags),
+			BindConn: func(ctx context.Context, peer net.Conn) net.Conn {
+				c := &countedConn{Conn: peer}
+				counted <- c
+				return c
+			},
+		})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		go serv.Serve(l)
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		// No auth and bind for a peer from the expected ip
+		conn.Write([]byte{5, 1, NoAuth})
+		conn.Write(appendAddrSpec([]byte{5, BindCommand, 0}, &AddrSpec{IP: test.expected, Port: 0}))
+
+		out := make([]byte, 2+10)
+		if _, err := io.ReadAtLeast(conn, out, len(out)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out[3] != successReply {
+			t.Fatalf("bad: %v", out)
+		}
+		bound := &net.TCPAddr{IP: net.IP(out[6:10]), Port: int(out[10])<<8 | int(out[11])}
+
+		peer, err := net.Dial("tcp", bound.String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		second := make([]byte, 10)
+		if _, err := io.ReadAtLeast(conn, second, len(second)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !test.accepted {
+			if second[1] != ReplyNotAllowed {
+				t.Fatalf("bad: %v", second)
+			}
+			peer.Close()
+			conn.Close()
+			l.Close()
+			continue
+		}
+		local := peer.LocalAddr().(*net.TCPAddr)
+		if second[1] != successReply || !net.IP(second[4:8]).Equal(local.IP) || int(second[8])<<8|int(second[9]) != local.Port {
+			t.Fatalf("bad: %v, peer %v", second, local)
+		}
+
+		// Relay both ways
+		peer.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil || !bytes.Equal(buf, []byte("ping")) {
+			t.Fatalf("bad: %v %v", buf, err)
+		}
+		conn.Write([]byte("pong"))
+		peer.SetDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadAtLeast(peer, buf, 4); err != nil || !bytes.Equal(buf, []byte("pong")) {
+			t.Fatalf("bad: %v %v", buf, err)
+		}
+		// the relayed peer connection went through BindConn
+		c := <-counted
+		if read, written := atomic.LoadInt64(&c.read), atomic.LoadInt64(&c.written); read != 4 || written != 4 {
+			t.Fatalf("bad: %d bytes read and %d written through BindConn", read, written)
+		}
+		peer.Close()
+		conn.Close()
+		l.Close()
+	}
+}
@@ -79,6 +79,14 @@ type Request struct {
 	// AddrSpec of the actual destination (might be affected by rewrite)
 	realDestAddr *AddrSpec
 	bufConn      io.Reader
+	// bindPeer is set on the request checking the peer of a bind
+	bindPeer bool
+}
+
+// BindPeer tells if the request checks the peer that connected to a bind,
+// the bind itself was allowed by a request of its own
+func (r *Request) BindPeer() bool {
+	return r.bindPeer
 }
 
 type conn interface {
@@ -159,13 +167,14 @@ func (s *Server) handleRequest(req *Request, conn conn) error {
 func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
 	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+		if err := sendReply(conn, denyReply(ctx_), nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return fmt.Errorf("Connect to %v blocked by rules", req.DestAddr)
 	} else {
 		ctx = ctx_
 	}
+	defer s.release(ctx, req)
 
 	// Attempt to connect
 	dial := s.config.Dial
@@ -196,6 +205,7 @@ func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) err
 	if err := sendReply(conn, successReply, &bind); err != nil {
 		return fmt.Errorf("Failed to send reply: %v", err)
 	}
+	s.handshakeDone(conn)
 
 	// Start proxying
 	errCh := make(chan error, 2)
@@ -213,17 +223,22 @@ func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) err
 	return nil
 }
 
-// handleBind is used to handle a connect command
+// handleBind is used to handle a bind command
 func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error {
+	if s.config.EnableBind {
+		return s.bind(ctx, conn, req)
+	}
+
 	// Check if this is allowed
 	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+		if err := sendReply(conn, denyReply(ctx_), nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return fmt.Errorf("Bind to %v blocked by rules", req.DestAddr)
 	} else {
 		ctx = ctx_
 	}
+	defer s.release(ctx, req)
 
 	// TODO: Support bind
 	if err := sendReply(conn, commandNotSupported, nil); err != nil {
@@ -234,15 +249,20 @@ func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error
 
 // handleAssociate is used to handle a connect command
 func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) error {
+	if s.config.EnableAssociate {
+		return s.associate(ctx, conn, req)
+	}
+
 	// Check if this is allowed
 	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+		if err := sendReply(conn, denyReply(ctx_), nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return fmt.Errorf("Associate to %v blocked by rules", req.DestAddr)
 	} else {
 		ctx = ctx_
 	}
+	defer s.release(ctx, req)
 
 	// TODO: Support associate
 	if err := sendReply(conn, commandNotSupported, nil); err != nil {
@@ -251,6 +271,13 @@ func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) e
 	return nil
 }
 
+// release notifies the RuleSet, if it cares, that an allowed request is done
+func (s *Server) release(ctx context.Context, req *Request) {
+	if r, ok := s.config.Rules.(RuleReleaser); ok {
+		r.Release(ctx, req)
+	}
+}
+
 // readAddrSpec is used to read AddrSpec.
 // Expects an address type byte, follwed by the address and port
 func readAddrSpec(r io.Reader) (*AddrSpec, error) {
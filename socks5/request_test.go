@@ -9,6 +9,8 @@ import (
 	"os"
 	"strings"
 	"testing"
+
+	"golang.org/x/net/context"
 )
 
 type MockConn struct {
@@ -167,3 +169,71 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 		t.Fatalf("bad: %v %v", out, expected)
 	}
 }
+
+type releaseCounter struct {
+	allow    bool
+	released int
+}
+
+func (r *releaseCounter) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return ctx, r.allow
+}
+
+func (r *releaseCounter) Release(ctx context.Context, req *Request) {
+	r.released++
+}
+
+func TestRequest_Release(t *testing.T) {
+	for _, allow := range []bool{true, false} {
+		rules := &releaseCounter{allow: allow}
+		s := &Server{config: &Config{
+			Rules:    rules,
+			Resolver: DNSResolver{},
+			Logger:   log.New(os.Stdout, "", log.LstdFlags),
+		}}
+
+		// Bind is not supported, so the request completes right away
+		buf := bytes.NewBuffer([]byte{5, 2, 0, 1, 127, 0, 0, 1, 0, 80})
+		req, err := NewRequest(buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		s.handleRequest(req, &MockConn{})
+
+		expected := 0
+		if allow {
+			expected = 1
+		}
+		if rules.released != expected {
+			t.Fatalf("allow %v: expected %d releases, got %d", allow, expected, rules.released)
+		}
+	}
+}
+
+// denyWithReply denies every request with reply
+type denyWithReply uint8
+
+func (r denyWithReply) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return WithDenyReply(ctx, uint8(r)), false
+}
+
+func TestRequest_Connect_DenyReply(t *testing.T) {
+	s := &Server{config: &Config{
+		Rules:    denyWithReply(ReplyHostUnreachable),
+		Resolver: DNSResolver{},
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	buf := bytes.NewBuffer([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	resp := &MockConn{}
+	req, err := NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, resp); !strings.Contains(err.Error(), "blocked by rules") {
+		t.Fatalf("err: %v", err)
+	}
+	if out := resp.buf.Bytes(); out[1] != hostUnreachable {
+		t.Fatalf("bad reply: %v", out)
+	}
+}
@@ -9,6 +9,13 @@ type RuleSet interface {
 	Allow(ctx context.Context, req *Request) (context.Context, bool)
 }
 
+// RuleReleaser can optionally be implemented by a RuleSet that needs to
+// know when a request it has allowed is finished, e.g. to free resources
+// reserved in Allow. Release is called exactly once per allowed request.
+type RuleReleaser interface {
+	Release(ctx context.Context, req *Request)
+}
+
 // PermitAll returns a RuleSet which allows all types of connections
 func PermitAll() RuleSet {
 	return &PermitCommand{true, true, true}
@@ -39,3 +46,29 @@ func (p *PermitCommand) Allow(ctx context.Context, req *Request) (context.Contex
 
 	return ctx, false
 }
+
+// Replies a RuleSet may send instead of the generic rule failure when it
+// denies a request, see WithDenyReply
+const (
+	ReplyNotAllowed         = ruleFailure
+	ReplyNetworkUnreachable = networkUnreachable
+	ReplyHostUnreachable    = hostUnreachable
+	ReplyConnectionRefused  = connectionRefused
+)
+
+type denyReplyKey struct{}
+
+// WithDenyReply returns a context for a RuleSet to return from a denying
+// Allow to choose the reply sent to the client
+func WithDenyReply(ctx context.Context, reply uint8) context.Context {
+	return context.WithValue(ctx, denyReplyKey{}, reply)
+}
+
+// denyReply returns the reply chosen by the RuleSet for a denied request,
+// the generic rule failure if it did not choose one
+func denyReply(ctx context.Context) uint8 {
+	if reply, ok := ctx.Value(denyReplyKey{}).(uint8); ok {
+		return reply
+	}
+	return ruleFailure
+}
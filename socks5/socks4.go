@@ -0,0 +1,118 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	socks4Version  = uint8(4)
+	socks4Granted  = uint8(90)
+	socks4Rejected = uint8(91)
+	// socks4MaxField bounds the null terminated userid and hostname
+	socks4MaxField = 255
+)
+
+// serveSOCKS4 serves a SOCKS4 or SOCKS4a connect request whose version
+// byte has been read already. SOCKS4 has no authentication, so requests are
+// rejected unless the server allows clients without authentication. The
+// userid of the request is only passed to the rules as the Username if
+// SOCKS4TrustUserID is set.
+func (s *Server) serveSOCKS4(conn net.Conn, bufConn *bufio.Reader) error {
+	// command, port and ip
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(bufConn, header); err != nil {
+		return fmt.Errorf("Failed to read SOCKS4 request: %v", err)
+	}
+	userID, err := readNullTerminated(bufConn)
+	if err != nil {
+		return fmt.Errorf("Failed to read SOCKS4 userid: %v", err)
+	}
+	dest := &AddrSpec{IP: net.IP(header[3:7]), Port: int(header[1])<<8 | int(header[2])}
+	// SOCKS4a sends an ip of 0.0.0.x followed by the hostname to resolve
+	if dest.IP[0] == 0 && dest.IP[1] == 0 && dest.IP[2] == 0 && dest.IP[3] != 0 {
+		if dest.FQDN, err = readNullTerminated(bufConn); err != nil {
+			return fmt.Errorf("Failed to read SOCKS4a hostname: %v", err)
+		}
+		dest.IP = nil
+	}
+
+	if _, ok := s.authMethods[NoAuth]; !ok {
+		_ = sendSOCKS4Reply(conn, socks4Rejected)
+		return fmt.Errorf("SOCKS4 request to %v denied, authentication is mandatory", dest)
+	}
+	if header[0] != ConnectCommand {
+		_ = sendSOCKS4Reply(conn, socks4Rejected)
+		return fmt.Errorf("Unsupported SOCKS4 command: %v", header[0])
+	}
+
+	payload := map[string]string{}
+	if userID != "" && s.config.SOCKS4TrustUserID {
+		payload["Username"] = userID
+	}
+	request := &Request{
+		Version:     socks4Version,
+		Command:     ConnectCommand,
+		AuthContext: &AuthContext{Method: NoAuth, Payload: payload},
+		DestAddr:    dest,
+		bufConn:     bufConn,
+	}
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
+	}
+	return s.handleRequest(request, &socks4Conn{Conn: conn})
+}
+
+func readNullTerminated(r *bufio.Reader) (string, error) {
+	field := []byte{}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(field), nil
+		}
+		if len(field) == socks4MaxField {
+			return "", fmt.Errorf("field longer than %d bytes", socks4MaxField)
+		}
+		field = append(field, b)
+	}
+}
+
+func sendSOCKS4Reply(w io.Writer, resp uint8) error {
+	// the port and ip of a connect reply are ignored by clients
+	_, err := w.Write([]byte{0, resp, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socks4Conn translates the first write, the SOCKS5 reply to the request,
+// into a SOCKS4 reply, and passes the proxied data on unchanged
+type socks4Conn struct {
+	net.Conn
+	replied bool
+}
+
+func (c *socks4Conn) Write(b []byte) (int, error) {
+	if c.replied {
+		return c.Conn.Write(b)
+	}
+	c.replied = true
+	resp := socks4Rejected
+	if len(b) > 1 && b[1] == successReply {
+		resp = socks4Granted
+	}
+	if err := sendSOCKS4Reply(c.Conn, resp); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks4Conn) CloseWrite() error {
+	if closeWriter, ok := c.Conn.(closeWriter); ok {
+		return closeWriter.CloseWrite()
+	}
+	return nil
+}
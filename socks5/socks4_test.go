@@ -0,0 +1,106 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestSOCKS4_Connect(t *testing.T) {
+	// Create a local listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err == nil && bytes.Equal(buf, []byte("ping")) {
+				conn.Write([]byte("pong"))
+			}
+			conn.Close()
+		}
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	// the userid is only the username if it is trusted
+	for trust, expected := range map[bool]string{false: "", true: "jan"} {
+		users := make(chan string, 1)
+		serv, err := New(&Config{
+			AuthMethods:       []Authenticator{NoAuthAuthenticator{}},
+			EnableSOCKS4:      true,
+			SOCKS4TrustUserID: trust,
+			Rules:             userRecorder(users),
+			Logger:            log.New(os.Stdout, "", log.LstdFlags),
+		})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		client, server := net.Pipe()
+		go serv.ServeConn(server)
+
+		// SOCKS4a connect to localhost with the userid jan
+		req := []byte{socks4Version, ConnectCommand, byte(lAddr.Port >> 8), byte(lAddr.Port), 0, 0, 0, 1}
+		req = append(req, "jan\x00localhost\x00ping"...)
+		go client.Write(req)
+
+		reply := make([]byte, 8)
+		if _, err := io.ReadFull(client, reply); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if reply[1] != socks4Granted {
+			t.Fatalf("bad reply: %v", reply)
+		}
+		pong := make([]byte, 4)
+		if _, err := io.ReadFull(client, pong); err != nil || !bytes.Equal(pong, []byte("pong")) {
+			t.Fatalf("bad: %v %v", pong, err)
+		}
+		if user := <-users; user != expected {
+			t.Fatalf("trusting the userid %v, expected the username %q, got %q", trust, expected, user)
+		}
+		client.Close()
+	}
+}
+
+func TestSOCKS4_AuthMandatory(t *testing.T) {
+	serv, err := New(&Config{
+		Credentials:  StaticCredentials{"foo": "bar"},
+		EnableSOCKS4: true,
+		Logger:       log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go serv.ServeConn(server)
+	go client.Write([]byte{socks4Version, ConnectCommand, 0, 80, 127, 0, 0, 1, 0})
+
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply[1] != socks4Rejected {
+		t.Fatalf("SOCKS4 should be rejected when authentication is mandatory: %v", reply)
+	}
+}
+
+// userRecorder permits all requests and records their Username
+type userRecorder chan string
+
+func (r userRecorder) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	r <- req.AuthContext.Payload["Username"]
+	return ctx, true
+}
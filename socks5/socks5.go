@@ -2,10 +2,13 @@ package socks5
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -42,12 +45,53 @@ type Config struct {
 	// BindIP is used for bind or udp associate
 	BindIP net.IP
 
+	// EnableAssociate enables the udp associate command. Rules are then
+	// asked about every datagram instead of the association itself.
+	EnableAssociate bool
+
+	// EnableBind enables the bind command. Rules are asked about the
+	// request and again about the peer connecting to the bound port, with
+	// the ip of the peer and the port of the request as DestAddr and
+	// BindPeer set.
+	EnableBind bool
+
+	// EnableSOCKS4 serves SOCKS4 and SOCKS4a connect requests as well. As
+	// SOCKS4 has no authentication, they are only served if NoAuth is among
+	// the AuthMethods, without a Username.
+	EnableSOCKS4 bool
+
+	// SOCKS4TrustUserID passes the unverified userid SOCKS4 clients send to
+	// the rules as the Username. INSECURE, any client can claim any user.
+	SOCKS4TrustUserID bool
+
+	// HandshakeTimeout bounds the method, auth and request exchange of a
+	// connection by a deadline, cleared once the request succeeded. 0
+	// leaves the deadlines of connections alone.
+	HandshakeTimeout time.Duration
+
 	// Logger can be used to provide a custom log target.
 	// Defaults to stdout.
 	Logger *log.Logger
 
 	// Optional function for dialing out
 	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// BindConn optionally wraps the peer connection accepted by a bind
+	// before it is relayed, like Dial can wrap the connections it dials.
+	// ctx is the one the rules returned for the peer.
+	BindConn func(ctx context.Context, peer net.Conn) net.Conn
+
+	// Datagram is optionally called with the size of every datagram an
+	// udp association relays, up for those of the client and down for
+	// answers to it. ctx is the one the rules returned for the datagram
+	// destination. Datagrams it returns false for are dropped.
+	Datagram func(ctx context.Context, n int, up bool) bool
+
+	// Associate is optionally called as an udp association starts, with
+	// the request of the association. It returns the ctx the datagrams of
+	// the association are decided with and a func called once the
+	// association ended. Associations it returns false for are rejected.
+	Associate func(ctx context.Context, req *Request) (context.Context, func(), bool)
 }
 
 // Server is reponsible for accepting connections and handling
@@ -55,8 +99,17 @@ type Config struct {
 type Server struct {
 	config      *Config
 	authMethods map[uint8]Authenticator
+
+	// listeners being served, closed by Stop
+	lock      sync.Mutex
+	listeners map[net.Listener]struct{}
+	stopped   bool
 }
 
+// ErrServerStopped is returned by Serve and ListenAndServe once Stop was
+// called
+var ErrServerStopped = errors.New("socks: Server stopped")
+
 // New creates a new Server and potentially returns an error
 func New(conf *Config) (*Server, error) {
 	// Ensure we have at least one authentication method enabled
@@ -105,11 +158,20 @@ func (s *Server) ListenAndServe(network, addr string) error {
 	return s.Serve(l)
 }
 
-// Serve is used to serve connections from a listener
+// Serve is used to serve connections from a listener until it fails or
+// Stop is called, which makes it return ErrServerStopped
 func (s *Server) Serve(l net.Listener) error {
+	if !s.addListener(l) {
+		l.Close()
+		return ErrServerStopped
+	}
+	defer s.removeListener(l)
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.isStopped() {
+				return ErrServerStopped
+			}
 			return err
 		}
 		go s.ServeConn(conn)
@@ -117,9 +179,55 @@ func (s *Server) Serve(l net.Listener) error {
 	return nil
 }
 
+// Stop closes the listeners being served so Serve returns, later calls of
+// Serve return right away. Connections already accepted are left to end
+// on their own.
+func (s *Server) Stop() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stopped = true
+	var err error
+	for l := range s.listeners {
+		if closeErr := l.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	s.listeners = nil
+	return err
+}
+
+// addListener registers l to be closed by Stop, false if already stopped
+func (s *Server) addListener(l net.Listener) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = map[net.Listener]struct{}{}
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) removeListener(l net.Listener) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.listeners, l)
+}
+
+func (s *Server) isStopped() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stopped
+}
+
 // ServeConn is used to serve a single connection.
 func (s *Server) ServeConn(conn net.Conn) error {
 	defer conn.Close()
+	if s.config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.config.HandshakeTimeout))
+	}
 	bufConn := bufio.NewReader(conn)
 
 	// Read the version byte
@@ -129,6 +237,14 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		return err
 	}
 
+	if version[0] == socks4Version && s.config.EnableSOCKS4 {
+		if err := s.serveSOCKS4(conn, bufConn); err != nil {
+			s.config.Logger.Printf("[ERR] socks: %v", err)
+			return err
+		}
+		return nil
+	}
+
 	// Ensure we are compatible
 	if version[0] != socks5Version {
 		err := fmt.Errorf("Unsupported SOCKS version: %v", version)
@@ -167,3 +283,14 @@ func (s *Server) ServeConn(conn net.Conn) error {
 
 	return nil
 }
+
+// handshakeDone clears the deadline of the HandshakeTimeout once a request
+// succeeded and its data is about to be relayed
+func (s *Server) handshakeDone(conn conn) {
+	if s.config.HandshakeTimeout == 0 {
+		return
+	}
+	if deadliner, ok := conn.(interface{ SetDeadline(time.Time) error }); ok {
+		deadliner.SetDeadline(time.Time{})
+	}
+}
@@ -108,3 +108,103 @@ func TestSOCKS5_Connect(t *testing.T) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+func TestSOCKS5_HandshakeTimeout(t *testing.T) {
+	// Create a local echo server
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	tAddr := target.Addr().(*net.TCPAddr)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	serv, err := New(&Config{
+		HandshakeTimeout: 50 * time.Millisecond,
+		Logger:           log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+
+	// A stalled handshake is closed
+	stalled, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stalled.Close()
+	stalled.Write([]byte{5, 1})
+	stalled.SetDeadline(time.Now().Add(time.Second))
+	if _, err := stalled.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the stalled handshake to be closed, got %v", err)
+	}
+
+	// An established connection outlives the timeout
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(appendAddrSpec([]byte{5, 1, NoAuth, 5, 1, 0}, &AddrSpec{IP: tAddr.IP, Port: tAddr.Port}))
+	out := make([]byte, 2+10)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, out); err != nil || out[3] != successReply {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, out[:4]); err != nil || !bytes.Equal(out[:4], []byte("ping")) {
+		t.Fatalf("bad: %v %v", out[:4], err)
+	}
+}
+
+func TestSOCKS5_Stop(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serv, err := New(&Config{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- serv.Serve(l)
+	}()
+
+	if err := serv.Stop(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case err := <-served:
+		if err != ErrServerStopped {
+			t.Fatalf("expected ErrServerStopped, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after Stop")
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("expected the listener to be closed")
+	}
+
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := serv.Serve(l2); err != ErrServerStopped {
+		t.Fatalf("expected ErrServerStopped serving after Stop, got %v", err)
+	}
+}
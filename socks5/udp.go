@@ -0,0 +1,235 @@
+package socks5
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// udpBufferSize fits any udp datagram
+	udpBufferSize = 65535
+
+	// associateDecisionTTL is how long a decision of the RuleSet about a
+	// datagram destination is reused within an association
+	associateDecisionTTL = 10 * time.Second
+
+	// associateTargetTTL is how long a destination may answer after the
+	// last datagram sent to it, once an association has
+	// associateMaxDestinations of them
+	associateTargetTTL = time.Minute
+
+	// associateMaxDestinations bounds the destinations an association keeps
+	// decisions and answering targets for. Decisions beyond are not cached,
+	// datagrams to further targets are dropped.
+	associateMaxDestinations = 1024
+)
+
+// associate handles an udp associate command. The association is not
+// checked against the RuleSet, as it has no destination yet, instead every
+// datagram is, with the datagram destination as DestAddr. The association
+// ends with the control connection.
+func (s *Server) associate(ctx context.Context, conn conn, req *Request) error {
+	if s.config.Associate != nil {
+		ctx_, done, ok := s.config.Associate(ctx, req)
+		if !ok {
+			if err := sendReply(conn, denyReply(ctx_), nil); err != nil {
+				return fmt.Errorf("Failed to send reply: %v", err)
+			}
+			return fmt.Errorf("Associate from %v rejected", req.RemoteAddr)
+		}
+		ctx = ctx_
+		if done != nil {
+			defer done()
+		}
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: s.bindIP(conn)})
+	if err != nil {
+		if err := sendReply(conn, serverFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Associate failed to listen: %v", err)
+	}
+	defer relay.Close()
+
+	local := relay.LocalAddr().(*net.UDPAddr)
+	if err := sendReply(conn, successReply, &AddrSpec{IP: local.IP, Port: local.Port}); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+	s.handshakeDone(conn)
+
+	a := &association{
+		server:    s,
+		ctx:       ctx,
+		req:       req,
+		relay:     relay,
+		decisions: map[string]associateDecision{},
+		targets:   map[string]associateTarget{},
+	}
+	if req.RemoteAddr != nil {
+		a.clientIP = req.RemoteAddr.IP
+	}
+	go a.serve()
+
+	// the client keeps the control connection open as long as it associates
+	_, err = io.Copy(ioutil.Discard, req.bufConn)
+	return err
+}
+
+type associateDecision struct {
+	allowed bool
+	at      time.Time
+	// ctx the rules returned for the destination
+	ctx context.Context
+}
+
+// associateTarget is a destination datagrams were sent to
+type associateTarget struct {
+	// ctx the rules returned for the destination
+	ctx context.Context
+	// at is when the last datagram was sent to it
+	at time.Time
+}
+
+// association relays datagrams between a client and its destinations
+type association struct {
+	server   *Server
+	ctx      context.Context
+	req      *Request
+	relay    *net.UDPConn
+	clientIP net.IP
+	// client is learned from the first datagram coming from clientIP
+	client    *net.UDPAddr
+	decisions map[string]associateDecision
+	// targets datagrams were sent to, only they may answer
+	targets map[string]associateTarget
+}
+
+func (a *association) serve() {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if a.isClient(from) {
+			a.client = from
+			a.forward(buf[:n])
+		} else if target, ok := a.targets[from.String()]; ok && a.client != nil {
+			a.reply(target.ctx, from, buf[:n])
+		}
+	}
+}
+
+func (a *association) isClient(from *net.UDPAddr) bool {
+	if a.client != nil {
+		return a.client.IP.Equal(from.IP) && a.client.Port == from.Port
+	}
+	return a.clientIP == nil || a.clientIP.Equal(from.IP)
+}
+
+// forward sends a datagram of the client to its destination, if allowed
+func (a *association) forward(datagram []byte) {
+	// RSV RSV FRAG, fragments are not supported and dropped
+	if len(datagram) < 3 || datagram[2] != 0 {
+		return
+	}
+	reader := bytes.NewReader(datagram[3:])
+	dest, err := readAddrSpec(reader)
+	if err != nil {
+		return
+	}
+	data := datagram[len(datagram)-reader.Len():]
+
+	if dest.FQDN != "" {
+		_, addr, err := a.server.config.Resolver.Resolve(a.ctx, dest.FQDN)
+		if err != nil {
+			return
+		}
+		dest.IP = addr
+	}
+	ctx, allowed := a.allowed(dest)
+	if !allowed || !a.counted(ctx, len(data), true) {
+		return
+	}
+	target := &net.UDPAddr{IP: dest.IP, Port: dest.Port}
+	key := target.String()
+	if _, ok := a.targets[key]; !ok && len(a.targets) >= associateMaxDestinations {
+		for known, target := range a.targets {
+			if time.Since(target.at) >= associateTargetTTL {
+				delete(a.targets, known)
+			}
+		}
+		if len(a.targets) >= associateMaxDestinations {
+			return
+		}
+	}
+	a.targets[key] = associateTarget{ctx: ctx, at: time.Now()}
+	_, _ = a.relay.WriteToUDP(data, target)
+}
+
+// allowed asks the RuleSet about a datagram destination, returning the
+// ctx of its decision
+func (a *association) allowed(dest *AddrSpec) (context.Context, bool) {
+	key := dest.Address()
+	if decision, ok := a.decisions[key]; ok && time.Since(decision.at) < associateDecisionTTL {
+		return decision.ctx, decision.allowed
+	}
+	datagramReq := &Request{
+		Version:      a.req.Version,
+		Command:      AssociateCommand,
+		AuthContext:  a.req.AuthContext,
+		RemoteAddr:   a.req.RemoteAddr,
+		DestAddr:     dest,
+		realDestAddr: dest,
+	}
+	ctx, allowed := a.server.config.Rules.Allow(a.ctx, datagramReq)
+	if allowed {
+		// the datagram is all there is to the request
+		a.server.release(ctx, datagramReq)
+	}
+	if len(a.decisions) >= associateMaxDestinations {
+		for known, decision := range a.decisions {
+			if time.Since(decision.at) >= associateDecisionTTL {
+				delete(a.decisions, known)
+			}
+		}
+	}
+	if len(a.decisions) < associateMaxDestinations {
+		a.decisions[key] = associateDecision{allowed: allowed, at: time.Now(), ctx: ctx}
+	}
+	return ctx, allowed
+}
+
+// counted passes the size of a datagram to the Datagram hook, if any
+func (a *association) counted(ctx context.Context, n int, up bool) bool {
+	if a.server.config.Datagram == nil {
+		return true
+	}
+	return a.server.config.Datagram(ctx, n, up)
+}
+
+// reply sends a datagram of a destination back to the client
+func (a *association) reply(ctx context.Context, from *net.UDPAddr, data []byte) {
+	if !a.counted(ctx, len(data), false) {
+		return
+	}
+	datagram := appendAddrSpec([]byte{0, 0, 0}, &AddrSpec{IP: from.IP, Port: from.Port})
+	_, _ = a.relay.WriteToUDP(append(datagram, data...), a.client)
+}
+
+// appendAddrSpec appends an ip address and port the way readAddrSpec reads
+// them
+func appendAddrSpec(b []byte, addr *AddrSpec) []byte {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append(append(b, ipv4Address), ip4...)
+	} else {
+		b = append(append(b, ipv6Address), addr.IP.To16()...)
+	}
+	return append(b, byte(addr.Port>>8), byte(addr.Port&0xff))
+}
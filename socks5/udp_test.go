@@ -0,0 +1,195 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestSOCKS5_Associate(t *testing.T) {
+	// Create a local udp echo server
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(bytes.ToUpper(buf[:n]), from)
+		}
+	}()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+
+	for _, test := range []struct {
+		rules RuleSet
+		// metered is what the Datagram hook returns
+		metered  bool
+		answered bool
+	}{
+		{PermitAll(), true, true},
+		{&PermitCommand{EnableConnect: true}, true, false},
+		{PermitAll(), false, false},
+	} {
+		var up, down int64
+		metered := test.metered
+		// Create a socks server
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		serv, err := New(&Config{
+			Rules:           test.rules,
+			EnableAssociate: true,
+			Logger:          log.New(os.Stdout, "", log.LstdFlags),
+			Datagram: func(ctx context.Context, n int, isUp bool) bool {
+				if isUp {
+					atomic.AddInt64(&up, int64(n))
+				} else {
+					atomic.AddInt64(&down, int64(n))
+				}
+				return metered
+			},
+		})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		go serv.Serve(l)
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		// No auth and associate from any address
+		conn.Write([]byte{5, 1, NoAuth})
+		conn.Write([]byte{5, AssociateCommand, 0, ipv4Address, 0, 0, 0, 0, 0, 0})
+
+		out := make([]byte, 2+10)
+		if _, err := io.ReadAtLeast(conn, out, len(out)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out[3] != successReply {
+			t.Fatalf("bad: %v", out)
+		}
+		relay := &net.UDPAddr{IP: net.IP(out[6:10]), Port: int(out[10])<<8 | int(out[11])}
+
+		client, err := net.DialUDP("udp", nil, relay)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		datagram := appendAddrSpec([]byte{0, 0, 0}, &AddrSpec{IP: echoAddr.IP, Port: echoAddr.Port})
+		client.Write(append(datagram, "ping"...))
+
+		client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, 1024)
+		n, err := client.Read(buf)
+		if !test.answered {
+			if err == nil {
+				t.Fatalf("expected the datagram to be dropped, got: %v", buf[:n])
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if expected := append(datagram, "PING"...); !bytes.Equal(buf[:n], expected) {
+				t.Fatalf("bad: %v", buf[:n])
+			}
+			// the payloads both ways went through the Datagram hook
+			if up, down := atomic.LoadInt64(&up), atomic.LoadInt64(&down); up != 4 || down != 4 {
+				t.Fatalf("bad: %d bytes up and %d down through Datagram", up, down)
+			}
+		}
+		client.Close()
+		conn.Close()
+		l.Close()
+	}
+}
+
+func TestSOCKS5_AssociateRejected(t *testing.T) {
+	for _, accept := range []bool{false, true} {
+		done := make(chan struct{})
+		serv, err := New(&Config{
+			EnableAssociate: true,
+			Logger:          log.New(os.Stdout, "", log.LstdFlags),
+			Associate: func(ctx context.Context, req *Request) (context.Context, func(), bool) {
+				return ctx, func() { close(done) }, accept
+			},
+		})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		client, server := net.Pipe()
+		go serv.ServeConn(server)
+		client.SetDeadline(time.Now().Add(time.Second))
+		go client.Write([]byte{5, 1, NoAuth, 5, AssociateCommand, 0, ipv4Address, 0, 0, 0, 0, 0, 0})
+
+		out := make([]byte, 2+10)
+		if _, err := io.ReadFull(client, out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if accept != (out[3] == successReply) {
+			t.Fatalf("accepted %v, bad reply: %v", accept, out)
+		}
+		client.Close()
+		if accept {
+			// the association ends with the control connection
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("the end of the association was not reported")
+			}
+		}
+	}
+}
+
+func TestSOCKS5_AssociateBounded(t *testing.T) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer relay.Close()
+	serv, err := New(&Config{Rules: PermitAll(), EnableAssociate: true})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	a := &association{
+		server:    serv,
+		ctx:       context.Background(),
+		req:       &Request{AuthContext: &AuthContext{}},
+		relay:     relay,
+		decisions: map[string]associateDecision{},
+		targets:   map[string]associateTarget{},
+	}
+	for port := 1; port <= associateMaxDestinations+10; port++ {
+		datagram := appendAddrSpec([]byte{0, 0, 0}, &AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		a.forward(append(datagram, "ping"...))
+	}
+	if len(a.decisions) != associateMaxDestinations || len(a.targets) != associateMaxDestinations {
+		t.Fatalf("expected at most %d destinations kept, got %d decisions and %d targets", associateMaxDestinations, len(a.decisions), len(a.targets))
+	}
+
+	// targets which did not get datagrams for long make room
+	for key, target := range a.targets {
+		target.at = target.at.Add(-associateTargetTTL)
+		a.targets[key] = target
+		break
+	}
+	datagram := appendAddrSpec([]byte{0, 0, 0}, &AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 65000})
+	a.forward(append(datagram, "ping"...))
+	if _, ok := a.targets["127.0.0.1:65000"]; !ok {
+		t.Fatal("expected a new target to replace an expired one")
+	}
+}
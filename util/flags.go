@@ -0,0 +1,35 @@
+package util
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EnvPrefix is put in front of flag names to name their environment variables
+const EnvPrefix = "SOCKS_"
+
+// EnvName is the environment variable a flag falls back to, like
+// SOCKS_AUTH_CACHE_MAX_USERS for -auth-cache-max-users
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// ParseFlags parses the command line like flag.Parse, but flags not given
+// on the command line fall back to their environment variable, before
+// falling back to their default. The usage of every flag names its
+// environment variable.
+func ParseFlags() {
+	flag.VisitAll(func(f *flag.Flag) {
+		name := EnvName(f.Name)
+		f.Usage += " (env " + name + ")"
+		if value, ok := os.LookupEnv(name); ok {
+			if err := f.Value.Set(value); err != nil {
+				fmt.Fprintf(os.Stderr, "invalid value %q for %s: %v\n", value, name, err)
+				os.Exit(2)
+			}
+		}
+	})
+	flag.Parse()
+}
@@ -0,0 +1,39 @@
+package util
+
+import (
+	"context"
+	"net"
+)
+
+// ListenOptions tune listening tcp sockets. Platform support:
+//
+//   - ReusePort works on linux, the BSDs and macOS, where it lets several
+//     processes or listeners accept on the same port
+//   - Backlog works on linux, the BSDs and macOS, where it is still capped
+//     by the kernel setting net.core.somaxconn resp. kern.ipc.somaxconn
+//
+// Listen fails when an option is set on a platform not supporting it.
+type ListenOptions struct {
+	ReusePort bool
+	// Backlog of connections waiting to be accepted, 0 keeps the default
+	Backlog int
+}
+
+// Listen listens for tcp connections on address with the options applied
+func Listen(address string, options ListenOptions) (net.Listener, error) {
+	config := net.ListenConfig{}
+	if options.ReusePort {
+		config.Control = reusePort
+	}
+	listener, err := config.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if options.Backlog > 0 {
+		if err := setBacklog(listener.(*net.TCPListener), options.Backlog); err != nil {
+			SilentClose(listener)
+			return nil, err
+		}
+	}
+	return listener, nil
+}
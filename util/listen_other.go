@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package util
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errListenOptionUnsupported = errors.New("listen option not supported on this platform")
+
+func reusePort(network, address string, conn syscall.RawConn) error {
+	return errListenOptionUnsupported
+}
+
+func setBacklog(listener *net.TCPListener, backlog int) error {
+	return errListenOptionUnsupported
+}
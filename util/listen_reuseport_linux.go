@@ -0,0 +1,6 @@
+//go:build linux && (386 || amd64 || arm)
+
+package util
+
+// soReusePort is missing from package syscall on these platforms
+const soReusePort = 0xf
@@ -0,0 +1,34 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package util
+
+import (
+	"net"
+	"syscall"
+)
+
+func reusePort(network, address string, conn syscall.RawConn) error {
+	var sockErr error
+	if err := conn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// setBacklog calls listen again on the listening socket, which just updates
+// the backlog
+func setBacklog(listener *net.TCPListener, backlog int) error {
+	conn, err := listener.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	if err := conn.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	return listenErr
+}
@@ -0,0 +1,18 @@
+package util
+
+import (
+	"go.uber.org/zap"
+)
+
+// NewLogger builds a production json logger logging at level, one of debug,
+// info, warn or error. It writes to file if given and to stderr otherwise.
+func NewLogger(level string, file string) (*zap.Logger, error) {
+	config := zap.NewProductionConfig()
+	if err := config.Level.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	if file != "" {
+		config.OutputPaths = []string{file}
+	}
+	return config.Build()
+}
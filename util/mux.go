@@ -0,0 +1,516 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// MuxPreface is sent by a mux client before its first frame, so servers
+// can tell multiplexed connections apart from plain socks ones
+var MuxPreface = []byte("hello-socks-mux/1\n")
+
+// A mux frame is a 1 byte type, a 4 byte stream id and a 4 byte length,
+// followed by length bytes of payload for data frames. Window frames grant
+// the peer length more bytes to send on the stream.
+const (
+	muxFrameOpen   = 1
+	muxFrameData   = 2
+	muxFrameWindow = 3
+	muxFrameClose  = 4
+	muxFrameReset  = 5
+
+	muxHeaderSize = 9
+	// muxMaxPayload is the largest payload of a data frame
+	muxMaxPayload = 16 * 1024
+	// muxWindow is how many bytes a stream buffers unread at most, so a
+	// slow stream does not hold up the others
+	muxWindow = 256 * 1024
+	// muxAcceptBacklog is how many streams opened by the peer wait to be
+	// accepted, further ones are reset
+	muxAcceptBacklog = 256
+)
+
+// ErrMuxClosed is returned by streams of a closed MuxSession
+var ErrMuxClosed = errors.New("mux session closed")
+
+var errMuxReset = errors.New("mux stream reset by peer")
+
+// MuxSession carries many streams over a single connection, like a TLS
+// connection to the server, so they share its handshake. Clients open
+// streams with odd ids, servers with even ones.
+type MuxSession struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	streams   map[uint32]*MuxStream
+	nextID    uint32
+	accepted  chan *MuxStream
+	// maxStreams caps the streams the peer may have open at once, further
+	// ones are reset, 0 means unlimited
+	maxStreams int
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewMuxClient sends the preface on conn and starts a session opening
+// streams
+func NewMuxClient(conn net.Conn) (*MuxSession, error) {
+	if _, err := conn.Write(MuxPreface); err != nil {
+		return nil, err
+	}
+	return newMuxSession(conn, 1, 0), nil
+}
+
+// NewMuxServer starts a session accepting up to maxStreams open streams at
+// once on conn, 0 means unlimited. Its preface has to be read already.
+func NewMuxServer(conn net.Conn, maxStreams int) *MuxSession {
+	return newMuxSession(conn, 2, maxStreams)
+}
+
+func newMuxSession(conn net.Conn, firstID uint32, maxStreams int) *MuxSession {
+	s := &MuxSession{
+		conn:       conn,
+		streams:    map[uint32]*MuxStream{},
+		nextID:     firstID,
+		accepted:   make(chan *MuxStream, muxAcceptBacklog),
+		maxStreams: maxStreams,
+		done:       make(chan struct{}),
+	}
+	go s.readFrames()
+	return s
+}
+
+// Open opens a new stream to the peer
+func (s *MuxSession) Open() (*MuxStream, error) {
+	s.lock.Lock()
+	if s.IsClosed() {
+		s.lock.Unlock()
+		return nil, ErrMuxClosed
+	}
+	stream := newMuxStream(s, s.nextID)
+	s.nextID += 2
+	s.streams[stream.id] = stream
+	s.lock.Unlock()
+
+	if err := s.writeFrame(muxFrameOpen, stream.id, 0, nil); err != nil {
+		s.remove(stream.id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for the next stream opened by the peer
+func (s *MuxSession) Accept() (*MuxStream, error) {
+	select {
+	case stream := <-s.accepted:
+		return stream, nil
+	case <-s.done:
+		return nil, ErrMuxClosed
+	}
+}
+
+// NumStreams returns the number of open streams
+func (s *MuxSession) NumStreams() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.streams)
+}
+
+// Done is closed once the session ended
+func (s *MuxSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// IsClosed tells if the session ended, its streams fail then
+func (s *MuxSession) IsClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close ends the session along with all of its streams
+func (s *MuxSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		_ = s.conn.Close()
+	})
+	return nil
+}
+
+func (s *MuxSession) stream(id uint32) *MuxStream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams[id]
+}
+
+func (s *MuxSession) remove(id uint32) {
+	s.lock.Lock()
+	delete(s.streams, id)
+	s.lock.Unlock()
+}
+
+// readFrames hands the frames read from the connection to their streams
+// until the connection fails. It never blocks on a stream, data frames
+// are buffered within the window of their stream.
+func (s *MuxSession) readFrames() {
+	defer s.Close()
+	header := make([]byte, muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			return
+		}
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint32(header[5:9])
+		if err := s.handleFrame(header[0], id, length); err != nil {
+			return
+		}
+	}
+}
+
+func (s *MuxSession) handleFrame(frameType byte, id, length uint32) error {
+	switch frameType {
+	case muxFrameOpen:
+		s.lock.Lock()
+		if id%2 == s.nextID%2 || s.streams[id] != nil {
+			s.lock.Unlock()
+			return fmt.Errorf("mux stream %d opened twice", id)
+		}
+		if s.maxStreams > 0 && len(s.streams) >= s.maxStreams {
+			s.lock.Unlock()
+			return s.writeFrame(muxFrameReset, id, 0, nil)
+		}
+		stream := newMuxStream(s, id)
+		s.streams[id] = stream
+		s.lock.Unlock()
+		select {
+		case s.accepted <- stream:
+		default:
+			s.remove(id)
+			return s.writeFrame(muxFrameReset, id, 0, nil)
+		}
+	case muxFrameData:
+		if length > muxMaxPayload {
+			return fmt.Errorf("mux frame of %d bytes too large", length)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			return err
+		}
+		if stream := s.stream(id); stream != nil {
+			return stream.received(payload)
+		}
+	case muxFrameWindow:
+		if stream := s.stream(id); stream != nil {
+			stream.granted(length)
+		}
+	case muxFrameClose:
+		if stream := s.stream(id); stream != nil {
+			stream.remoteClosed()
+		}
+	case muxFrameReset:
+		if stream := s.stream(id); stream != nil {
+			stream.remoteReset()
+		}
+	default:
+		return fmt.Errorf("unknown mux frame type %d", frameType)
+	}
+	return nil
+}
+
+// writeFrame writes a frame at once, a failing write ends the session
+func (s *MuxSession) writeFrame(frameType byte, id, length uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderSize+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], length)
+	copy(frame[muxHeaderSize:], payload)
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.IsClosed() {
+		return ErrMuxClosed
+	}
+	if _, err := s.conn.Write(frame); err != nil {
+		_ = s.Close()
+		return err
+	}
+	return nil
+}
+
+// MuxStream is a connection carried by a MuxSession. Like tcp, closing a
+// stream ends both directions, while CloseWrite only ends the sending one.
+type MuxStream struct {
+	session *MuxSession
+	id      uint32
+	lock    sync.Mutex
+	buf     bytes.Buffer
+	// recvWindow is how many bytes the peer may still send
+	recvWindow uint32
+	// unacked bytes were read but not granted back to the peer yet
+	unacked uint32
+	// sendWindow is how many bytes may still be sent to the peer
+	sendWindow uint32
+	// readClosed the peer will not send any more
+	readClosed bool
+	// writeClosed the close frame was sent
+	writeClosed bool
+	// closed the stream was closed locally
+	closed bool
+	reset  bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readReady     chan struct{}
+	writeReady    chan struct{}
+}
+
+func newMuxStream(session *MuxSession, id uint32) *MuxStream {
+	return &MuxStream{
+		session:    session,
+		id:         id,
+		recvWindow: muxWindow,
+		sendWindow: muxWindow,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+func (c *MuxStream) Read(b []byte) (int, error) {
+	for {
+		c.lock.Lock()
+		if c.buf.Len() > 0 && !c.closed {
+			n, _ := c.buf.Read(b)
+			c.unacked += uint32(n)
+			grant := uint32(0)
+			if c.unacked >= muxWindow/2 {
+				grant, c.unacked = c.unacked, 0
+				c.recvWindow += grant
+			}
+			c.lock.Unlock()
+			if grant > 0 {
+				_ = c.session.writeFrame(muxFrameWindow, c.id, grant, nil)
+			}
+			return n, nil
+		}
+		err := c.readErr()
+		deadline := c.readDeadline
+		c.lock.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if err := c.wait(c.readReady, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readErr tells why nothing is left to read, nil if more may come
+func (c *MuxStream) readErr() error {
+	switch {
+	case c.closed:
+		return net.ErrClosed
+	case c.readClosed:
+		return io.EOF
+	case c.reset:
+		return errMuxReset
+	case c.session.IsClosed():
+		return ErrMuxClosed
+	}
+	return nil
+}
+
+func (c *MuxStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		c.lock.Lock()
+		err := c.writeErr()
+		window := c.sendWindow
+		deadline := c.writeDeadline
+		if err == nil && window > 0 {
+			n := uint32(len(b))
+			if n > muxMaxPayload {
+				n = muxMaxPayload
+			}
+			if n > window {
+				n = window
+			}
+			c.sendWindow -= n
+			c.lock.Unlock()
+			if err := c.session.writeFrame(muxFrameData, c.id, n, b[:n]); err != nil {
+				return written, err
+			}
+			written += int(n)
+			b = b[n:]
+			continue
+		}
+		c.lock.Unlock()
+		if err != nil {
+			return written, err
+		}
+		if err := c.wait(c.writeReady, deadline); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// writeErr tells why nothing can be written, nil if it can
+func (c *MuxStream) writeErr() error {
+	switch {
+	case c.closed || c.writeClosed:
+		return net.ErrClosed
+	case c.reset:
+		return errMuxReset
+	case c.session.IsClosed():
+		return ErrMuxClosed
+	}
+	return nil
+}
+
+// wait blocks until ready is signalled, the session ends or the deadline
+// passes
+func (c *MuxStream) wait(ready chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		until := time.Until(deadline)
+		if until <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(until)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ready:
+	case <-c.session.done:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// muxSignal wakes up a waiting Read or Write
+func muxSignal(ready chan struct{}) {
+	select {
+	case ready <- struct{}{}:
+	default:
+	}
+}
+
+// CloseWrite tells the peer nothing more will be sent, it can still send
+func (c *MuxStream) CloseWrite() error {
+	c.lock.Lock()
+	if c.writeClosed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.writeClosed = true
+	done := c.readClosed || c.reset
+	c.lock.Unlock()
+	muxSignal(c.writeReady)
+	if done {
+		c.session.remove(c.id)
+	}
+	return c.session.writeFrame(muxFrameClose, c.id, 0, nil)
+}
+
+// Close ends both directions. Data the peer sends afterwards resets the
+// stream, like a tcp connection answers with a reset.
+func (c *MuxStream) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.lock.Unlock()
+	muxSignal(c.readReady)
+	return c.CloseWrite()
+}
+
+// received buffers payload for Read, a payload exceeding the window is a
+// protocol error ending the session
+func (c *MuxStream) received(payload []byte) error {
+	c.lock.Lock()
+	if uint32(len(payload)) > c.recvWindow {
+		c.lock.Unlock()
+		return fmt.Errorf("mux stream %d exceeded its window", c.id)
+	}
+	if c.closed {
+		c.reset = true
+		c.lock.Unlock()
+		c.session.remove(c.id)
+		return c.session.writeFrame(muxFrameReset, c.id, 0, nil)
+	}
+	c.recvWindow -= uint32(len(payload))
+	c.buf.Write(payload)
+	c.lock.Unlock()
+	muxSignal(c.readReady)
+	return nil
+}
+
+func (c *MuxStream) granted(n uint32) {
+	c.lock.Lock()
+	c.sendWindow += n
+	c.lock.Unlock()
+	muxSignal(c.writeReady)
+}
+
+func (c *MuxStream) remoteClosed() {
+	c.lock.Lock()
+	c.readClosed = true
+	done := c.writeClosed
+	c.lock.Unlock()
+	muxSignal(c.readReady)
+	if done {
+		c.session.remove(c.id)
+	}
+}
+
+func (c *MuxStream) remoteReset() {
+	c.lock.Lock()
+	c.reset = true
+	c.lock.Unlock()
+	muxSignal(c.readReady)
+	muxSignal(c.writeReady)
+	c.session.remove(c.id)
+}
+
+func (c *MuxStream) LocalAddr() net.Addr {
+	return c.session.conn.LocalAddr()
+}
+
+func (c *MuxStream) RemoteAddr() net.Addr {
+	return c.session.conn.RemoteAddr()
+}
+
+func (c *MuxStream) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *MuxStream) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline = t
+	c.lock.Unlock()
+	muxSignal(c.readReady)
+	return nil
+}
+
+func (c *MuxStream) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.writeDeadline = t
+	c.lock.Unlock()
+	muxSignal(c.writeReady)
+	return nil
+}
@@ -0,0 +1,221 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestMuxPair returns a client session and the server session it is
+// connected to
+func newTestMuxPair(t *testing.T, maxStreams int) (client, server *MuxSession) {
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		preface := make([]byte, len(MuxPreface))
+		_, _ = io.ReadFull(serverConn, preface)
+	}()
+	client, err := NewMuxClient(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = NewMuxServer(serverConn, maxStreams)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+// openTestStreams opens a stream on client and accepts it on server
+func openTestStreams(t *testing.T, client, server *MuxSession) (*MuxStream, *MuxStream) {
+	opened, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opened, accepted
+}
+
+// writeTestFrame writes a raw frame to conn
+func writeTestFrame(t *testing.T, conn net.Conn, frameType byte, id, length uint32, payload []byte) {
+	frame := make([]byte, muxHeaderSize, muxHeaderSize+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], length)
+	if _, err := conn.Write(append(frame, payload...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	client, server := newTestMuxPair(t, 0)
+	opened, accepted := openTestStreams(t, client, server)
+
+	// the writer stops once the window of the unread stream is used up
+	payload := bytes.Repeat([]byte("0123456789abcdef"), muxWindow/8)
+	_ = opened.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	written, err := opened.Write(payload)
+	if !errors.Is(err, os.ErrDeadlineExceeded) || written != muxWindow {
+		t.Fatalf("expected %d bytes written before the deadline, got %d %v", muxWindow, written, err)
+	}
+
+	// reading grants the window back, so the rest goes through
+	_ = opened.SetWriteDeadline(time.Time{})
+	rest := make(chan error, 1)
+	go func() {
+		_, err := opened.Write(payload[written:])
+		rest <- err
+	}()
+	received := make([]byte, len(payload))
+	_ = accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(accepted, received); err != nil || !bytes.Equal(received, payload) {
+		t.Fatalf("expected the payload to be received, got %v", err)
+	}
+	if err := <-rest; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxWindowExceeded(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	server := NewMuxServer(serverConn, 0)
+	defer server.Close()
+	go func() { _, _ = io.Copy(io.Discard, clientConn) }()
+
+	writeTestFrame(t, clientConn, muxFrameOpen, 1, 0, nil)
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	chunk := make([]byte, muxMaxPayload)
+	for sent := 0; sent < muxWindow; sent += len(chunk) {
+		writeTestFrame(t, clientConn, muxFrameData, 1, uint32(len(chunk)), chunk)
+	}
+	// a peer sending beyond the window breaks the protocol
+	writeTestFrame(t, clientConn, muxFrameData, 1, 1, []byte{0})
+	select {
+	case <-server.Done():
+	case <-time.After(time.Second):
+		t.Fatal("session exceeding a window was not closed")
+	}
+}
+
+func TestMuxFrameErrors(t *testing.T) {
+	for name, frame := range map[string][]byte{
+		"too large":    {muxFrameData, 0, 0, 0, 1, 0, 1, 0, 0},
+		"unknown type": {9, 0, 0, 0, 1, 0, 0, 0, 0},
+		"server id":    {muxFrameOpen, 0, 0, 0, 2, 0, 0, 0, 0},
+	} {
+		clientConn, serverConn := net.Pipe()
+		server := NewMuxServer(serverConn, 0)
+		go func() { _, _ = io.Copy(io.Discard, clientConn) }()
+		if _, err := clientConn.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-server.Done():
+		case <-time.After(time.Second):
+			t.Errorf("%s: session was not closed", name)
+		}
+		_ = clientConn.Close()
+	}
+}
+
+func TestMuxReset(t *testing.T) {
+	client, server := newTestMuxPair(t, 1)
+	opened, accepted := openTestStreams(t, client, server)
+
+	// streams beyond the cap are reset
+	beyond, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = beyond.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := beyond.Read(make([]byte, 1)); !errors.Is(err, errMuxReset) {
+		t.Errorf("expected the stream beyond the cap to be reset, got %v", err)
+	}
+
+	// data sent to a closed stream resets it
+	if err := accepted.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_ = opened.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := opened.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF once the peer closed, got %v", err)
+	}
+	if _, err := opened.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, err = opened.Write([]byte("x")); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !errors.Is(err, errMuxReset) {
+		t.Errorf("expected writes to a closed stream to be reset, got %v", err)
+	}
+	if deadline := time.Now().Add(time.Second); server.NumStreams() != 0 {
+		for server.NumStreams() != 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := server.NumStreams(); n != 0 {
+			t.Errorf("expected no open streams, got %d", n)
+		}
+	}
+}
+
+func TestMuxClose(t *testing.T) {
+	client, server := newTestMuxPair(t, 0)
+	opened, accepted := openTestStreams(t, client, server)
+
+	// a half closed stream still carries the other direction
+	if _, err := opened.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if err := opened.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	_ = accepted.SetReadDeadline(time.Now().Add(time.Second))
+	if received, err := io.ReadAll(accepted); err != nil || string(received) != "ping" {
+		t.Fatalf("expected ping and EOF, got %q %v", received, err)
+	}
+	if _, err := accepted.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if err := accepted.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_ = opened.SetReadDeadline(time.Now().Add(time.Second))
+	if received, err := io.ReadAll(opened); err != nil || string(received) != "pong" {
+		t.Fatalf("expected pong and EOF, got %q %v", received, err)
+	}
+	if _, err := opened.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected writes after CloseWrite to fail, got %v", err)
+	}
+
+	// closing the session fails its streams
+	opened, accepted = openTestStreams(t, client, server)
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := opened.Write([]byte("x")); !errors.Is(err, ErrMuxClosed) {
+		t.Errorf("expected writes to fail on a closed session, got %v", err)
+	}
+	_ = accepted.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := accepted.Read(make([]byte, 1)); !errors.Is(err, ErrMuxClosed) {
+		t.Errorf("expected reads to fail once the peer closed the session, got %v", err)
+	}
+	if _, err := client.Open(); !errors.Is(err, ErrMuxClosed) {
+		t.Errorf("expected opening on a closed session to fail, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// PaddedFrameSize is the size of every frame sent by a PaddedConn. A frame
+// is a 2 byte payload length followed by the payload, padded with zeros to
+// the full frame size, so the tunnel only ever carries multiples of it.
+//
+// The overhead is at least 2 bytes per frame (~0.2%) for bulk transfers, but
+// a small write still costs a whole frame, so interactive traffic with lots
+// of tiny writes can grow by up to PaddedFrameSize bytes per write.
+const PaddedFrameSize = 1024
+
+const maxPaddedPayload = PaddedFrameSize - 2
+
+var errInvalidFrame = errors.New("invalid padded frame")
+
+// PaddedConn chunks and pads everything written to it into fixed size
+// frames and strips the padding from frames read from it. Both ends of the
+// tunnel have to use it.
+type PaddedConn struct {
+	net.Conn
+	readFrame  [PaddedFrameSize]byte
+	writeFrame [PaddedFrameSize]byte
+	pending    []byte
+}
+
+func NewPaddedConn(conn net.Conn) *PaddedConn {
+	return &PaddedConn{Conn: conn}
+}
+
+func (c *PaddedConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if _, err := io.ReadFull(c.Conn, c.readFrame[:]); err != nil {
+			return 0, err
+		}
+		n := int(binary.BigEndian.Uint16(c.readFrame[:2]))
+		if n > maxPaddedPayload {
+			return 0, errInvalidFrame
+		}
+		c.pending = c.readFrame[2 : 2+n]
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *PaddedConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := copy(c.writeFrame[2:], b)
+		binary.BigEndian.PutUint16(c.writeFrame[:2], uint16(n))
+		for i := 2 + n; i < PaddedFrameSize; i++ {
+			c.writeFrame[i] = 0
+		}
+		if _, err := c.Conn.Write(c.writeFrame[:]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite keeps half closing working for wrapped tcp and tls connections
+func (c *PaddedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package util
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// TokenBucket limits throughput to a rate in bytes per second. The rate is
+// looked up on every call, so it may change over time, and a rate <= 0
+// means unlimited. Up to one second worth of bytes may be burst.
+type TokenBucket struct {
+	lock   sync.Mutex
+	rate   func() int64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns an empty bucket
+func NewTokenBucket(rate func() int64) *TokenBucket {
+	return &TokenBucket{rate: rate, last: time.Now()}
+}
+
+// NewFullTokenBucket returns a bucket holding one second worth already, or
+// burst if more, as TryTake(burst) holds at most
+func NewFullTokenBucket(rate func() int64, burst int) *TokenBucket {
+	b := &TokenBucket{rate: rate, tokens: float64(rate()), last: time.Now()}
+	if b.tokens < float64(burst) {
+		b.tokens = float64(burst)
+	}
+	return b
+}
+
+// Wait takes n bytes from the bucket, blocking as long as needed to stay
+// within the rate
+func (b *TokenBucket) Wait(n int) {
+	b.lock.Lock()
+	rate, ok := b.refill(0)
+	if !ok {
+		b.lock.Unlock()
+		return
+	}
+	b.tokens -= float64(n)
+	wait := time.Duration(-b.tokens / rate * float64(time.Second))
+	b.lock.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// TryTake takes n tokens if the bucket holds them, without blocking. Up to
+// n tokens are held even beyond one second worth, so any n is taken
+// eventually.
+func (b *TokenBucket) TryTake(n int) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.refill(float64(n)); !ok {
+		return true
+	}
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// refill adds the tokens accumulated since the last call, holding up to one
+// second worth or burst if more. It returns the rate, false if unlimited.
+func (b *TokenBucket) refill(burst float64) (float64, bool) {
+	rate := float64(b.rate())
+	now := time.Now()
+	if rate <= 0 {
+		b.tokens = 0
+		b.last = now
+		return rate, false
+	}
+	if burst < rate {
+		burst = rate
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	return rate, true
+}
+
+// RateLimitedConn throttles reads and writes of a connection with a
+// TokenBucket, which may be shared with other connections
+type RateLimitedConn struct {
+	net.Conn
+	bucket *TokenBucket
+}
+
+func NewRateLimitedConn(conn net.Conn, bucket *TokenBucket) *RateLimitedConn {
+	return &RateLimitedConn{Conn: conn, bucket: bucket}
+}
+
+func (c *RateLimitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.bucket.Wait(n)
+	}
+	return n, err
+}
+
+func (c *RateLimitedConn) Write(b []byte) (int, error) {
+	c.bucket.Wait(len(b))
+	return c.Conn.Write(b)
+}
+
+// CloseWrite keeps half closing working for wrapped tcp connections
+func (c *RateLimitedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
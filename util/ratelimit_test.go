@@ -0,0 +1,30 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTryTake(t *testing.T) {
+	rate := int64(100)
+	b := NewFullTokenBucket(func() int64 { return rate }, 0)
+	if !b.TryTake(60) || b.TryTake(60) {
+		t.Fatal("expected one second worth to be taken at once only")
+	}
+
+	// more than one second worth is held, so it is taken eventually
+	b = NewFullTokenBucket(func() int64 { return rate }, 150)
+	if !b.TryTake(150) || b.TryTake(150) {
+		t.Fatal("expected the burst to be held once")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if b.TryTake(150) {
+		t.Fatal("expected the bucket to refill at the rate")
+	}
+
+	// a rate <= 0 is unlimited
+	rate = 0
+	if !b.TryTake(1000) {
+		t.Fatal("expected to take anything without a rate")
+	}
+}
@@ -0,0 +1,65 @@
+package util
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a tls version like 1.2
+func ParseTLSVersion(version string) (uint16, error) {
+	if v, ok := tlsVersions[version]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown tls version %q, use one of 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// ParseCipherSuites parses comma separated cipher suite names like
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Only secure suites configurable for
+// tls 1.2 and below are accepted, the tls 1.3 ones are always enabled. An
+// empty list returns nil, keeping the go defaults.
+func ParseCipherSuites(names string) ([]uint16, error) {
+	if strings.TrimSpace(names) == "" {
+		return nil, nil
+	}
+	secure := map[string]*tls.CipherSuite{}
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite
+	}
+	insecure := map[string]bool{}
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	ids := []uint16{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		suite, ok := secure[name]
+		switch {
+		case insecure[name]:
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		case !ok:
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		case !supportsTLS12(suite):
+			return nil, fmt.Errorf("cipher suite %s is tls 1.3 only, those can not be configured", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+func supportsTLS12(suite *tls.CipherSuite) bool {
+	for _, version := range suite.SupportedVersions {
+		if version <= tls.VersionTLS12 {
+			return true
+		}
+	}
+	return false
+}
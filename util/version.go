@@ -0,0 +1,17 @@
+package util
+
+import "fmt"
+
+// Build information, set when building like
+//
+//	go build -ldflags "-X util.Version=1.2.0 -X util.Commit=$(git rev-parse --short HEAD) -X util.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// VersionString describes the build for -version flags
+func VersionString(program string) string {
+	return fmt.Sprintf("%s %s (commit %s, built %s)", program, Version, Commit, BuildDate)
+}